@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// registerAdminHandlers adds the /admin, /api, /auth and /metrics endpoints,
+// which are shared by every authentication type.
+func registerAdminHandlers() {
+	http.Handle("/admin/plan", adminOnly(planHandler))
+	http.Handle("/admin/drift", adminOnly(driftHandler))
+	http.Handle("/admin/retries", adminOnly(retriesHandler))
+	http.Handle("/admin/tokens", adminOnly(tokensHandler))
+	http.Handle("/api/whitelist", handle(whitelistTokenHandler))
+	http.Handle("/auth", handle(forwardAuthHandler))
+	http.Handle("/revoke", handle(revokeHandler))
+	http.Handle("/status", handle(statusHandler))
+	http.Handle("/extend", handle(extendHandler))
+	http.Handle("/metrics", handle(metricsHandler))
+	registerApiHandlers()
+	registerDashboardHandlers()
+}
+
+// adminOnly guards an admin endpoint with the configured admin token, sent as
+// "Authorization: Bearer <token>". Without a configured token the admin
+// endpoints don't exist.
+func adminOnly(next handle) handle {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		if c.Admin.Token == "" {
+			return Error{Code: http.StatusNotFound}
+		}
+		if !isAdminToken(bearerToken(req)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return Error{Code: http.StatusUnauthorized}
+		}
+		return next(w, req)
+	}
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+func isAdminToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.Admin.Token)) == 1
+}
+
+// planHandler shows what a sync would change on every resource, without
+// applying anything. JSON by default, or the -plan CLI output with
+// ?format=text.
+func planHandler(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+
+	list, err := r.getWhitelist(req.Context())
+	if err != nil {
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not read the whitelist"}
+	}
+	plans := planResources(req.Context(), p.enabled(), list, r.getGroups)
+
+	if req.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writePlan(w, plans)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(plans)
+}
+
+// driftHandler returns the last drift report, or with POST runs a drift check
+// now and returns its report.
+func driftHandler(w http.ResponseWriter, req *http.Request) error {
+	var report *DriftReport
+	switch req.Method {
+	case http.MethodGet:
+		lastDrift.mu.RLock()
+		report = lastDrift.report
+		lastDrift.mu.RUnlock()
+		if report == nil {
+			return Error{Code: http.StatusNotFound, Message: "no drift check has run yet"}
+		}
+	case http.MethodPost:
+		dr, err := checkDrift()
+		if err != nil {
+			return Error{Code: http.StatusServiceUnavailable, Message: "could not read the whitelist"}
+		}
+		report = &dr
+	default:
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(report)
+}
+
+// retriesHandler lists the resource updates waiting to be retried.
+func retriesHandler(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(q.list())
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminOnly(t *testing.T) {
+	defer func() { c.Admin.Token = "" }()
+
+	next := handle(func(w http.ResponseWriter, req *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	tests := []struct {
+		token  string
+		header string
+		want   int
+	}{
+		{"", "", http.StatusNotFound},
+		{"", "Bearer ", http.StatusNotFound},
+		{"s3cr3t", "", http.StatusUnauthorized},
+		{"s3cr3t", "Bearer wrong", http.StatusUnauthorized},
+		{"s3cr3t", "Basic s3cr3t", http.StatusUnauthorized},
+		{"s3cr3t", "Bearer s3cr3t", http.StatusOK},
+		{"s3cr3t", "bearer s3cr3t", http.StatusOK},
+	}
+
+	for _, f := range tests {
+		c.Admin.Token = f.token
+		req := httptest.NewRequest(http.MethodGet, "/admin/plan", nil)
+		if f.header != "" {
+			req.Header.Set("Authorization", f.header)
+		}
+		rec := httptest.NewRecorder()
+		adminOnly(next).ServeHTTP(rec, req)
+		if rec.Code != f.want {
+			t.Errorf("token %q, Authorization %q: got %d, want %d", f.token, f.header, rec.Code, f.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Whitelisting is a whitelist entry, as the api and the command-line client
+// see it.
+type Whitelisting struct {
+	Key       string    `json:"key,omitempty"`
+	Name      string    `json:"name"`
+	IP        string    `json:"ip"`
+	Expires   time.Time `json:"expires"`
+	Resources []string  `json:"resources,omitempty"` // ids of the resources the IP is whitelisted on
+}
+
+// apiHandle serves an /api/v1 endpoint. Unlike handle it writes errors as
+// JSON, {"error": {"code": 404, "message": "Not Found"}}, and hides the
+// details of errors that aren't an Error.
+type apiHandle func(w http.ResponseWriter, req *http.Request) error
+
+func (h apiHandle) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	err := h(w, req)
+	if err == nil {
+		return
+	}
+	log.Printf("api.ServeHTTP(): %v", err)
+	httpErr, ok := err.(Error)
+	if !ok {
+		httpErr = Error{Code: http.StatusInternalServerError}
+	}
+	if httpErr.Message == "" {
+		httpErr.Message = http.StatusText(httpErr.Code)
+	}
+	if httpErr.Code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeJSON(w, httpErr.Code, struct {
+		Error Error `json:"error"`
+	}{httpErr})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func registerApiHandlers() {
+	http.Handle("/api/v1/whitelist", apiHandle(apiWhitelistHandler))
+	http.Handle("/api/v1/resources", apiHandle(apiResourcesHandler))
+}
+
+// apiWhitelistHandler manages the caller's whitelisting: GET reads it, POST
+// creates or renews it for the caller's current IP, and DELETE removes it and
+// reports the resources it was taken off.
+func apiWhitelistHandler(w http.ResponseWriter, req *http.Request) error {
+	u, t, err := apiCaller(req)
+	if err != nil {
+		return err
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		wl, err := currentWhitelisting(req, u)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, wl)
+
+	case http.MethodPost:
+		if err := chooseTTL(req, u, t); err != nil {
+			return err
+		}
+		if !u.whitelist() {
+			return Error{Code: http.StatusServiceUnavailable, Message: "could not whitelist " + u.ip}
+		}
+		return writeJSON(w, http.StatusOK, Whitelisting{
+			Key:       u.key,
+			Name:      u.name,
+			IP:        u.cidr,
+			Expires:   time.Now().Add(u.lifetime()).UTC().Truncate(time.Second),
+			Resources: coveredResources(u),
+		})
+
+	case http.MethodDelete:
+		rv, err := revoke(req, u)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, rv)
+
+	default:
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+}
+
+// apiResourcesHandler lists the resources the caller's whitelisting applies
+// to, or would apply to from their current IP when they have none.
+func apiResourcesHandler(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	u, _, err := apiCaller(req)
+	if err != nil {
+		return err
+	}
+	resources := coveredResources(u)
+	if wl, err := currentWhitelisting(req, u); err == nil {
+		resources = wl.Resources
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Resources []string `json:"resources"`
+	}{resources})
+}
+
+// chooseTTL applies the ttl form value, in hours, to u's whitelisting: up to
+// the token's max_ttl when whitelisting with one, and up to u's maxLifetime.
+// Without it the whitelisting lasts as long as the token allows, or ttl.
+func chooseTTL(req *http.Request, u *User, t *ApiToken) error {
+	hours := hoursParam(req, "ttl")
+	if t != nil {
+		var err error
+		if u.ttl, err = t.ttl(hours); err != nil {
+			return Error{Code: http.StatusBadRequest, Message: err.Error()}
+		}
+	}
+	if hours != 0 {
+		if err := u.chooseLifetime(hours); err != nil {
+			return Error{Code: http.StatusBadRequest, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+// currentWhitelisting reads u's whitelist entry as it's stored, with the
+// groups it was made with.
+func currentWhitelisting(req *http.Request, u *User) (Whitelisting, error) {
+	cidr, ttl, err := r.getIp(req.Context(), u.key)
+	if err != nil {
+		log.Print("api.currentWhitelisting(): ", err)
+		return Whitelisting{}, Error{Code: http.StatusServiceUnavailable, Message: "could not read the whitelist"}
+	}
+	if cidr == "" {
+		return Whitelisting{}, Error{Code: http.StatusNotFound, Message: "you aren't whitelisted"}
+	}
+	stored := User{key: u.key, cidr: cidr, groups: r.getGroups(u.key)}
+	return Whitelisting{
+		Key:       u.key,
+		Name:      u.name,
+		IP:        cidr,
+		Expires:   time.Now().Add(ttl).UTC().Truncate(time.Second),
+		Resources: coveredResources(&stored),
+	}, nil
+}
+
+// apiCaller works out who is calling the api, from their api token or
+// AzureAD access token, or else as the browser pages would: the sign-in
+// session, or the proxy's headers in auth.type: none. The api token is
+// returned too when one was used.
+func apiCaller(req *http.Request) (*User, *ApiToken, error) {
+	if secret := bearerToken(req); secret != "" {
+		if strings.HasPrefix(secret, tokenPrefix) {
+			return tokenUser(req)
+		}
+		if strings.EqualFold(c.Auth.Type, "azure") {
+			if err := checkClientIP(req); err != nil {
+				return nil, nil, err
+			}
+			u, err := cliUser(req)
+			return u, nil, err
+		}
+		return nil, nil, Error{Code: http.StatusUnauthorized, Message: "unknown token"}
+	}
+
+	if err := checkClientIP(req); err != nil {
+		return nil, nil, err
+	}
+	switch strings.ToLower(c.Auth.Type) {
+	case "none", "disabled":
+		u, err := noAuthUser(req)
+		return u, nil, err
+	}
+
+	session, _ := store.Get(req, "session")
+	key, _ := session.Values["key"].(string)
+	if key == "" {
+		return nil, nil, Error{Code: http.StatusUnauthorized, Message: "sign in first, or send a token"}
+	}
+	u := User{}
+	u.name, _ = session.Values["name"].(string)
+	u.groups, _ = session.Values["groups"].([]string)
+	if err := u.finishUser(key, req); err != nil {
+		return nil, nil, Error{Code: http.StatusForbidden, Message: "Your IP address can't be whitelisted"}
+	}
+	return &u, nil, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestApiHandleErrors(t *testing.T) {
+	c.Debug = false
+
+	tests := []struct {
+		err      error
+		wantCode int
+		wantBody string
+	}{
+		{Error{Code: http.StatusNotFound, Message: "you aren't whitelisted"}, http.StatusNotFound, `{"error":{"code":404,"message":"you aren't whitelisted"}}`},
+		{Error{Code: http.StatusUnauthorized}, http.StatusUnauthorized, `{"error":{"code":401,"message":"Unauthorized"}}`},
+		// other errors could leak internals, so only their status is shown
+		{errors.New("redis: connection refused"), http.StatusInternalServerError, `{"error":{"code":500,"message":"Internal Server Error"}}`},
+	}
+
+	for _, f := range tests {
+		rec := httptest.NewRecorder()
+		apiHandle(func(http.ResponseWriter, *http.Request) error { return f.err }).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/whitelist", nil))
+		if rec.Code != f.wantCode || strings.TrimSpace(rec.Body.String()) != f.wantBody {
+			t.Errorf("%v: got %d %s, want %d %s", f.err, rec.Code, rec.Body.String(), f.wantCode, f.wantBody)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%v: Content-Type = %q, want application/json", f.err, ct)
+		}
+	}
+}
+
+func TestApiCaller(t *testing.T) {
+	c.Debug = false
+	defer func() { c.Auth.Type = "" }()
+	store = sessions.NewCookieStore([]byte("test-session-key"))
+
+	// a signed-in browser session
+	saveReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	saveRec := httptest.NewRecorder()
+	session, _ := store.Get(saveReq, "session")
+	session.Values["key"] = "alice@example.com"
+	session.Values["name"] = "Alice"
+	session.Values["groups"] = []string{"devs"}
+	if err := session.Save(saveReq, saveRec); err != nil {
+		t.Fatalf("could not save session: %v", err)
+	}
+	cookie := saveRec.Header().Get("Set-Cookie")
+
+	tests := []struct {
+		name       string
+		authType   string
+		remoteAddr string
+		header     map[string]string
+		wantKey    string
+		wantCode   int
+	}{
+		{"session", "oidc", "203.0.113.9:5555", map[string]string{"Cookie": cookie}, "aliceexamplecom", 0},
+		{"no session", "oidc", "203.0.113.9:5555", nil, "", http.StatusUnauthorized},
+		{"private ip", "oidc", "192.168.1.20:5555", map[string]string{"Cookie": cookie}, "", http.StatusForbidden},
+		{"foreign bearer token", "oidc", "203.0.113.9:5555", map[string]string{"Authorization": "Bearer eyJhbGciOi"}, "", http.StatusUnauthorized},
+		{"no auth", "none", "10.0.0.1:5555", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "20301139", 0},
+	}
+
+	for _, f := range tests {
+		c.Auth.Type = f.authType
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/whitelist", nil)
+		req.RemoteAddr = f.remoteAddr
+		for k, v := range f.header {
+			req.Header.Set(k, v)
+		}
+		u, _, err := apiCaller(req)
+		if f.wantCode != 0 {
+			if !isStatus(err, f.wantCode) {
+				t.Errorf("%s: got %v, want %d", f.name, err, f.wantCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: returned error: %v", f.name, err)
+			continue
+		}
+		if u.key != f.wantKey || u.ip != "203.0.113.9" {
+			t.Errorf("%s: got key %q ip %q, want %q 203.0.113.9", f.name, u.key, u.ip, f.wantKey)
+		}
+	}
+}
+
+func TestApiWhitelist(t *testing.T) {
+	testRedisInstance := CreateTestRedis(t)
+	var rc RedisConfiguration
+	rc.Host = testRedisInstance.Host
+	rc.Port = testRedisInstance.Port
+	rc.Token = testRedisInstance.Token
+	if !r.connect(rc) {
+		t.Fatal("could not connect to test redis")
+	}
+	defer DeleteTestRedis(t, testRedisInstance)
+	c.TTL = 24
+
+	secret, token, err := newApiToken(TokenRequest{Name: "ci runner", Groups: []string{"devs"}, MaxTTL: 2}, nil)
+	if err != nil {
+		t.Fatalf("newApiToken() returned error: %v", err)
+	}
+	b, _ := json.Marshal(token)
+	if err := r.setToken(context.Background(), token.Id, b, time.Until(token.Expires)); err != nil {
+		t.Fatalf("could not store token: %v", err)
+	}
+
+	call := func(method string, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "203.0.113.9:5555"
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		apiHandle(apiWhitelistHandler).ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := call(http.MethodGet, "/api/v1/whitelist"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET before whitelisting = %d, want 404", rec.Code)
+	}
+	if rec := call(http.MethodPost, "/api/v1/whitelist?ttl=3"); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST with ttl over max_ttl = %d, want 400", rec.Code)
+	}
+
+	rec := call(http.MethodPost, "/api/v1/whitelist?ttl=1")
+	var wl Whitelisting
+	if err := json.NewDecoder(rec.Body).Decode(&wl); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("POST = %d (%v), want 200", rec.Code, err)
+	}
+	if wl.Key != "token"+token.Id || wl.Name != "ci runner" || wl.IP != "203.0.113.9/32" {
+		t.Errorf("POST = %+v, want the token's key and name and ip 203.0.113.9/32", wl)
+	}
+
+	rec = call(http.MethodGet, "/api/v1/whitelist")
+	var got Whitelisting
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d (%v), want 200", rec.Code, err)
+	}
+	if got.IP != wl.IP || got.Expires.After(wl.Expires) || wl.Expires.Sub(got.Expires) > time.Minute {
+		t.Errorf("GET = %+v, want the entry POST made, %+v", got, wl)
+	}
+
+	rec = call(http.MethodDelete, "/api/v1/whitelist")
+	var rv Revocation
+	if err := json.NewDecoder(rec.Body).Decode(&rv); err != nil || rec.Code != http.StatusOK || rv.IP != "203.0.113.9/32" {
+		t.Errorf("DELETE = %d %+v (%v), want 200 and the removed ip", rec.Code, rv, err)
+	}
+	if groups, _ := r.getUserGroups(context.Background(), "token"+token.Id); len(groups) != 0 {
+		t.Errorf("DELETE left the cached groups %v behind", groups)
+	}
+	if rec := call(http.MethodDelete, "/api/v1/whitelist"); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d, want 404", rec.Code)
+	}
+}
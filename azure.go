@@ -3,11 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/cosmos-db/mgmt/2021-10-15/documentdb"
 	"github.com/Azure/azure-sdk-for-go/services/frontdoor/mgmt/2019-10-01/frontdoor"
@@ -20,15 +21,6 @@ import (
 	"github.com/Azure/go-autorest/autorest/to"
 )
 
-type Azure struct {
-	FrontDoor      []AzureFrontDoor
-	StorageAccount []AzureStorageAccount
-	KeyVault       []AzureKeyVault
-	PostgresServer []AzurePostgresServer
-	RedisCache     []AzureRedisCache
-	CosmosDb       []AzureCosmosDb
-}
-
 type AzureFrontDoor struct {
 	SubscriptionId string
 	ResourceGroup  string
@@ -75,40 +67,138 @@ type AzureCosmosDb struct {
 	Name           string
 	IPWhiteList    []string
 	Group          []string
-	Queued         bool
 }
 
-func (*AzureFrontDoor) new(fd AzureFrontDoor) {
-	a.FrontDoor = append(a.FrontDoor, fd)
-	log.Println("azure.AzureFrontDoor.new(): frontdoor added '" + fd.ResourceGroup + "/" + fd.PolicyName + "'")
+// azureRange is a start/end firewall rule, as used by Postgres and Redis Cache.
+type azureRange struct {
+	start string
+	end   string
+}
+
+// staticRuleName strips everything but letters and digits from static rule
+// names, which Azure doesn't allow.
+var staticRuleName = regexp.MustCompile("[^a-zA-Z0-9]+")
+
+func init() {
+	registerProvider("azure", "frontdoor", newAzureFrontDoor)
+	registerProvider("azure", "storageaccount", newAzureStorageAccount)
+	registerProvider("azure", "keyvault", newAzureKeyVault)
+	registerProvider("azure", "postgres", newAzurePostgresServer)
+	registerProvider("azure", "redis", newAzureRedisCache)
+	registerProvider("azure", "cosmosdb", newAzureCosmosDb)
+}
+
+func newAzureFrontDoor(rc ResourceConfiguration) (Provider, error) {
+	fd := &AzureFrontDoor{
+		SubscriptionId: rc.SubscriptionId,
+		ResourceGroup:  rc.ResourceGroup,
+		PolicyName:     rc.PolicyName,
+		IPWhiteList:    rc.IPWhiteList,
+		Group:          rc.Group,
+	}
+	log.Println("azure.newAzureFrontDoor(): frontdoor added '" + fd.ResourceGroup + "/" + fd.PolicyName + "'")
+	return fd, nil
 }
 
-func (*AzureStorageAccount) new(st AzureStorageAccount) {
-	a.StorageAccount = append(a.StorageAccount, st)
-	log.Println("azure.AzureStorageAccount.new(): storage account added '" + st.ResourceGroup + "/" + st.Name + "'")
+func newAzureStorageAccount(rc ResourceConfiguration) (Provider, error) {
+	st := &AzureStorageAccount{
+		SubscriptionId: rc.SubscriptionId,
+		ResourceGroup:  rc.ResourceGroup,
+		Name:           rc.Name,
+		IPWhiteList:    rc.IPWhiteList,
+		Group:          rc.Group,
+	}
+	log.Println("azure.newAzureStorageAccount(): storage account added '" + st.ResourceGroup + "/" + st.Name + "'")
+	return st, nil
 }
 
-func (*AzureKeyVault) new(kv AzureKeyVault) {
-	a.KeyVault = append(a.KeyVault, kv)
-	log.Println("azure.AzureKeyVault.new(): key vault added '" + kv.ResourceGroup + "/" + kv.Name + "'")
+func newAzureKeyVault(rc ResourceConfiguration) (Provider, error) {
+	kv := &AzureKeyVault{
+		SubscriptionId: rc.SubscriptionId,
+		ResourceGroup:  rc.ResourceGroup,
+		Name:           rc.Name,
+		IPWhiteList:    rc.IPWhiteList,
+		Group:          rc.Group,
+	}
+	log.Println("azure.newAzureKeyVault(): key vault added '" + kv.ResourceGroup + "/" + kv.Name + "'")
+	return kv, nil
 }
 
-func (*AzurePostgresServer) new(pg AzurePostgresServer) {
-	a.PostgresServer = append(a.PostgresServer, pg)
-	log.Println("azure.AzurePostgresServer.new(): postgres server added '" + pg.ResourceGroup + "/" + pg.Name + "'")
+func newAzurePostgresServer(rc ResourceConfiguration) (Provider, error) {
+	pg := &AzurePostgresServer{
+		SubscriptionId: rc.SubscriptionId,
+		ResourceGroup:  rc.ResourceGroup,
+		Name:           rc.Name,
+		IPWhiteList:    rc.IPWhiteList,
+		Group:          rc.Group,
+	}
+	log.Println("azure.newAzurePostgresServer(): postgres server added '" + pg.ResourceGroup + "/" + pg.Name + "'")
+	return pg, nil
 }
 
-func (*AzureRedisCache) new(rc AzureRedisCache) {
-	a.RedisCache = append(a.RedisCache, rc)
-	log.Println("azure.AzureRedisCache.new(): redis cache added '" + rc.ResourceGroup + "/" + rc.Name + "'")
+func newAzureRedisCache(rc ResourceConfiguration) (Provider, error) {
+	rd := &AzureRedisCache{
+		SubscriptionId: rc.SubscriptionId,
+		ResourceGroup:  rc.ResourceGroup,
+		Name:           rc.Name,
+		IPWhiteList:    rc.IPWhiteList,
+		Group:          rc.Group,
+	}
+	log.Println("azure.newAzureRedisCache(): redis cache added '" + rd.ResourceGroup + "/" + rd.Name + "'")
+	return rd, nil
 }
 
-func (*AzureCosmosDb) new(cd AzureCosmosDb) {
-	a.CosmosDb = append(a.CosmosDb, cd)
-	log.Println("azure.AzureCosmosDb.new(): cosmos db added '" + cd.ResourceGroup + "/" + cd.Name + "'")
+func newAzureCosmosDb(rc ResourceConfiguration) (Provider, error) {
+	cd := &AzureCosmosDb{
+		SubscriptionId: rc.SubscriptionId,
+		ResourceGroup:  rc.ResourceGroup,
+		Name:           rc.Name,
+		IPWhiteList:    rc.IPWhiteList,
+		Group:          rc.Group,
+	}
+	log.Println("azure.newAzureCosmosDb(): cosmos db added '" + cd.ResourceGroup + "/" + cd.Name + "'")
+	return cd, nil
 }
 
-func (*Azure) authorize() (autorest.Authorizer, error) {
+func (fd *AzureFrontDoor) id() string {
+	return "azure/frontdoor/" + fd.ResourceGroup + "/" + fd.PolicyName
+}
+
+func (st *AzureStorageAccount) id() string {
+	return "azure/storageaccount/" + st.ResourceGroup + "/" + st.Name
+}
+
+func (kv *AzureKeyVault) id() string {
+	return "azure/keyvault/" + kv.ResourceGroup + "/" + kv.Name
+}
+
+func (pg *AzurePostgresServer) id() string {
+	return "azure/postgres/" + pg.ResourceGroup + "/" + pg.Name
+}
+
+func (rc *AzureRedisCache) id() string {
+	return "azure/redis/" + rc.ResourceGroup + "/" + rc.Name
+}
+
+func (cd *AzureCosmosDb) id() string {
+	return "azure/cosmosdb/" + cd.ResourceGroup + "/" + cd.Name
+}
+
+func (*AzureFrontDoor) enabled() bool      { return azureEnabled() }
+func (*AzureStorageAccount) enabled() bool { return azureEnabled() }
+func (*AzureKeyVault) enabled() bool       { return azureEnabled() }
+func (*AzurePostgresServer) enabled() bool { return azureEnabled() }
+func (*AzureRedisCache) enabled() bool     { return azureEnabled() }
+func (*AzureCosmosDb) enabled() bool       { return azureEnabled() }
+
+// azureEnabled reports whether Azure resources should be synced. It is disabled
+// while the tenant is the sample placeholder, so the dummy config never touches
+// real cloud resources.
+func azureEnabled() bool {
+	return c.Auth.TenantId != "notreal-not-real-not-notreal"
+}
+
+func azureAuthorize() (autorest.Authorizer, error) {
 	var a autorest.Authorizer
 
 	oauthConfig, err := adal.NewOAuthConfig("https://login.microsoftonline.com", c.Auth.TenantId)
@@ -124,24 +214,27 @@ func (*Azure) authorize() (autorest.Authorizer, error) {
 	return a, nil
 }
 
-func (fd *AzureFrontDoor) update() int {
+// ips returns the policy's match values: the dynamic whitelist and the static
+// (global + per-policy) whitelist, which get separate rules.
+func (fd *AzureFrontDoor) ips(list map[string]string, getGroups func(string) []string) (dynamic []string, static []string) {
+	allowed := whitelistedIps(fd.id(), list, fd.IPWhiteList, fd.Group, getGroups, false)
+	for _, key := range sortedKeys(allowed) {
+		dynamic = append(dynamic, allowed[key])
+	}
+	return dynamic, staticWhitelist(fd.IPWhiteList)
+}
+
+func (fd *AzureFrontDoor) desired(list map[string]string, getGroups func(string) []string) []string {
+	dynamic, static := fd.ips(list, getGroups)
+	return append(dynamic, static...)
+}
+
+func (fd *AzureFrontDoor) update(ctx context.Context, list map[string]string) error {
 	log.Print("azure.AzureFrontDoor.update(): updating '" + fd.ResourceGroup + "/" + fd.PolicyName + "'")
 
 	var rules []frontdoor.CustomRule
 
-	ips := make([]string, 0, len(w.List))
-	for key, ipval := range w.List {
-		if !w.inRange(ipval, fd.IPWhiteList) {
-			// ip not within static whitelist range
-			if hasGroup(fd.Group, r.getGroups(key)) {
-				ips = append(ips, ipval)
-			} else {
-				if c.Debug {
-					log.Print("azure.AzureFrontDoor.update(): user '"+key+"' is not part of any of the groups ", fd.Group, " required for frontdoor '"+fd.ResourceGroup+"/"+fd.PolicyName+"'")
-				}
-			}
-		}
-	}
+	ips, static := fd.ips(list, r.getGroups)
 
 	// split into lists of 100 ips
 	// ip whitelist
@@ -170,7 +263,7 @@ func (fd *AzureFrontDoor) update() int {
 
 	// static ip whitelist
 	ii += 1
-	for i, v := range chunkList(append(c.IPWhiteList, fd.IPWhiteList...), 100) {
+	for i, v := range chunkList(static, 100) {
 		if len(v) != 0 {
 			rule := &frontdoor.CustomRule{
 				Name:         to.StringPtr("staticwhitelist" + strconv.Itoa(i)),
@@ -210,13 +303,13 @@ func (fd *AzureFrontDoor) update() int {
 	rules = append(rules, *rule)
 
 	azfd := frontdoor.NewPoliciesClient(fd.SubscriptionId)
-	azfd.Authorizer, _ = a.authorize()
+	azfd.Authorizer, _ = azureAuthorize()
 
 	// CreateOrUpdate replaces the whole policy, so fetch the existing one first
 	// and carry its tags over to avoid wiping tags on every update.
-	existing, _ := azfd.Get(context.Background(), fd.ResourceGroup, fd.PolicyName)
+	existing, _ := azfd.Get(ctx, fd.ResourceGroup, fd.PolicyName)
 
-	_, err := azfd.CreateOrUpdate(context.Background(), fd.ResourceGroup, fd.PolicyName, frontdoor.WebApplicationFirewallPolicy{
+	_, err := azfd.CreateOrUpdate(ctx, fd.ResourceGroup, fd.PolicyName, frontdoor.WebApplicationFirewallPolicy{
 		Location: to.StringPtr("Global"),
 		Tags:     existing.Tags,
 		WebApplicationFirewallPolicyProperties: &frontdoor.WebApplicationFirewallPolicyProperties{
@@ -243,82 +336,105 @@ func (fd *AzureFrontDoor) update() int {
 		log.Printf("azure.AzureFrontDoor.update(): \n%v", string(prettyBody))
 	}
 	if err != nil {
-		log.Print("azure.AzureFrontDoor.update():", err)
-	} else {
-		log.Print("azure.AzureFrontDoor.update(): updated '" + fd.ResourceGroup + "/" + fd.PolicyName + "'")
+		return err
 	}
 
-	return 0
+	log.Print("azure.AzureFrontDoor.update(): updated '" + fd.ResourceGroup + "/" + fd.PolicyName + "'")
+	return nil
 }
 
-func (st *AzureStorageAccount) update() int {
-	log.Print("azure.AzureStorageAccount.update(): updating '" + st.ResourceGroup + "/" + st.Name + "'")
+func (fd *AzureFrontDoor) current(ctx context.Context) ([]string, error) {
+	azfd := frontdoor.NewPoliciesClient(fd.SubscriptionId)
+	azfd.Authorizer, _ = azureAuthorize()
+	policy, err := azfd.Get(ctx, fd.ResourceGroup, fd.PolicyName)
+	if err != nil {
+		return nil, err
+	}
 
-	var ipRules []storage.IPRule
-	// ip whitelist
-	for key, ipval := range w.List {
-		if !w.inRange(ipval, st.IPWhiteList) && isValidIpOrNetV4(ipval) {
-			// ip not within static whitelist range
-			if strings.Contains(ipval, "/32") {
-				// storage account wants a single IP without its /32 netmask
-				ipval = deleteNetmask(ipval)
-			}
-			if hasGroup(st.Group, r.getGroups(key)) {
-				if strings.Contains(ipval, "/31") {
-					// storage account doesnt support /31, have to split both ips
-					first, last, _ := getIpList(ipval)
-					ipRules = append(ipRules, storage.IPRule{
-						IPAddressOrRange: to.StringPtr(first),
-						Action:           storage.ActionAllow,
-					})
-					ipRules = append(ipRules, storage.IPRule{
-						IPAddressOrRange: to.StringPtr(last),
-						Action:           storage.ActionAllow,
-					})
-				} else {
-					ipRules = append(ipRules, storage.IPRule{
-						IPAddressOrRange: to.StringPtr(ipval),
-						Action:           storage.ActionAllow,
-					})
-				}
-			} else {
-				if c.Debug {
-					log.Print("azure.AzureStorageAccount.update(): user '"+key+"' is not part of any of the groups ", st.Group, " required for storage account '"+st.ResourceGroup+"/"+st.Name+"'")
-				}
+	var ips []string
+	if policy.WebApplicationFirewallPolicyProperties == nil || policy.CustomRules == nil || policy.CustomRules.Rules == nil {
+		return ips, nil
+	}
+	for _, rule := range *policy.CustomRules.Rules {
+		// only the allow rules are ours to compare, blockall never changes
+		name := to.String(rule.Name)
+		if !strings.HasPrefix(name, "ipwhitelist") && !strings.HasPrefix(name, "staticwhitelist") {
+			continue
+		}
+		if rule.MatchConditions == nil {
+			continue
+		}
+		for _, mc := range *rule.MatchConditions {
+			if mc.MatchValue != nil {
+				ips = append(ips, *mc.MatchValue...)
 			}
 		}
 	}
+	return ips, nil
+}
+
+// storageIpValues converts a cidr to storage account notation: a single IP
+// without its /32 netmask, and a /31 as both of its IPs since storage accounts
+// don't support /31.
+func storageIpValues(cidr string) []string {
+	if strings.Contains(cidr, "/32") {
+		cidr = deleteNetmask(cidr)
+	}
+	if strings.Contains(cidr, "/31") {
+		first, last, _ := getIpList(cidr)
+		return []string{first, last}
+	}
+	return []string{cidr}
+}
 
+func (st *AzureStorageAccount) desired(list map[string]string, getGroups func(string) []string) []string {
+	var ips []string
+	// ip whitelist
+	allowed := whitelistedIps(st.id(), list, st.IPWhiteList, st.Group, getGroups, true)
+	for _, key := range sortedKeys(allowed) {
+		ips = append(ips, storageIpValues(allowed[key])...)
+	}
 	// static ip whitelist
-	for _, ipval := range append(c.IPWhiteList, st.IPWhiteList...) {
+	for _, ipval := range staticWhitelist(st.IPWhiteList) {
 		if isValidIpOrNetV4(ipval) {
-			if strings.Contains(ipval, "/32") {
-				// storage account wants a single IP without its /32 netmask
-				ipval = deleteNetmask(ipval)
-			}
-			if strings.Contains(ipval, "/31") {
-				// storage account doesnt support /31, have to split both ips
-				first, last, _ := getIpList(ipval)
-				ipRules = append(ipRules, storage.IPRule{
-					IPAddressOrRange: to.StringPtr(first),
-					Action:           storage.ActionAllow,
-				})
-				ipRules = append(ipRules, storage.IPRule{
-					IPAddressOrRange: to.StringPtr(last),
-					Action:           storage.ActionAllow,
-				})
-			} else {
-				ipRules = append(ipRules, storage.IPRule{
-					IPAddressOrRange: to.StringPtr(ipval),
-					Action:           storage.ActionAllow,
-				})
-			}
+			ips = append(ips, storageIpValues(ipval)...)
 		}
 	}
+	return ips
+}
 
+func (st *AzureStorageAccount) current(ctx context.Context) ([]string, error) {
 	azst := storage.NewAccountsClient(st.SubscriptionId)
-	azst.Authorizer, _ = a.authorize()
-	ret, err := azst.Update(context.Background(), st.ResourceGroup, st.Name, storage.AccountUpdateParameters{
+	azst.Authorizer, _ = azureAuthorize()
+	account, err := azst.GetProperties(ctx, st.ResourceGroup, st.Name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	if account.AccountProperties == nil || account.NetworkRuleSet == nil || account.NetworkRuleSet.IPRules == nil {
+		return ips, nil
+	}
+	for _, rule := range *account.NetworkRuleSet.IPRules {
+		ips = append(ips, to.String(rule.IPAddressOrRange))
+	}
+	return ips, nil
+}
+
+func (st *AzureStorageAccount) update(ctx context.Context, list map[string]string) error {
+	log.Print("azure.AzureStorageAccount.update(): updating '" + st.ResourceGroup + "/" + st.Name + "'")
+
+	var ipRules []storage.IPRule
+	for _, ipval := range st.desired(list, r.getGroups) {
+		ipRules = append(ipRules, storage.IPRule{
+			IPAddressOrRange: to.StringPtr(ipval),
+			Action:           storage.ActionAllow,
+		})
+	}
+
+	azst := storage.NewAccountsClient(st.SubscriptionId)
+	azst.Authorizer, _ = azureAuthorize()
+	_, err := azst.Update(ctx, st.ResourceGroup, st.Name, storage.AccountUpdateParameters{
 		AccountPropertiesUpdateParameters: &storage.AccountPropertiesUpdateParameters{
 			AllowBlobPublicAccess: to.BoolPtr(false),
 			NetworkRuleSet: &storage.NetworkRuleSet{
@@ -332,46 +448,60 @@ func (st *AzureStorageAccount) update() int {
 		log.Printf("azure.AzureStorageAccount.update(): \n%v", string(prettyBody))
 	}
 	if err != nil {
-		log.Print("azure.AzureStorageAccount.update():", err)
-	} else {
-		log.Print("azure.AzureStorageAccount.update(): updated '" + st.ResourceGroup + "/" + st.Name + "'")
+		return err
 	}
 
-	return ret.Response.StatusCode
+	log.Print("azure.AzureStorageAccount.update(): updated '" + st.ResourceGroup + "/" + st.Name + "'")
+	return nil
 }
 
-func (kv *AzureKeyVault) update() int {
-	log.Print("azure.AzureKeyVault.update(): updating '" + kv.ResourceGroup + "/" + kv.Name + "'")
-
-	var ipRules []keyvault.IPRule
+func (kv *AzureKeyVault) desired(list map[string]string, getGroups func(string) []string) []string {
+	var ips []string
 	// ip whitelist
-	for key, ipval := range w.List {
-		if !w.inRange(ipval, kv.IPWhiteList) && isValidIpOrNetV4(ipval) {
-			// ip not within static whitelist range
-			if hasGroup(kv.Group, r.getGroups(key)) {
-				ipRules = append(ipRules, keyvault.IPRule{
-					Value: to.StringPtr(ipval),
-				})
-			} else {
-				if c.Debug {
-					log.Print("azure.AzureKeyVault.update(): user '"+key+"' is not part of any of the groups ", kv.Group, " required for keyvault '"+kv.ResourceGroup+"/"+kv.Name+"'")
-				}
-			}
-		}
+	allowed := whitelistedIps(kv.id(), list, kv.IPWhiteList, kv.Group, getGroups, true)
+	for _, key := range sortedKeys(allowed) {
+		ips = append(ips, allowed[key])
 	}
-
 	// static ip whitelist
-	for _, ipval := range append(c.IPWhiteList, kv.IPWhiteList...) {
+	for _, ipval := range staticWhitelist(kv.IPWhiteList) {
 		if isValidIpOrNetV4(ipval) {
-			ipRules = append(ipRules, keyvault.IPRule{
-				Value: to.StringPtr(ipval),
-			})
+			ips = append(ips, ipval)
 		}
 	}
+	return ips
+}
+
+func (kv *AzureKeyVault) current(ctx context.Context) ([]string, error) {
+	azkv := keyvault.NewVaultsClient(kv.SubscriptionId)
+	azkv.Authorizer, _ = azureAuthorize()
+	vault, err := azkv.Get(ctx, kv.ResourceGroup, kv.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	if vault.Properties == nil || vault.Properties.NetworkAcls == nil || vault.Properties.NetworkAcls.IPRules == nil {
+		return ips, nil
+	}
+	for _, rule := range *vault.Properties.NetworkAcls.IPRules {
+		ips = append(ips, to.String(rule.Value))
+	}
+	return ips, nil
+}
+
+func (kv *AzureKeyVault) update(ctx context.Context, list map[string]string) error {
+	log.Print("azure.AzureKeyVault.update(): updating '" + kv.ResourceGroup + "/" + kv.Name + "'")
+
+	var ipRules []keyvault.IPRule
+	for _, ipval := range kv.desired(list, r.getGroups) {
+		ipRules = append(ipRules, keyvault.IPRule{
+			Value: to.StringPtr(ipval),
+		})
+	}
 
 	azkv := keyvault.NewVaultsClient(kv.SubscriptionId)
-	azkv.Authorizer, _ = a.authorize()
-	ret, err := azkv.Update(context.Background(), kv.ResourceGroup, kv.Name, keyvault.VaultPatchParameters{
+	azkv.Authorizer, _ = azureAuthorize()
+	_, err := azkv.Update(ctx, kv.ResourceGroup, kv.Name, keyvault.VaultPatchParameters{
 		Properties: &keyvault.VaultPatchProperties{
 			NetworkAcls: &keyvault.NetworkRuleSet{
 				DefaultAction: keyvault.Deny,
@@ -384,28 +514,76 @@ func (kv *AzureKeyVault) update() int {
 		log.Printf("azure.AzureKeyVault.update(): \n%v", string(prettyBody))
 	}
 	if err != nil {
-		log.Print("azure.AzureKeyVault.update():", err)
-	} else {
-		log.Print("azure.AzureKeyVault.update(): updated '" + kv.ResourceGroup + "/" + kv.Name + "'")
+		return err
 	}
 
-	return ret.Response.StatusCode
+	log.Print("azure.AzureKeyVault.update(): updated '" + kv.ResourceGroup + "/" + kv.Name + "'")
+	return nil
 }
 
-func (pg *AzurePostgresServer) update() int {
+// rangeRules generates the start/end firewall rules a Postgres server or Redis
+// Cache should hold, keyed by rule name: one per qualifying user plus one per
+// static whitelist entry.
+func rangeRules(id string, list map[string]string, static []string, groups []string, getGroups func(string) []string) map[string]azureRange {
+	rules := make(map[string]azureRange)
+	// ip whitelist
+	for key, cidr := range whitelistedIps(id, list, static, groups, getGroups, true) {
+		first, last, _ := getIpList(cidr)
+		rules[key] = azureRange{start: first, end: last}
+	}
+	// static ip whitelist
+	for _, cidr := range staticWhitelist(static) {
+		if isValidIpOrNetV4(cidr) {
+			first, last, _ := getIpList(cidr)
+			rules[staticRuleName.ReplaceAllString("static"+first+last, "")] = azureRange{start: first, end: last}
+		}
+	}
+	return rules
+}
+
+// rangeEntries renders range rules as "name: start-end", sorted by name.
+func rangeEntries(rules map[string]azureRange) []string {
+	entries := make([]string, 0, len(rules))
+	for name, rule := range rules {
+		entries = append(entries, name+": "+rule.start+"-"+rule.end)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func (pg *AzurePostgresServer) desired(list map[string]string, getGroups func(string) []string) []string {
+	return rangeEntries(rangeRules(pg.id(), list, pg.IPWhiteList, pg.Group, getGroups))
+}
+
+func (pg *AzurePostgresServer) current(ctx context.Context) ([]string, error) {
+	azpg := postgresql.NewFirewallRulesClient(pg.SubscriptionId)
+	azpg.Authorizer, _ = azureAuthorize()
+	currRules, err := azpg.ListByServer(ctx, pg.ResourceGroup, pg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(map[string]azureRange)
+	if currRules.Value != nil {
+		for _, v := range *currRules.Value {
+			rules[to.String(v.Name)] = azureRange{start: to.String(v.StartIPAddress), end: to.String(v.EndIPAddress)}
+		}
+	}
+	return rangeEntries(rules), nil
+}
+
+func (pg *AzurePostgresServer) update(ctx context.Context, list map[string]string) error {
 	log.Print("azure.AzurePostgresServer.update(): updating '" + pg.ResourceGroup + "/" + pg.Name + "'")
 
-	var error bool
-	error = false
+	var errs []error
 
 	azpg := postgresql.NewFirewallRulesClient(pg.SubscriptionId)
-	azpg.Authorizer, _ = a.authorize()
+	azpg.Authorizer, _ = azureAuthorize()
 
 	// 1. get current rules from postgres server
-	getCurrRules, err := azpg.ListByServer(context.Background(), pg.ResourceGroup, pg.Name)
+	getCurrRules, err := azpg.ListByServer(ctx, pg.ResourceGroup, pg.Name)
 	if err != nil {
-		log.Print("azure.AzurePostgresServer.update():", err)
-		return 1
+		return err
 	}
 	currRules := make(map[string]postgresql.FirewallRule)
 	for _, v := range *getCurrRules.Value {
@@ -414,41 +592,12 @@ func (pg *AzurePostgresServer) update() int {
 
 	// 2. generate list of what postgres server should look like
 	newRules := make(map[string]postgresql.FirewallRule)
-	// ip whitelist
-	for key, cidr := range w.List {
-		if !w.inRange(cidr, pg.IPWhiteList) && isValidIpOrNetV4(cidr) {
-			// ip not within static whitelist range
-			if hasGroup(pg.Group, r.getGroups(key)) {
-				first, last, _ := getIpList(cidr)
-				newRules[key] = postgresql.FirewallRule{
-					FirewallRuleProperties: &postgresql.FirewallRuleProperties{
-						StartIPAddress: to.StringPtr(first),
-						EndIPAddress:   to.StringPtr(last),
-					},
-				}
-			} else {
-				if c.Debug {
-					log.Print("azure.AzurePostgresServer.update(): user '"+key+"' is not part of any of the groups ", pg.Group, " required for postgres '"+pg.ResourceGroup+"/"+pg.Name+"'")
-				}
-			}
-		}
-	}
-	// static ip whitelist
-	for _, cidr := range append(c.IPWhiteList, pg.IPWhiteList...) {
-		if isValidIpOrNetV4(cidr) {
-			first, last, _ := getIpList(cidr)
-			// reg expression for creating key
-			reg, err := regexp.Compile("[^a-zA-Z0-9]+")
-			if err != nil {
-				log.Fatal("azure.AzurePostgresServer.update():", err)
-			}
-			key := reg.ReplaceAllString("static"+first+last, "")
-			newRules[key] = postgresql.FirewallRule{
-				FirewallRuleProperties: &postgresql.FirewallRuleProperties{
-					StartIPAddress: to.StringPtr(first),
-					EndIPAddress:   to.StringPtr(last),
-				},
-			}
+	for key, rule := range rangeRules(pg.id(), list, pg.IPWhiteList, pg.Group, r.getGroups) {
+		newRules[key] = postgresql.FirewallRule{
+			FirewallRuleProperties: &postgresql.FirewallRuleProperties{
+				StartIPAddress: to.StringPtr(rule.start),
+				EndIPAddress:   to.StringPtr(rule.end),
+			},
 		}
 	}
 
@@ -459,11 +608,9 @@ func (pg *AzurePostgresServer) update() int {
 			if c.Debug {
 				log.Print("azure.PostgresServer.update(): deleting rule '" + key + "' - start: " + *fwRule.StartIPAddress + ", end: " + *fwRule.EndIPAddress)
 			}
-			ret, err := azpg.Delete(context.Background(), pg.ResourceGroup, pg.Name, key)
+			_, err := azpg.Delete(ctx, pg.ResourceGroup, pg.Name, key)
 			if err != nil {
-				log.Print("azure.AzurePostgresServer.update():", err)
-				log.Print("azure.AzurePostgresServer.update():", ret.Response().StatusCode)
-				error = true
+				errs = append(errs, err)
 			}
 		}
 	}
@@ -473,47 +620,61 @@ func (pg *AzurePostgresServer) update() int {
 			if c.Debug {
 				log.Print("azure.PostgresServer.update(): adding rule '" + key + "' - start: " + *fwRule.StartIPAddress + ", end: " + *fwRule.EndIPAddress)
 			}
-			ret, err := azpg.CreateOrUpdate(context.Background(), pg.ResourceGroup, pg.Name, key, fwRule)
+			_, err := azpg.CreateOrUpdate(ctx, pg.ResourceGroup, pg.Name, key, fwRule)
 			if err != nil {
-				log.Print("azure.AzurePostgresServer.update():", err)
-				log.Print("azure.AzurePostgresServer.update():", ret.Response().StatusCode)
-				error = true
+				errs = append(errs, err)
 			}
 		} else if *currRules[key].StartIPAddress != *fwRule.StartIPAddress || *currRules[key].EndIPAddress != *fwRule.EndIPAddress {
 			// update
 			if c.Debug {
 				log.Print("azure.PostgresServer.update(): updating rule '" + key + "' - start: " + *currRules[key].StartIPAddress + ", end: " + *currRules[key].EndIPAddress + " to start: " + *fwRule.StartIPAddress + ", end: " + *fwRule.EndIPAddress)
 			}
-			ret, err := azpg.CreateOrUpdate(context.Background(), pg.ResourceGroup, pg.Name, key, fwRule)
+			_, err := azpg.CreateOrUpdate(ctx, pg.ResourceGroup, pg.Name, key, fwRule)
 			if err != nil {
-				log.Print("azure.AzurePostgresServer.update():", err)
-				log.Print("azure.AzurePostgresServer.update():", ret.Response().StatusCode)
-				error = true
+				errs = append(errs, err)
 			}
 		}
 	}
 
-	if !error {
-		log.Print("azure.AzurePostgresServer.update(): updated '" + pg.ResourceGroup + "/" + pg.Name + "'")
+	if len(errs) != 0 {
+		return errors.Join(errs...)
+	}
+
+	log.Print("azure.AzurePostgresServer.update(): updated '" + pg.ResourceGroup + "/" + pg.Name + "'")
+	return nil
+}
+
+func (rc *AzureRedisCache) desired(list map[string]string, getGroups func(string) []string) []string {
+	return rangeEntries(rangeRules(rc.id(), list, rc.IPWhiteList, rc.Group, getGroups))
+}
+
+func (rc *AzureRedisCache) current(ctx context.Context) ([]string, error) {
+	azrc := redis.NewFirewallRulesClient(rc.SubscriptionId)
+	azrc.Authorizer, _ = azureAuthorize()
+	currRules, err := azrc.List(ctx, rc.ResourceGroup, rc.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	return 0
+	rules := make(map[string]azureRange)
+	for _, v := range currRules.Values() {
+		rules[strings.Split(to.String(v.Name), "/")[1]] = azureRange{start: to.String(v.StartIP), end: to.String(v.EndIP)}
+	}
+	return rangeEntries(rules), nil
 }
 
-func (rc *AzureRedisCache) update() int {
+func (rc *AzureRedisCache) update(ctx context.Context, list map[string]string) error {
 	log.Print("azure.AzureRedisCache.update(): updating '" + rc.ResourceGroup + "/" + rc.Name + "'")
 
-	var error bool
-	error = false
+	var errs []error
 
 	azrc := redis.NewFirewallRulesClient(rc.SubscriptionId)
-	azrc.Authorizer, _ = a.authorize()
+	azrc.Authorizer, _ = azureAuthorize()
 
-	// 1. get current rules from postgres server
-	getCurrRules, err := azrc.List(context.Background(), rc.ResourceGroup, rc.Name)
+	// 1. get current rules from redis cache
+	getCurrRules, err := azrc.List(ctx, rc.ResourceGroup, rc.Name)
 	if err != nil {
-		log.Print("azure.AzureRedisCache.update():", err)
-		return 1
+		return err
 	}
 
 	currRules := make(map[string]redis.FirewallRule)
@@ -521,43 +682,14 @@ func (rc *AzureRedisCache) update() int {
 		currRules[strings.Split(*v.Name, "/")[1]] = v
 	}
 
-	// 2. generate list of what postgres server should look like
+	// 2. generate list of what redis cache should look like
 	newRules := make(map[string]redis.FirewallRule)
-	// ip whitelist
-	for key, cidr := range w.List {
-		if !w.inRange(cidr, rc.IPWhiteList) && isValidIpOrNetV4(cidr) {
-			// ip not within static whitelist range
-			if hasGroup(rc.Group, r.getGroups(key)) {
-				first, last, _ := getIpList(cidr)
-				newRules[key] = redis.FirewallRule{
-					FirewallRuleProperties: &redis.FirewallRuleProperties{
-						StartIP: to.StringPtr(first),
-						EndIP:   to.StringPtr(last),
-					},
-				}
-			} else {
-				if c.Debug {
-					log.Print("azure.AzureRedisCache.update(): user '"+key+"' is not part of any of the groups ", rc.Group, " required for redis cache '"+rc.ResourceGroup+"/"+rc.Name+"'")
-				}
-			}
-		}
-	}
-	// static ip whitelist
-	for _, cidr := range append(c.IPWhiteList, rc.IPWhiteList...) {
-		if isValidIpOrNetV4(cidr) {
-			first, last, _ := getIpList(cidr)
-			// reg expression for creating key
-			reg, err := regexp.Compile("[^a-zA-Z0-9]+")
-			if err != nil {
-				log.Fatal("azure.AzureRedisCache.update():", err)
-			}
-			key := reg.ReplaceAllString("static"+first+last, "")
-			newRules[key] = redis.FirewallRule{
-				FirewallRuleProperties: &redis.FirewallRuleProperties{
-					StartIP: to.StringPtr(first),
-					EndIP:   to.StringPtr(last),
-				},
-			}
+	for key, rule := range rangeRules(rc.id(), list, rc.IPWhiteList, rc.Group, r.getGroups) {
+		newRules[key] = redis.FirewallRule{
+			FirewallRuleProperties: &redis.FirewallRuleProperties{
+				StartIP: to.StringPtr(rule.start),
+				EndIP:   to.StringPtr(rule.end),
+			},
 		}
 	}
 
@@ -568,11 +700,9 @@ func (rc *AzureRedisCache) update() int {
 			if c.Debug {
 				log.Print("azure.AzureRedisCache.update(): deleting rule '" + key + "' - start: " + *fwRule.StartIP + ", end: " + *fwRule.EndIP)
 			}
-			ret, err := azrc.Delete(context.Background(), rc.ResourceGroup, rc.Name, key)
+			_, err := azrc.Delete(ctx, rc.ResourceGroup, rc.Name, key)
 			if err != nil {
-				log.Print("azure.AzureRedisCache.update():", err)
-				log.Print("azure.AzureRedisCache.update():", ret.Response.StatusCode)
-				error = true
+				errs = append(errs, err)
 			}
 		}
 	}
@@ -582,69 +712,77 @@ func (rc *AzureRedisCache) update() int {
 			if c.Debug {
 				log.Print("azure.AzureRedisCache.update(): adding rule '" + key + "' - start: " + *fwRule.StartIP + ", end: " + *fwRule.EndIP)
 			}
-			ret, err := azrc.CreateOrUpdate(context.Background(), rc.ResourceGroup, rc.Name, key, fwRule)
+			_, err := azrc.CreateOrUpdate(ctx, rc.ResourceGroup, rc.Name, key, fwRule)
 			if err != nil {
-				log.Print("azure.AzureRedisCache.update():", err)
-				log.Print("azure.AzureRedisCache.update():", ret.Response.StatusCode)
-				error = true
+				errs = append(errs, err)
 			}
 		} else if *currRules[key].StartIP != *fwRule.StartIP || *currRules[key].EndIP != *fwRule.EndIP {
 			// update
 			if c.Debug {
 				log.Print("azure.AzureRedisCache.update(): updating rule '" + key + "' - start: " + *currRules[key].StartIP + ", end: " + *currRules[key].EndIP + " to start: " + *fwRule.StartIP + ", end: " + *fwRule.EndIP)
 			}
-			ret, err := azrc.CreateOrUpdate(context.Background(), rc.ResourceGroup, rc.Name, key, fwRule)
+			_, err := azrc.CreateOrUpdate(ctx, rc.ResourceGroup, rc.Name, key, fwRule)
 			if err != nil {
-				log.Print("azure.AzureRedisCache.update():", err)
-				log.Print("azure.AzureRedisCache.update():", ret.Response.StatusCode)
-				error = true
+				errs = append(errs, err)
 			}
 		}
 	}
 
-	if !error {
-		log.Print("azure.AzureRedisCache.update(): updated '" + rc.ResourceGroup + "/" + rc.Name + "'")
+	if len(errs) != 0 {
+		return errors.Join(errs...)
 	}
 
-	return 0
+	log.Print("azure.AzureRedisCache.update(): updated '" + rc.ResourceGroup + "/" + rc.Name + "'")
+	return nil
 }
 
-func (cd *AzureCosmosDb) update() int {
-	if cd.Queued {
-		return 0
-	}
-
-	log.Print("azure.AzureCosmosDb.update(): updating '" + cd.ResourceGroup + "/" + cd.Name + "'")
-
-	var ipRules []documentdb.IPAddressOrRange
+func (cd *AzureCosmosDb) desired(list map[string]string, getGroups func(string) []string) []string {
+	var ips []string
 	// ip whitelist
-	for key, ipval := range w.List {
-		if !w.inRange(ipval, cd.IPWhiteList) && isValidIpOrNetV4(ipval) {
-			// ip not within static whitelist range
-			if hasGroup(cd.Group, r.getGroups(key)) {
-				ipRules = append(ipRules, documentdb.IPAddressOrRange{
-					IPAddressOrRange: to.StringPtr(ipval),
-				})
-			} else {
-				if c.Debug {
-					log.Print("azure.AzureCosmosDb.update(): user '"+key+"' is not part of any of the groups ", cd.Group, " required for cosmosdb '"+cd.ResourceGroup+"/"+cd.Name+"'")
-				}
-			}
-		}
+	allowed := whitelistedIps(cd.id(), list, cd.IPWhiteList, cd.Group, getGroups, true)
+	for _, key := range sortedKeys(allowed) {
+		ips = append(ips, allowed[key])
 	}
-
 	// static ip whitelist
-	for _, ipval := range append(c.IPWhiteList, cd.IPWhiteList...) {
+	for _, ipval := range staticWhitelist(cd.IPWhiteList) {
 		if isValidIpOrNetV4(ipval) {
-			ipRules = append(ipRules, documentdb.IPAddressOrRange{
-				IPAddressOrRange: to.StringPtr(ipval),
-			})
+			ips = append(ips, ipval)
 		}
 	}
+	return ips
+}
+
+func (cd *AzureCosmosDb) current(ctx context.Context) ([]string, error) {
+	azcd := documentdb.NewDatabaseAccountsClient(cd.SubscriptionId)
+	azcd.Authorizer, _ = azureAuthorize()
+	account, err := azcd.Get(ctx, cd.ResourceGroup, cd.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	if account.DatabaseAccountGetProperties == nil || account.IPRules == nil {
+		return ips, nil
+	}
+	for _, rule := range *account.IPRules {
+		ips = append(ips, to.String(rule.IPAddressOrRange))
+	}
+	return ips, nil
+}
+
+func (cd *AzureCosmosDb) update(ctx context.Context, list map[string]string) error {
+	log.Print("azure.AzureCosmosDb.update(): updating '" + cd.ResourceGroup + "/" + cd.Name + "'")
+
+	var ipRules []documentdb.IPAddressOrRange
+	for _, ipval := range cd.desired(list, r.getGroups) {
+		ipRules = append(ipRules, documentdb.IPAddressOrRange{
+			IPAddressOrRange: to.StringPtr(ipval),
+		})
+	}
 
 	azcd := documentdb.NewDatabaseAccountsClient(cd.SubscriptionId)
-	azcd.Authorizer, _ = a.authorize()
-	ret, err := azcd.Update(context.Background(), cd.ResourceGroup, cd.Name, documentdb.DatabaseAccountUpdateParameters{
+	azcd.Authorizer, _ = azureAuthorize()
+	_, err := azcd.Update(ctx, cd.ResourceGroup, cd.Name, documentdb.DatabaseAccountUpdateParameters{
 		DatabaseAccountUpdateProperties: &documentdb.DatabaseAccountUpdateProperties{
 			IPRules: &ipRules,
 		},
@@ -654,31 +792,11 @@ func (cd *AzureCosmosDb) update() int {
 		log.Printf("azure.AzureCosmosDb.update(): \n%v", string(prettyBody))
 	}
 	if err != nil {
-		if ret.Response().StatusCode == 412 {
-			// There is already an operation in progress which requires exclusive lock on this service. Please retry the operation after sometime.
-			// so stupid, queue job to run against in a few minutes :@
-			go cd.queueUpdate(cd)
-		} else {
-			log.Print("azure.AzureCosmosDb.update():", err)
-		}
-	} else {
-		log.Print("azure.AzureCosmosDb.update(): updated '" + cd.ResourceGroup + "/" + cd.Name + "'")
+		// a 412 means another operation holds the account's lock, the retry
+		// scheduler tries again later
+		return err
 	}
 
-	return 0
-}
-
-func (cd *AzureCosmosDb) queueUpdate(me *AzureCosmosDb) {
-	if !me.Queued {
-		me.Queued = true
-		if c.Debug {
-			log.Print("azure.AzureCosmosDb.queueUpdate(): queued job, retrying in 2 minutes")
-		}
-		time.Sleep(time.Minute * 2)
-		if c.Debug {
-			log.Print("azure.AzureCosmosDb.queueUpdate(): retrying job")
-		}
-		me.Queued = false
-		me.update()
-	}
+	log.Print("azure.AzureCosmosDb.update(): updated '" + cd.ResourceGroup + "/" + cd.Name + "'")
+	return nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStorageIpValues(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want []string
+	}{
+		{"1.2.3.4/32", []string{"1.2.3.4"}},
+		{"10.0.0.0/31", []string{"10.0.0.0", "10.0.0.1"}},
+		{"85.0.0.0/24", []string{"85.0.0.0/24"}},
+		{"1.2.3.4", []string{"1.2.3.4"}},
+	}
+
+	for _, f := range tests {
+		if got := storageIpValues(f.cidr); !reflect.DeepEqual(got, f.want) {
+			t.Errorf("storageIpValues(%q) = %v, want %v", f.cidr, got, f.want)
+		}
+	}
+}
+
+func TestAzureDesired(t *testing.T) {
+	c.Debug = false
+	c.IPWhiteList = []string{"85.0.0.0/24"}
+	defer func() { c.IPWhiteList = nil }()
+
+	getGroups := func(string) []string { return nil }
+	list := map[string]string{
+		"bob":   "2.2.2.2/32",
+		"alice": "1.1.1.1/32",
+		"dave":  "2a00:11c7:1234:b801:a16e:12af:5e42:1100/128",
+	}
+
+	tests := []struct {
+		provider Provider
+		want     []string
+	}{
+		// frontdoor takes ipv6, everything else drops it
+		{&AzureFrontDoor{}, []string{"1.1.1.1/32", "2.2.2.2/32", "2a00:11c7:1234:b801:a16e:12af:5e42:1100/128", "85.0.0.0/24"}},
+		{&AzureStorageAccount{}, []string{"1.1.1.1", "2.2.2.2", "85.0.0.0/24"}},
+		{&AzureKeyVault{IPWhiteList: []string{"10.0.0.1/32"}}, []string{"1.1.1.1/32", "2.2.2.2/32", "85.0.0.0/24", "10.0.0.1/32"}},
+		{&AzureCosmosDb{}, []string{"1.1.1.1/32", "2.2.2.2/32", "85.0.0.0/24"}},
+		{&AzurePostgresServer{}, []string{"alice: 1.1.1.1-1.1.1.1", "bob: 2.2.2.2-2.2.2.2", "static850008500255: 85.0.0.0-85.0.0.255"}},
+		{&AzureRedisCache{Group: []string{"group-a"}}, []string{"static850008500255: 85.0.0.0-85.0.0.255"}},
+	}
+
+	for _, f := range tests {
+		if got := f.provider.desired(list, getGroups); !reflect.DeepEqual(got, f.want) {
+			t.Errorf("%T.desired() = %v, want %v", f.provider, got, f.want)
+		}
+	}
+}
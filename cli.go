@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// The command-line client (see client.go) signs in to AzureAD with the device
+// code flow, as a public client of the app's registration, and sends the
+// Microsoft Graph access token it gets here. Graph checks the token when the
+// user is looked up with it.
+
+// CliConfig tells the command-line client how to sign in.
+type CliConfig struct {
+	TenantId string   `json:"tenant_id"`
+	ClientId string   `json:"client_id"`
+	Scopes   []string `json:"scopes"`
+}
+
+// cliScopes are what the command-line client asks for: Graph access to look
+// the user up, and a refresh token to renew without signing in again.
+var cliScopes = []string{"openid", "profile", "offline_access", "User.Read", "GroupMember.Read.All"}
+
+// graphClient calls Microsoft Graph with an access token the client sent.
+var graphClient = func(accessToken string) *http.Client {
+	return oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+}
+
+func registerCliHandlers() {
+	http.Handle("/api/cli", handle(cliConfigHandler))
+	http.Handle("/api/cli/whitelist", handle(cliWhitelistHandler))
+}
+
+func cliConfigHandler(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(CliConfig{
+		TenantId: c.Auth.TenantId,
+		ClientId: c.Auth.ClientId,
+		Scopes:   cliScopes,
+	})
+}
+
+// cliWhitelistHandler whitelists the caller's IP with POST, for the optional
+// ttl form value in hours, or removes their whitelisting with DELETE, for the
+// user whose Graph access token is sent as "Authorization: Bearer <token>".
+func cliWhitelistHandler(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	if err := checkClientIP(req); err != nil {
+		return err
+	}
+	u, err := cliUser(req)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return err
+	}
+
+	if req.Method == http.MethodDelete {
+		rv, err := revoke(req, u)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(rv)
+	}
+
+	if err := chooseTTL(req, u, nil); err != nil {
+		return err
+	}
+	if !u.whitelist() {
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not whitelist " + u.ip}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(Whitelisting{
+		Name:      u.name,
+		IP:        u.ip,
+		Expires:   time.Now().Add(u.lifetime()).UTC().Truncate(time.Second),
+		Resources: coveredResources(u),
+	})
+}
+
+// cliUser looks up the user whose access token the request carries. The token
+// must have been issued to this app by the configured tenant, so one from
+// another app can't be replayed here, nor one from another tenant accepted by
+// a multi-tenant app registration.
+func cliUser(req *http.Request) (*User, error) {
+	token := bearerToken(req)
+	if token == "" {
+		return nil, Error{Code: http.StatusUnauthorized}
+	}
+	claims, err := parseIdToken(token)
+	if err != nil || (claims.AppId != c.Auth.ClientId && claims.Azp != c.Auth.ClientId) {
+		log.Print("cli.cliUser(): access token wasn't issued to this app")
+		return nil, Error{Code: http.StatusUnauthorized, Message: "the token wasn't issued to this app"}
+	}
+	if !issuedByTenant(claims, c.Auth.TenantId) {
+		log.Print("cli.cliUser(): access token was issued by tenant '" + claims.Tid + "' (" + claims.Iss + ")")
+		return nil, Error{Code: http.StatusUnauthorized, Message: "the token wasn't issued by this tenant"}
+	}
+
+	var u User
+	if u.new(graphClient(token), "", req) == nil {
+		return nil, Error{Code: http.StatusUnauthorized, Message: "the token was rejected"}
+	}
+	return &u, nil
+}
+
+// issuedByTenant reports whether an access token was issued by tenant, in
+// its v1 or v2 issuer format.
+func issuedByTenant(claims IdTokenClaims, tenant string) bool {
+	if tenant == "" || !strings.EqualFold(claims.Tid, tenant) {
+		return false
+	}
+	for _, iss := range []string{"https://sts.windows.net/" + claims.Tid + "/", "https://login.microsoftonline.com/" + claims.Tid + "/v2.0"} {
+		if claims.Iss == iss {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCliUser(t *testing.T) {
+	c.Debug = false
+	c.Auth.ClientId, c.Auth.TenantId = "client-id", "tenant-id"
+	defer func() { c.Auth.ClientId, c.Auth.TenantId = "", "" }()
+	defer func(f func(string) *http.Client) { graphClient = f }(graphClient)
+
+	me := fakeResponse{200, `{"displayName":"Test User","employeeId":"12345"}`}
+	memberOf := fakeResponse{200, `{"value":[{"id":"group-a"}]}`}
+
+	tests := []struct {
+		name     string
+		token    string
+		graphMe  fakeResponse
+		wantCode int // 0 for a user
+	}{
+		{"v1 access token for this app", fakeIdToken(`{"appid":"client-id","tid":"tenant-id","iss":"https://sts.windows.net/tenant-id/"}`), me, 0},
+		{"v2 access token for this app", fakeIdToken(`{"azp":"client-id","tid":"tenant-id","iss":"https://login.microsoftonline.com/tenant-id/v2.0"}`), me, 0},
+		{"access token for another app", fakeIdToken(`{"appid":"other-app","tid":"tenant-id","iss":"https://sts.windows.net/tenant-id/"}`), me, http.StatusUnauthorized},
+		{"access token from another tenant", fakeIdToken(`{"appid":"client-id","tid":"other-tenant","iss":"https://sts.windows.net/other-tenant/"}`), me, http.StatusUnauthorized},
+		{"issuer of another tenant", fakeIdToken(`{"appid":"client-id","tid":"tenant-id","iss":"https://sts.windows.net/other-tenant/"}`), me, http.StatusUnauthorized},
+		{"no tenant", fakeIdToken(`{"appid":"client-id"}`), me, http.StatusUnauthorized},
+		{"not a token", "nope", me, http.StatusUnauthorized},
+		{"no token", "", me, http.StatusUnauthorized},
+		{"token graph rejects", fakeIdToken(`{"appid":"client-id","tid":"tenant-id","iss":"https://sts.windows.net/tenant-id/"}`), fakeResponse{401, `{}`}, http.StatusUnauthorized},
+	}
+
+	for _, f := range tests {
+		t.Run(f.name, func(t *testing.T) {
+			graphClient = func(string) *http.Client { return fakeGraphClient(f.graphMe, memberOf) }
+			req := httptest.NewRequest(http.MethodPost, "/api/cli/whitelist", nil)
+			req.RemoteAddr = "203.0.113.9:5555"
+			if f.token != "" {
+				req.Header.Set("Authorization", "Bearer "+f.token)
+			}
+
+			u, err := cliUser(req)
+			if f.wantCode != 0 {
+				if e, ok := err.(Error); !ok || e.Code != f.wantCode {
+					t.Fatalf("cliUser() = %v, %v, want a %d", u, err, f.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cliUser() returned error: %v", err)
+			}
+			if u.key != "testuser12345" || u.ip != "203.0.113.9" || len(u.groups) != 1 {
+				t.Errorf("cliUser() = %+v", u)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientCache is what `ip-whitelister login` keeps between runs, so `renew`
+// and `revoke` work without signing in again.
+type ClientCache struct {
+	Server       string    `json:"server"`
+	Config       CliConfig `json:"config"`
+	RefreshToken string    `json:"refresh_token"`
+}
+
+// DeviceCode is AzureAD's answer to starting a device code sign-in.
+type DeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationUri string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+}
+
+// TokenResponse is AzureAD's token endpoint response, or its error.
+type TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// azureLoginURL is where the command-line client signs in.
+var azureLoginURL = "https://login.microsoftonline.com"
+
+// pollWait waits between device code token polls.
+var pollWait = time.Sleep
+
+var clientHTTP = &http.Client{Timeout: 30 * time.Second}
+
+// runClient runs a client subcommand and returns the exit code.
+func runClient(cmd string, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	server := flags.String("server", os.Getenv("IPW_SERVER"), "url of the ip-whitelister server, e.g. https://whitelist.example.com")
+	cachePath := flags.String("cache", defaultClientCache(), "file the sign-in is kept in between runs")
+	ttl := flags.Int("ttl", 0, "hours to be whitelisted for, up to the server's maximum (default the server's ttl)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	switch cmd {
+	case "login":
+		err = clientLogin(strings.TrimSuffix(*server, "/"), *cachePath, *ttl, out)
+	case "renew":
+		err = clientRenew(*cachePath, *ttl, out)
+	case "revoke":
+		err = clientRevoke(*cachePath, out)
+	default:
+		err = errors.New("unknown command '" + cmd + "'")
+	}
+	if err != nil {
+		fmt.Fprintln(out, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+func defaultClientCache() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "ip-whitelister", "login.json")
+}
+
+// clientLogin signs in with the device code flow and whitelists this machine.
+func clientLogin(server string, cachePath string, ttl int, out io.Writer) error {
+	if server == "" {
+		return errors.New("the server is missing, set -server or IPW_SERVER")
+	}
+	var cfg CliConfig
+	if err := clientGetJSON(server+"/api/cli", &cfg); err != nil {
+		return fmt.Errorf("could not read the server's sign-in settings: %v", err)
+	}
+
+	token, err := deviceCodeLogin(cfg, out)
+	if err != nil {
+		return err
+	}
+	cache := ClientCache{Server: server, Config: cfg, RefreshToken: token.RefreshToken}
+	if err := saveClientCache(cachePath, cache); err != nil {
+		fmt.Fprintln(out, "warning: could not keep the sign-in for renew and revoke:", err)
+	}
+	return clientWhitelist(server, token.AccessToken, ttl, out)
+}
+
+// clientRenew whitelists this machine again with the kept sign-in, which
+// extends the whitelisting without signing in again.
+func clientRenew(cachePath string, ttl int, out io.Writer) error {
+	cache, token, err := refreshClientLogin(cachePath)
+	if err != nil {
+		return err
+	}
+	return clientWhitelist(cache.Server, token.AccessToken, ttl, out)
+}
+
+// clientRevoke removes this user's whitelisting and forgets the sign-in.
+func clientRevoke(cachePath string, out io.Writer) error {
+	cache, token, err := refreshClientLogin(cachePath)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, cache.Server+"/api/cli/whitelist", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var rv Revocation
+	if err := clientDo(req, &rv); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Your whitelisting for %s has been removed.\n", rv.IP)
+	for _, res := range rv.Resources {
+		if res.Removed {
+			fmt.Fprintln(out, "  "+res.Id+": removed")
+		} else {
+			fmt.Fprintln(out, "  "+res.Id+": not removed yet, it will be retried")
+		}
+	}
+	return os.Remove(cachePath)
+}
+
+// deviceCodeLogin has the user sign in on another device and waits for it.
+func deviceCodeLogin(cfg CliConfig, out io.Writer) (TokenResponse, error) {
+	base := azureLoginURL + "/" + cfg.TenantId + "/oauth2/v2.0"
+	var dc DeviceCode
+	resp, err := clientHTTP.PostForm(base+"/devicecode", url.Values{
+		"client_id": {cfg.ClientId},
+		"scope":     {strings.Join(cfg.Scopes, " ")},
+	})
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return TokenResponse{}, newStatusError("devicecode", resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&dc); err != nil {
+		return TokenResponse{}, err
+	}
+
+	if dc.Message != "" {
+		fmt.Fprintln(out, dc.Message)
+	} else {
+		fmt.Fprintf(out, "To sign in, open %s and enter the code %s\n", dc.VerificationUri, dc.UserCode)
+	}
+
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second)
+	for {
+		pollWait(interval)
+		token, err := requestToken(base+"/token", url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"client_id":   {cfg.ClientId},
+			"device_code": {dc.DeviceCode},
+		})
+		if err != nil {
+			return TokenResponse{}, err
+		}
+		switch token.Error {
+		case "":
+			return token, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return TokenResponse{}, errors.New("sign-in failed: " + token.Error + " " + token.ErrorDescription)
+		}
+		if dc.ExpiresIn > 0 && time.Now().After(deadline) {
+			return TokenResponse{}, errors.New("sign-in failed: the code expired")
+		}
+	}
+}
+
+// refreshClientLogin gets a fresh access token for the kept sign-in, keeping
+// the refresh token it's rotated to.
+func refreshClientLogin(cachePath string) (ClientCache, TokenResponse, error) {
+	cache, err := loadClientCache(cachePath)
+	if err != nil {
+		return cache, TokenResponse{}, errors.New("not signed in, run `ip-whitelister login` first")
+	}
+	token, err := requestToken(azureLoginURL+"/"+cache.Config.TenantId+"/oauth2/v2.0/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {cache.Config.ClientId},
+		"refresh_token": {cache.RefreshToken},
+		"scope":         {strings.Join(cache.Config.Scopes, " ")},
+	})
+	if err != nil {
+		return cache, token, err
+	}
+	if token.Error != "" {
+		return cache, token, errors.New("the sign-in has expired, run `ip-whitelister login` again (" + token.Error + ")")
+	}
+	if token.RefreshToken != "" {
+		cache.RefreshToken = token.RefreshToken
+		if err := saveClientCache(cachePath, cache); err != nil {
+			return cache, token, err
+		}
+	}
+	return cache, token, nil
+}
+
+// requestToken posts to a token endpoint. OAuth errors are returned in the
+// response rather than as an error, as some of them mean "try again".
+func requestToken(tokenURL string, form url.Values) (TokenResponse, error) {
+	var token TokenResponse
+	resp, err := clientHTTP.PostForm(tokenURL, form)
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return token, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 && token.Error == "" {
+		return token, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	return token, nil
+}
+
+// clientWhitelist has the server whitelist this machine, for ttl hours or its
+// default when 0, and says for how long.
+func clientWhitelist(server string, accessToken string, ttl int, out io.Writer) error {
+	target := server + "/api/cli/whitelist"
+	if ttl > 0 {
+		target += "?ttl=" + strconv.Itoa(ttl)
+	}
+	req, err := http.NewRequest(http.MethodPost, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	var wl Whitelisting
+	if err := clientDo(req, &wl); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%s has been whitelisted for %s until %s\n", wl.IP, wl.Name, wl.Expires.Local().Format("02-01-2006 at 15:04"))
+	if len(wl.Resources) == 0 {
+		fmt.Fprintln(out, "No resources are covered by your groups.")
+	}
+	for _, id := range wl.Resources {
+		fmt.Fprintln(out, "  "+id)
+	}
+	return nil
+}
+
+func clientGetJSON(url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	return clientDo(req, v)
+}
+
+// clientDo sends a request to the server and decodes its JSON response into v,
+// turning an error response into an error carrying the server's message.
+func clientDo(req *http.Request, v interface{}) error {
+	resp, err := clientHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New("server returned " + resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func loadClientCache(path string) (ClientCache, error) {
+	var cache ClientCache
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cache, err
+	}
+	err = json.Unmarshal(b, &cache)
+	return cache, err
+}
+
+// saveClientCache keeps the sign-in readable by the user only, as the refresh
+// token grants access to their account.
+func saveClientCache(path string, cache ClientCache) error {
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
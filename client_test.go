@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLoginServer plays both AzureAD and the ip-whitelister server for the
+// command-line client. Device code polls answer with polls in turn.
+type fakeLoginServer struct {
+	*httptest.Server
+	polls    []string // token errors to answer device code polls with, "" for a token
+	refresh  []string // refresh tokens seen
+	bearers  []string // access tokens the server was called with
+	methods  []string // methods the whitelist endpoint was called with
+	ttls     []string // ttl query parameters the whitelist endpoint was called with
+	rotation int
+}
+
+func newFakeLoginServer(t *testing.T, polls ...string) *fakeLoginServer {
+	f := &fakeLoginServer{polls: polls}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/cli", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(CliConfig{TenantId: "tenant", ClientId: "client-id", Scopes: cliScopes})
+	})
+	mux.HandleFunc("/tenant/oauth2/v2.0/devicecode", func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("client_id") != "client-id" || !strings.Contains(req.FormValue("scope"), "offline_access") {
+			t.Errorf("devicecode request = %v", req.Form)
+		}
+		json.NewEncoder(w).Encode(DeviceCode{DeviceCode: "dev-code", UserCode: "ABC123", VerificationUri: "https://microsoft.com/devicelogin", ExpiresIn: 900, Interval: 1})
+	})
+	mux.HandleFunc("/tenant/oauth2/v2.0/token", func(w http.ResponseWriter, req *http.Request) {
+		switch req.FormValue("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			poll := f.polls[0]
+			f.polls = f.polls[1:]
+			if poll != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(TokenResponse{Error: poll})
+				return
+			}
+			json.NewEncoder(w).Encode(TokenResponse{AccessToken: "access-0", RefreshToken: "refresh-0"})
+		case "refresh_token":
+			f.refresh = append(f.refresh, req.FormValue("refresh_token"))
+			f.rotation++
+			n := strconv.Itoa(f.rotation)
+			json.NewEncoder(w).Encode(TokenResponse{AccessToken: "access-" + n, RefreshToken: "refresh-" + n})
+		}
+	})
+	mux.HandleFunc("/api/cli/whitelist", func(w http.ResponseWriter, req *http.Request) {
+		f.bearers = append(f.bearers, bearerToken(req))
+		f.methods = append(f.methods, req.Method)
+		f.ttls = append(f.ttls, req.URL.Query().Get("ttl"))
+		if req.Method == http.MethodDelete {
+			json.NewEncoder(w).Encode(Revocation{IP: "203.0.113.9/32", Resources: []RevokedResource{{Id: "unifi/networklist/default/ci", Removed: true}}})
+			return
+		}
+		json.NewEncoder(w).Encode(Whitelisting{Name: "Test User", IP: "203.0.113.9", Expires: time.Now().Add(time.Hour), Resources: []string{"unifi/networklist/default/ci"}})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func TestClientLoginRenewRevoke(t *testing.T) {
+	fs := newFakeLoginServer(t, "authorization_pending", "slow_down", "")
+	defer fs.Close()
+	defer func(u string) { azureLoginURL = u }(azureLoginURL)
+	azureLoginURL = fs.URL
+	var waits []time.Duration
+	defer func() { pollWait = time.Sleep }()
+	pollWait = func(d time.Duration) { waits = append(waits, d) }
+	cachePath := filepath.Join(t.TempDir(), "ip-whitelister", "login.json")
+
+	var out bytes.Buffer
+	if code := runClient("login", []string{"-server", fs.URL + "/", "-cache", cachePath}, &out); code != 0 {
+		t.Fatalf("login exited %d:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "ABC123") || !strings.Contains(out.String(), "203.0.113.9 has been whitelisted") || !strings.Contains(out.String(), "unifi/networklist/default/ci") {
+		t.Errorf("login output:\n%s", out.String())
+	}
+	if len(waits) != 3 || waits[2] != 6*time.Second {
+		t.Errorf("device code polls waited %v, want 1s, 1s then 6s after slow_down", waits)
+	}
+	if info, err := os.Stat(cachePath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("login cache: %v, %v, want a 0600 file", info, err)
+	}
+
+	out.Reset()
+	if code := runClient("renew", []string{"-cache", cachePath, "-ttl", "4"}, &out); code != 0 {
+		t.Fatalf("renew exited %d:\n%s", code, out.String())
+	}
+	if len(fs.ttls) != 2 || fs.ttls[0] != "" || fs.ttls[1] != "4" {
+		t.Errorf("whitelist called with ttls %q, want the default then 4", fs.ttls)
+	}
+	out.Reset()
+	if code := runClient("revoke", []string{"-cache", cachePath}, &out); code != 0 {
+		t.Fatalf("revoke exited %d:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "unifi/networklist/default/ci: removed") {
+		t.Errorf("revoke output:\n%s", out.String())
+	}
+	if got := strings.Join(fs.refresh, ","); got != "refresh-0,refresh-1" {
+		t.Errorf("refresh tokens used = %s, want each rotated one in turn", got)
+	}
+	if got := strings.Join(fs.bearers, ","); got != "access-0,access-1,access-2" {
+		t.Errorf("server called with %s", got)
+	}
+	if got := strings.Join(fs.methods, ","); got != "POST,POST,DELETE" {
+		t.Errorf("whitelist endpoint called with %s", got)
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Errorf("revoke left the login cache behind: %v", err)
+	}
+
+	out.Reset()
+	if code := runClient("renew", []string{"-cache", cachePath}, &out); code == 0 || !strings.Contains(out.String(), "not signed in") {
+		t.Errorf("renew after revoke exited %d:\n%s", code, out.String())
+	}
+}
+
+func TestDeviceCodeLoginDeclined(t *testing.T) {
+	fs := newFakeLoginServer(t, "authorization_pending", "authorization_declined")
+	defer fs.Close()
+	defer func(u string) { azureLoginURL = u }(azureLoginURL)
+	azureLoginURL = fs.URL
+	defer func() { pollWait = time.Sleep }()
+	pollWait = func(time.Duration) {}
+
+	var out bytes.Buffer
+	_, err := deviceCodeLogin(CliConfig{TenantId: "tenant", ClientId: "client-id", Scopes: cliScopes}, &out)
+	if err == nil || !strings.Contains(err.Error(), "authorization_declined") {
+		t.Errorf("deviceCodeLogin() error = %v, want authorization_declined", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultTrustedProxies are trusted when trusted_proxies isn't set: loopback
+// and private ranges, where an ingress or sidecar proxy usually sits. A
+// client reaching the app directly from the internet has a public address,
+// so its headers are ignored.
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// DevConfiguration holds settings only meant for running the app locally.
+type DevConfiguration struct {
+	// LoopbackIP is whitelisted in place of a loopback client address
+	LoopbackIP string `yaml:"loopback_ip"`
+}
+
+// trustedProxies parses trusted_proxies, CIDRs or single addresses.
+func trustedProxies() []*net.IPNet {
+	list := c.TrustedProxies
+	if len(list) == 0 {
+		list = defaultTrustedProxies
+	}
+
+	var nets []*net.IPNet
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Print("clientip.trustedProxies(): ignoring invalid trusted proxy: ", err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func isTrusted(ip net.IP, proxies []*net.IPNet) bool {
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPublic reports whether ip can be whitelisted: not loopback, private,
+// link-local or unspecified.
+func isPublic(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsUnspecified()
+}
+
+// parseHeaderIP reads an address from a client IP header, which may carry a
+// port.
+func parseHeaderIP(v string) net.IP {
+	v = strings.TrimSpace(v)
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		v = host
+	}
+	return net.ParseIP(strings.Trim(v, "[]"))
+}
+
+// forwardedFor walks an X-Forwarded-For chain right to left, past the
+// trusted proxies that appended to it, and returns the first address that
+// isn't one: the client as seen by the outermost trusted proxy. Anything
+// further left was supplied by the client and can't be trusted.
+func forwardedFor(chain string, proxies []*net.IPNet) net.IP {
+	hops := strings.Split(chain, ",")
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHeaderIP(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrusted(hop, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientIP returns the address to whitelist for a request. The configured
+// ip_header (X-Azure-Clientip when unset), or failing that X-Forwarded-For,
+// is only honoured when the request comes from a trusted proxy; otherwise the
+// connection's own address is used. Loopback is replaced by dev.loopback_ip
+// when set, for local testing, and anything that isn't a public address is
+// rejected.
+func clientIP(req *http.Request) (string, error) {
+	ip, err := remoteIP(req)
+	if err != nil {
+		return "", err
+	}
+
+	proxies := trustedProxies()
+	if isTrusted(ip, proxies) {
+		ipHeader := c.Auth.IPHeader
+		if ipHeader == "" {
+			ipHeader = "X-Azure-Clientip"
+		}
+		var fromHeader net.IP
+		if strings.EqualFold(ipHeader, "X-Forwarded-For") {
+			fromHeader = forwardedFor(strings.Join(req.Header.Values("X-Forwarded-For"), ","), proxies)
+		} else if v := req.Header.Get(ipHeader); v != "" {
+			fromHeader = parseHeaderIP(v)
+			if fromHeader == nil {
+				return "", errors.New("'" + v + "' in " + ipHeader + " is not a valid address")
+			}
+		} else if xff := req.Header.Values("X-Forwarded-For"); len(xff) != 0 {
+			fromHeader = forwardedFor(strings.Join(xff, ","), proxies)
+		}
+		if fromHeader != nil {
+			ip = fromHeader
+		}
+	} else if c.Debug && (req.Header.Get(c.Auth.IPHeader) != "" || req.Header.Get("X-Forwarded-For") != "") {
+		log.Print("clientip.clientIP(): ignoring client ip headers from untrusted " + ip.String())
+	}
+	return whitelistableIP(ip)
+}
+
+// remoteIP is the address the request's connection comes from.
+func remoteIP(req *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("'" + req.RemoteAddr + "' is not a valid remote address")
+	}
+	return ip, nil
+}
+
+// whitelistableIP replaces loopback by dev.loopback_ip when set, and rejects
+// anything that isn't a public address.
+func whitelistableIP(ip net.IP) (string, error) {
+	if ip.IsLoopback() && c.Dev.LoopbackIP != "" {
+		ip = net.ParseIP(c.Dev.LoopbackIP)
+	}
+	if !isPublic(ip) {
+		return "", errors.New(ip.String() + " is not a public address and can't be whitelisted")
+	}
+	return ip.String(), nil
+}
+
+// checkClientIP fails a request whose client IP can't be whitelisted, before
+// any sign-in work is done for it.
+func checkClientIP(req *http.Request) error {
+	if _, err := clientIP(req); err != nil {
+		log.Print("clientip.checkClientIP(): ", err)
+		return Error{Code: http.StatusForbidden, Message: "Your IP address can't be whitelisted"}
+	}
+	return nil
+}
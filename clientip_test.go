@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	c.Debug = false
+	defer func() {
+		c.Auth.IPHeader = ""
+		c.TrustedProxies = nil
+		c.Dev.LoopbackIP = ""
+	}()
+
+	tests := []struct {
+		name           string
+		ipHeader       string
+		trustedProxies []string
+		loopbackIP     string
+		remoteAddr     string
+		headers        map[string]string
+		wantIP         string
+		wantErr        bool
+	}{
+		{
+			name:       "header from a trusted proxy",
+			ipHeader:   "Cf-Connecting-Ip",
+			remoteAddr: "10.0.0.1:5555",
+			headers:    map[string]string{"Cf-Connecting-Ip": "1.2.3.4"},
+			wantIP:     "1.2.3.4",
+		},
+		{
+			name:       "header from an untrusted client is ignored",
+			ipHeader:   "Cf-Connecting-Ip",
+			remoteAddr: "8.8.8.8:5555",
+			headers:    map[string]string{"Cf-Connecting-Ip": "1.2.3.4"},
+			wantIP:     "8.8.8.8",
+		},
+		{
+			name:           "configured trusted proxy",
+			ipHeader:       "Cf-Connecting-Ip",
+			trustedProxies: []string{"173.245.48.0/20", "9.9.9.9"},
+			remoteAddr:     "9.9.9.9:5555",
+			headers:        map[string]string{"Cf-Connecting-Ip": "1.2.3.4"},
+			wantIP:         "1.2.3.4",
+		},
+		{
+			name:           "private proxy isn't trusted once trusted_proxies is set",
+			ipHeader:       "Cf-Connecting-Ip",
+			trustedProxies: []string{"173.245.48.0/20"},
+			remoteAddr:     "10.0.0.1:5555",
+			headers:        map[string]string{"Cf-Connecting-Ip": "1.2.3.4"},
+			wantErr:        true,
+		},
+		{
+			name:       "forwarded-for is walked past trusted hops",
+			ipHeader:   "X-Forwarded-For",
+			remoteAddr: "10.0.0.1:5555",
+			headers:    map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2"},
+			wantIP:     "1.2.3.4",
+		},
+		{
+			name:       "forwarded-for is used when ip_header is absent",
+			ipHeader:   "Cf-Connecting-Ip",
+			remoteAddr: "10.0.0.1:5555",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			wantIP:     "1.2.3.4",
+		},
+		{
+			name:       "forwarded-for of only trusted hops is rejected",
+			ipHeader:   "X-Forwarded-For",
+			remoteAddr: "10.0.0.1:5555",
+			headers:    map[string]string{"X-Forwarded-For": "192.168.1.10, 10.0.0.2"},
+			wantErr:    true,
+		},
+		{
+			name:       "private address in the header is rejected",
+			ipHeader:   "Cf-Connecting-Ip",
+			remoteAddr: "10.0.0.1:5555",
+			headers:    map[string]string{"Cf-Connecting-Ip": "192.168.1.10"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid address in the header is rejected",
+			ipHeader:   "Cf-Connecting-Ip",
+			remoteAddr: "10.0.0.1:5555",
+			headers:    map[string]string{"Cf-Connecting-Ip": "not-an-ip"},
+			wantErr:    true,
+		},
+		{
+			name:       "loopback is rejected without dev.loopback_ip",
+			remoteAddr: "[::1]:8080",
+			wantErr:    true,
+		},
+		{
+			name:       "loopback is replaced by dev.loopback_ip",
+			loopbackIP: "80.18.81.18",
+			remoteAddr: "[::1]:8080",
+			wantIP:     "80.18.81.18",
+		},
+		{
+			name:       "link-local remote address is rejected",
+			remoteAddr: "169.254.1.1:5555",
+			wantErr:    true,
+		},
+	}
+
+	for _, f := range tests {
+		t.Run(f.name, func(t *testing.T) {
+			c.Auth.IPHeader = f.ipHeader
+			c.TrustedProxies = f.trustedProxies
+			c.Dev.LoopbackIP = f.loopbackIP
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = f.remoteAddr
+			for k, v := range f.headers {
+				req.Header.Set(k, v)
+			}
+
+			ip, err := clientIP(req)
+			if f.wantErr {
+				if err == nil {
+					t.Fatalf("clientIP() = %q, want an error", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("clientIP() returned error: %v", err)
+			}
+			if ip != f.wantIP {
+				t.Errorf("clientIP() = %q, want %q", ip, f.wantIP)
+			}
+		})
+	}
+}
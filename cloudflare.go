@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+func init() {
+	registerHeaderVerifier("cloudflare", newCloudflareVerifier)
+}
+
+// newCloudflareVerifier verifies the Cf-Access-Jwt-Assertion token Cloudflare
+// Access adds to every request it lets through, against the team's signing
+// keys. Only the team domain and the application's AUD tag need configuring.
+func newCloudflareVerifier(vc VerifyConfiguration) (HeaderVerifier, error) {
+	if vc.TeamDomain == "" {
+		return nil, errors.New("verify type 'cloudflare' needs the team_domain, e.g. myteam.cloudflareaccess.com")
+	}
+	team := "https://" + strings.TrimSuffix(strings.TrimPrefix(vc.TeamDomain, "https://"), "/")
+	if vc.Header == "" {
+		vc.Header = "Cf-Access-Jwt-Assertion"
+	}
+	if vc.Issuer == "" {
+		vc.Issuer = team
+	}
+	if vc.JwksURL == "" {
+		vc.JwksURL = team + "/cdn-cgi/access/certs"
+	}
+	return newJWTVerifier(vc)
+}
@@ -21,7 +21,16 @@ type Configuration struct {
 	Defaults    Defaults                `yaml:"defaults"`
 	IPWhiteList []string                `yaml:"ip_whitelist"`
 	TTL         int                     `yaml:"ttl"`
+	MaxTTL      int                     `yaml:"max_ttl"` // hours users may choose up to, at least ttl
 	Unifi       UnifiConfiguration      `yaml:"unifi"`
+	Sync        SyncConfiguration       `yaml:"sync"`
+	Admin       AdminConfiguration      `yaml:"admin"`
+	Drift       DriftConfiguration      `yaml:"drift"`
+	Session     SessionConfiguration    `yaml:"session"`
+	// TrustedProxies are the CIDRs whose client IP headers are believed,
+	// default private and loopback ranges
+	TrustedProxies []string         `yaml:"trusted_proxies"`
+	Dev            DevConfiguration `yaml:"dev"`
 }
 
 // Defaults are per-config-file fallback values applied to any resource in that
@@ -39,6 +48,38 @@ type UnifiConfiguration struct {
 	Password string `yaml:"password"`
 }
 
+// SyncConfiguration tunes how resources are reconciled against the whitelist.
+type SyncConfiguration struct {
+	Concurrency int                `yaml:"concurrency"` // resources updated in parallel
+	Timeout     int                `yaml:"timeout"`     // seconds allowed per resource update
+	Window      int                `yaml:"window"`      // seconds sync triggers are collected for before syncing
+	Sweep       int                `yaml:"sweep"`       // seconds between full syncs, catching any missed expiry
+	Lease       int                `yaml:"lease"`       // seconds the leader lease lasts without renewal
+	Retry       RetryConfiguration `yaml:"retry"`
+}
+
+// RetryConfiguration controls the backoff between retries of a failed
+// resource update.
+type RetryConfiguration struct {
+	Attempts int `yaml:"attempts"` // retries before giving up until the next sync
+	Base     int `yaml:"base"`     // seconds before the first retry, doubled each attempt
+	Max      int `yaml:"max"`      // seconds the backoff is capped at
+}
+
+// AdminConfiguration controls access to the /admin endpoints. They are
+// disabled while no token is set. The admin dashboard is for signed-in users
+// in one of Group, and disabled while it's empty.
+type AdminConfiguration struct {
+	Token string   `yaml:"token"`
+	Group []string `yaml:"group"`
+}
+
+// DriftConfiguration controls the periodic check of resources for rules
+// changed outside the whitelister.
+type DriftConfiguration struct {
+	Interval int `yaml:"interval"` // seconds between checks, 0 disables
+}
+
 type ResourceConfiguration struct {
 	Cloud          string   `yaml:"cloud"`
 	Type           string   `yaml:"type"`
@@ -48,6 +89,8 @@ type ResourceConfiguration struct {
 	Name           string   `yaml:"name"`
 	IPWhiteList    []string `yaml:"ip_whitelist"`
 	Group          []string `yaml:"group"`
+	Drift          string   `yaml:"drift"`   // correct (default) or alert
+	MaxTTL         int      `yaml:"max_ttl"` // hours whitelistings landing here may last, default max_ttl
 }
 
 var defaultConfigFile = "config/config.yaml"
@@ -103,6 +146,8 @@ func applyDefaults(resources []ResourceConfiguration, d Defaults) {
 // header set by Cloudflare Access.
 func applyAuthDefaults(a Authentication) Authentication {
 	switch strings.ToLower(a.Type) {
+	case "oidc":
+		a.OIDC = applyOIDCDefaults(a.OIDC)
 	case "none", "disabled":
 		if a.Header == "" {
 			a.Header = "Cf-Access-Authenticated-User-Email"
@@ -110,10 +155,48 @@ func applyAuthDefaults(a Authentication) Authentication {
 		if a.IPHeader == "" {
 			a.IPHeader = "Cf-Connecting-Ip"
 		}
+		if a.Verify.Type != "" {
+			a.Verify = applyVerifyDefaults(a.Verify)
+		}
 	}
 	return a
 }
 
+// applySyncDefaults fills in sync defaults: 4 resources at a time, each given
+// 5 minutes to update, triggers collected for 2 seconds, a full sync every
+// hour, and failed updates retried up to 8 times, 30 seconds
+// after the first failure backing off to at most 30 minutes.
+func applySyncDefaults(s SyncConfiguration) SyncConfiguration {
+	if s.Concurrency <= 0 {
+		s.Concurrency = 4
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = 300
+	}
+	if s.Window <= 0 {
+		s.Window = 2
+	}
+	if s.Sweep <= 0 {
+		s.Sweep = 3600
+	}
+	if s.Lease <= 0 {
+		s.Lease = 15
+	}
+	if s.Retry.Attempts <= 0 {
+		s.Retry.Attempts = 8
+	}
+	if s.Retry.Base <= 0 {
+		s.Retry.Base = 30
+	}
+	if s.Retry.Max < s.Retry.Base {
+		s.Retry.Max = 1800
+		if s.Retry.Max < s.Retry.Base {
+			s.Retry.Max = s.Retry.Base
+		}
+	}
+	return s
+}
+
 func (c *Configuration) load(reload ...bool) *Configuration {
 	if strings.ToLower(os.Getenv("DEBUG")) == "true" {
 		c.Debug = true
@@ -147,6 +230,7 @@ func (c *Configuration) load(reload ...bool) *Configuration {
 	}
 
 	c.Auth = applyAuthDefaults(c.Auth)
+	c.Sync = applySyncDefaults(c.Sync)
 
 	if c.Unifi.Site == "" {
 		c.Unifi.Site = "default"
@@ -158,15 +242,6 @@ func (c *Configuration) load(reload ...bool) *Configuration {
 		c.Unifi.Password = os.Getenv("UNIFI_PASSWORD")
 	}
 
-	// empty resources first
-	a.FrontDoor = nil
-	a.KeyVault = nil
-	a.PostgresServer = nil
-	a.StorageAccount = nil
-	a.RedisCache = nil
-	a.CosmosDb = nil
-	u.NetworkList = nil
-
 	// apply the main config file's defaults to its own resources
 	applyDefaults(c.Resources, c.Defaults)
 
@@ -177,85 +252,31 @@ func (c *Configuration) load(reload ...bool) *Configuration {
 	}
 	c.Resources = append(c.Resources, extraResources...)
 
-	// load resources
-	for _, resource := range c.Resources {
-		switch strings.ToLower(resource.Cloud) {
-		case "azure":
-			switch strings.ToLower(resource.Type) {
-			case "frontdoor":
-				var fd AzureFrontDoor
-				fd.SubscriptionId = resource.SubscriptionId
-				fd.ResourceGroup = resource.ResourceGroup
-				fd.PolicyName = resource.PolicyName
-				fd.IPWhiteList = resource.IPWhiteList
-				fd.Group = resource.Group
-				fd.new(fd)
-			case "storageaccount":
-				var st AzureStorageAccount
-				st.SubscriptionId = resource.SubscriptionId
-				st.ResourceGroup = resource.ResourceGroup
-				st.Name = resource.Name
-				st.IPWhiteList = resource.IPWhiteList
-				st.Group = resource.Group
-				st.new(st)
-			case "keyvault":
-				var kv AzureKeyVault
-				kv.SubscriptionId = resource.SubscriptionId
-				kv.ResourceGroup = resource.ResourceGroup
-				kv.Name = resource.Name
-				kv.IPWhiteList = resource.IPWhiteList
-				kv.Group = resource.Group
-				kv.new(kv)
-			case "postgres":
-				var pg AzurePostgresServer
-				pg.SubscriptionId = resource.SubscriptionId
-				pg.ResourceGroup = resource.ResourceGroup
-				pg.Name = resource.Name
-				pg.IPWhiteList = resource.IPWhiteList
-				pg.Group = resource.Group
-				pg.new(pg)
-			case "redis":
-				var rc AzureRedisCache
-				rc.SubscriptionId = resource.SubscriptionId
-				rc.ResourceGroup = resource.ResourceGroup
-				rc.Name = resource.Name
-				rc.IPWhiteList = resource.IPWhiteList
-				rc.Group = resource.Group
-				rc.new(rc)
-			case "cosmosdb":
-				var cd AzureCosmosDb
-				cd.SubscriptionId = resource.SubscriptionId
-				cd.ResourceGroup = resource.ResourceGroup
-				cd.Name = resource.Name
-				cd.IPWhiteList = resource.IPWhiteList
-				cd.Group = resource.Group
-				cd.new(cd)
-			default:
-				log.Fatalln("config.load(): unsupported " + resource.Cloud + " resource type '" + resource.Type + "'")
-			}
-		case "unifi":
-			switch strings.ToLower(resource.Type) {
-			case "networklist":
-				var nl UnifiNetworkList
-				nl.Name = resource.Name
-				nl.Group = resource.Group
-				nl.IPWhiteList = resource.IPWhiteList
-				nl.client = newUnifiClient(c.Unifi)
-				nl.new(nl)
-			default:
-				log.Fatalln("config.load(): unsupported " + resource.Cloud + " resource type '" + resource.Type + "'")
-			}
-		default:
-			log.Fatalln("config.load(): unsupported cloud '" + resource.Cloud + "'")
-		}
+	// build a provider for every resource
+	resources, err := loadProviders(c.Resources)
+	if err != nil {
+		log.Fatalln("config.load(): " + err.Error())
 	}
+	p.set(resources)
 
 	if os.Getenv("CLIENT_SECRET") != "" {
 		c.Auth.ClientSecret = os.Getenv("CLIENT_SECRET")
 	}
+	if os.Getenv("OIDC_CLIENT_SECRET") != "" {
+		c.Auth.OIDC.ClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	}
+	if os.Getenv("GITHUB_CLIENT_SECRET") != "" {
+		c.Auth.GitHub.ClientSecret = os.Getenv("GITHUB_CLIENT_SECRET")
+	}
 	if os.Getenv("REDIS_TOKEN") != "" {
 		c.Redis.Token = os.Getenv("REDIS_TOKEN")
 	}
+	if os.Getenv("ADMIN_TOKEN") != "" {
+		c.Admin.Token = os.Getenv("ADMIN_TOKEN")
+	}
+	if os.Getenv("SESSION_KEYS") != "" {
+		c.Session.Keys = strings.Split(os.Getenv("SESSION_KEYS"), ",")
+	}
 
 	if len(reload) == 0 {
 		log.Println("config.load(): config file loaded")
@@ -143,8 +143,9 @@ func TestUnifiConfigLoad(t *testing.T) {
 		t.Errorf("UNIFI_USERNAME/PASSWORD env overrides not applied: %+v", ret.Unifi)
 	}
 	found := false
-	for _, nl := range u.NetworkList {
-		if nl.Name == "ip-whitelister" {
+	for _, res := range p.all() {
+		nl, ok := res.Provider.(*UnifiNetworkList)
+		if ok && nl.Name == "ip-whitelister" {
 			found = true
 			if nl.client == nil {
 				t.Error("network list client was not constructed")
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// SyncTicket is a requested sync. wait blocks until the sync that covers the
+// request has finished.
+type SyncTicket struct {
+	done   chan struct{}
+	report SyncReport
+}
+
+// wait returns the report of the sync covering the ticket, once it's done.
+func (t *SyncTicket) wait() SyncReport {
+	<-t.done
+	return t.report
+}
+
+// SyncCoordinator collapses sync triggers arriving within a window into a
+// single reconcile and runs one reconcile at a time, so a resource never has
+// two syncs in flight. Triggers arriving while a sync runs are collected for
+// the next one, as the running sync may already have read the whitelist.
+type SyncCoordinator struct {
+	mu        sync.Mutex
+	all       bool            // a trigger asked for every resource
+	ids       map[string]bool // resources asked for by targeted triggers
+	tickets   []*SyncTicket
+	scheduled bool // a sync is waiting for its window or running
+
+	// window overrides syncWindow(), and run l.runSync, in tests.
+	window time.Duration
+	run    func(ids ...string) SyncReport
+}
+
+// syncWindow is how long a trigger waits for others to join its sync.
+func syncWindow() time.Duration {
+	return time.Duration(applySyncDefaults(c.Sync).Window) * time.Second
+}
+
+// trigger requests a sync of the given resource ids, or of every resource when
+// none are given, and returns a ticket for the sync that will cover it.
+func (sc *SyncCoordinator) trigger(ids ...string) *SyncTicket {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	t := &SyncTicket{done: make(chan struct{})}
+	sc.tickets = append(sc.tickets, t)
+	if len(ids) == 0 {
+		sc.all = true
+	}
+	for _, id := range ids {
+		if sc.ids == nil {
+			sc.ids = make(map[string]bool)
+		}
+		sc.ids[id] = true
+	}
+
+	if !sc.scheduled {
+		sc.scheduled = true
+		sc.schedule()
+	}
+	return t
+}
+
+// schedule runs the next sync once the window has passed. Callers must hold
+// sc.mu.
+func (sc *SyncCoordinator) schedule() {
+	window := sc.window
+	if window == 0 {
+		window = syncWindow()
+	}
+	time.AfterFunc(window, sc.flush)
+}
+
+// flush runs one sync for every trigger collected so far and hands its report
+// to their tickets.
+func (sc *SyncCoordinator) flush() {
+	sc.mu.Lock()
+	var ids []string
+	if !sc.all {
+		ids = sortedKeys(sc.ids)
+	}
+	tickets := sc.tickets
+	sc.all, sc.ids, sc.tickets = false, nil, nil
+	sc.mu.Unlock()
+
+	run := sc.run
+	if run == nil {
+		run = l.runSync
+	}
+	report := run(ids...)
+	for _, t := range tickets {
+		t.report = report
+		close(t.done)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if len(sc.tickets) != 0 {
+		sc.schedule()
+		return
+	}
+	sc.scheduled = false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSyncCoordinatorCoalesces(t *testing.T) {
+	var mu sync.Mutex
+	var runs [][]string
+	var running, peak int
+	sc := SyncCoordinator{
+		window: 20 * time.Millisecond,
+		run: func(ids ...string) SyncReport {
+			mu.Lock()
+			runs = append(runs, ids)
+			running++
+			if running > peak {
+				peak = running
+			}
+			n := len(runs)
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return SyncReport{Results: make([]SyncResult, n)}
+		},
+	}
+
+	// triggers within the window share one sync
+	var tickets []*SyncTicket
+	for i := 0; i < 10; i++ {
+		tickets = append(tickets, sc.trigger("fake/b", "fake/a"))
+	}
+	tickets = append(tickets, sc.trigger("fake/a"))
+
+	// once the first sync has started, later triggers wait for a second one
+	time.Sleep(35 * time.Millisecond)
+	late := []*SyncTicket{sc.trigger(), sc.trigger("fake/c")}
+
+	for _, tk := range tickets {
+		if got := len(tk.wait().Results); got != 1 {
+			t.Errorf("early ticket got the report of sync %d, want 1", got)
+		}
+	}
+	for _, tk := range late {
+		if got := len(tk.wait().Results); got != 2 {
+			t.Errorf("late ticket got the report of sync %d, want 2", got)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := [][]string{{"fake/a", "fake/b"}, nil}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("runs = %q, want %q (targeted ids merged, then every resource)", runs, want)
+	}
+	if peak != 1 {
+		t.Errorf("peak concurrent syncs = %d, want 1", peak)
+	}
+}
+
+func TestSyncCoordinatorIdle(t *testing.T) {
+	var mu sync.Mutex
+	var count int
+	sc := SyncCoordinator{
+		window: time.Millisecond,
+		run: func(ids ...string) SyncReport {
+			mu.Lock()
+			count++
+			mu.Unlock()
+			return SyncReport{}
+		},
+	}
+
+	sc.trigger().wait()
+	sc.trigger().wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if count != 2 {
+		t.Errorf("got %d syncs, want one per trigger once the previous sync finished", count)
+	}
+}
+
+func TestFilterResources(t *testing.T) {
+	resources := []Resource{
+		{Provider: &fakeProvider{name: "a"}},
+		{Provider: &fakeProvider{name: "b"}},
+		{Provider: &fakeProvider{name: "c"}},
+	}
+	got := filterResources(resources, []string{"fake/c", "fake/a", "fake/missing"})
+	if len(got) != 2 || got[0].id() != "fake/a" || got[1].id() != "fake/c" {
+		t.Errorf("filterResources() = %v, want fake/a and fake/c in order", got)
+	}
+}
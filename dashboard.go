@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminEntry is an active whitelisting, as the admin dashboard lists it.
+type AdminEntry struct {
+	Key       string
+	IP        string
+	Groups    []string
+	TTL       time.Duration
+	Resources []string // ids of the resources it adds an entry to
+}
+
+// AdminResource is an enabled resource with the outcome of its last sync.
+type AdminResource struct {
+	Id     string
+	Status SyncStatus
+}
+
+var dashboardTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Dynamic IP Whitelist - Admin</title>
+
+    <link href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.7/css/bootstrap.min.css" rel="stylesheet" integrity="sha384-BVYiiSIFeK1dGmJRAkycuHAHRg32OmUcww7on3RYdg4Va+PmSTsz/K68vbdEjh4u" crossorigin="anonymous">
+  </head>
+  <body class="container-fluid">
+    <div class="row">
+      <div class="col-xs-10 col-xs-offset-1">
+        <h1>Active whitelistings</h1>
+{{range .Flashes}}
+        <div class="alert alert-info">{{.}}</div>
+{{end}}
+        <table class="table table-condensed">
+          <tr><th>Identity</th><th>IP</th><th>Groups</th><th>Time left</th><th>Resources</th><th></th></tr>
+{{range .Entries}}
+          <tr>
+            <td>{{.Key}}</td>
+            <td>{{.IP}}</td>
+            <td>{{range .Groups}}{{.}}<br>{{end}}</td>
+            <td>{{.TTL}}</td>
+            <td>{{range .Resources}}{{.}}<br>{{else}}<span class="text-muted">none</span>{{end}}</td>
+            <td>
+              <form method="post" action="/admin/entry" class="form-inline">
+                <input type="hidden" name="key" value="{{.Key}}">
+                <input type="number" name="hours" value="{{$.TTL}}" min="1" class="form-control input-sm" style="width: 5em">
+                <button type="submit" name="action" value="extend" class="btn btn-default btn-sm">Extend</button>
+                <button type="submit" name="action" value="sync" class="btn btn-default btn-sm">Sync</button>
+                <button type="submit" name="action" value="revoke" class="btn btn-danger btn-sm">Revoke</button>
+              </form>
+            </td>
+          </tr>
+{{else}}
+          <tr><td colspan="6">Nobody is whitelisted.</td></tr>
+{{end}}
+        </table>
+
+        <h2>Resources</h2>
+        <table class="table table-condensed">
+          <tr><th>Resource</th><th>Last applied</th><th>Last sync</th><th></th></tr>
+{{range .Resources}}
+          <tr>
+            <td>{{.Id}}</td>
+            <td>{{if .Status.Applied.IsZero}}<span class="text-muted">never</span>{{else}}{{.Status.Applied.Format "02-01-2006 15:04:05 MST"}}{{end}}</td>
+            <td>{{if .Status.Synced.IsZero}}<span class="text-muted">never</span>{{else}}{{.Status.Synced.Format "02-01-2006 15:04:05 MST"}}{{if .Status.Failed}} <span class="text-danger">failed</span>{{else}} <span class="text-success">ok</span>{{end}}{{end}}</td>
+            <td>
+              <form method="post" action="/admin/resource">
+                <input type="hidden" name="id" value="{{.Id}}">
+                <button type="submit" class="btn btn-default btn-sm">Sync</button>
+              </form>
+            </td>
+          </tr>
+{{end}}
+        </table>
+      </div>
+    </div>
+  </body>
+</html>
+`))
+
+// adminGroupOnly guards the admin dashboard: the caller must be signed in, not
+// with an api token, and in one of admin.group. Without a configured group
+// the dashboard doesn't exist.
+func adminGroupOnly(next func(w http.ResponseWriter, req *http.Request, admin *User) error) handle {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		if len(c.Admin.Group) == 0 {
+			return Error{Code: http.StatusNotFound}
+		}
+		u, t, err := apiCaller(req)
+		if err != nil {
+			return err
+		}
+		if t != nil || !hasGroup(c.Admin.Group, u.groups) {
+			log.Print("dashboard.adminGroupOnly(): '" + u.key + "' isn't an admin")
+			return Error{Code: http.StatusForbidden, Message: "You're not an admin"}
+		}
+		return next(w, req, u)
+	}
+}
+
+func registerDashboardHandlers() {
+	http.Handle("/admin", adminGroupOnly(dashboardHandler))
+	http.Handle("/admin/entry", adminGroupOnly(dashboardEntryHandler))
+	http.Handle("/admin/resource", adminGroupOnly(dashboardResourceHandler))
+}
+
+// dashboardHandler lists every active whitelisting and the resources.
+func dashboardHandler(w http.ResponseWriter, req *http.Request, admin *User) error {
+	if req.Method != http.MethodGet {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	entries, err := activeEntries(ctx)
+	if err != nil {
+		log.Print("dashboard.dashboardHandler(): ", err)
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not read the whitelist"}
+	}
+	saved, err := r.getSyncStatuses(ctx)
+	if err != nil {
+		log.Print("dashboard.dashboardHandler(): ", err)
+	}
+	var resources []AdminResource
+	for _, res := range p.enabled() {
+		resources = append(resources, AdminResource{Id: res.id(), Status: parseSyncStatus(saved[res.id()])})
+	}
+
+	session, _ := store.Get(req, "session")
+	flashes := session.Flashes()
+	if len(flashes) != 0 {
+		session.Save(req, w)
+	}
+
+	var data = struct {
+		Flashes   []interface{}
+		Entries   []AdminEntry
+		Resources []AdminResource
+		TTL       int
+	}{
+		Flashes:   flashes,
+		Entries:   entries,
+		Resources: resources,
+		TTL:       c.TTL,
+	}
+	return dashboardTempl.Execute(w, &data)
+}
+
+// activeEntries reads every whitelisting, ordered by key.
+func activeEntries(ctx context.Context) ([]AdminEntry, error) {
+	list, err := r.getWhitelist(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := []AdminEntry{}
+	for _, key := range sortedKeys(list) {
+		_, ttl, err := r.getIp(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		groups, err := r.getUserGroups(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, AdminEntry{
+			Key:       key,
+			IP:        list[key],
+			Groups:    groups,
+			TTL:       ttl.Round(time.Minute),
+			Resources: coveredResources(&User{key: key, cidr: list[key], groups: groups}),
+		})
+	}
+	return entries, nil
+}
+
+// dashboardEntryHandler revokes, extends or starts a sync of a single
+// whitelisting.
+func dashboardEntryHandler(w http.ResponseWriter, req *http.Request, admin *User) error {
+	if req.Method != http.MethodPost {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	msg, err := entryAction(req, admin, req.FormValue("action"), req.FormValue("key"))
+	if err != nil {
+		return err
+	}
+	return dashboardRedirect(w, req, msg)
+}
+
+// entryAction carries out a dashboard action on the whitelisting of key and
+// describes the outcome.
+func entryAction(req *http.Request, admin *User, action string, key string) (string, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	cidr, _, err := r.getIp(ctx, key)
+	if err != nil {
+		log.Print("dashboard.entryAction(): ", err)
+		return "", Error{Code: http.StatusServiceUnavailable, Message: "could not read the whitelist"}
+	}
+	if cidr == "" {
+		return "", Error{Code: http.StatusNotFound, Message: "'" + key + "' isn't whitelisted"}
+	}
+	log.Printf("dashboard.entryAction(): '%s' asked to %s '%s'", admin.key, action, key)
+
+	switch action {
+	case "revoke":
+		rv, err := revoke(req, &User{key: key, name: key, ip: cidr})
+		if err != nil {
+			return "", err
+		}
+		return "Revoked " + key + " (" + rv.IP + ")" + revocationSummary(rv), nil
+
+	case "extend":
+		hours := hoursParam(req, "hours")
+		if hours <= 0 {
+			return "", Error{Code: http.StatusBadRequest, Message: "hours must be a positive number"}
+		}
+		ttl, ok := w.extend(key, time.Duration(hours)*time.Hour)
+		if !ok {
+			return "", Error{Code: http.StatusServiceUnavailable, Message: "could not extend the whitelisting"}
+		}
+		return fmt.Sprintf("Extended %s by %d hours, %v left", key, hours, ttl.Round(time.Minute)), nil
+
+	case "sync":
+		groups, err := r.getUserGroups(ctx, key)
+		if err != nil {
+			log.Print("dashboard.entryAction(): ", err)
+			return "", Error{Code: http.StatusServiceUnavailable, Message: "could not read the whitelist"}
+		}
+		ids := coveredResources(&User{key: key, cidr: cidr, groups: groups})
+		if len(ids) == 0 {
+			return key + " isn't on any resource", nil
+		}
+		s.trigger(ids...)
+		return "Syncing " + strings.Join(ids, ", ") + " for " + key + ", the resources below show when it's done", nil
+	}
+	return "", Error{Code: http.StatusBadRequest, Message: "unknown action '" + action + "'"}
+}
+
+// dashboardResourceHandler starts a sync of a single resource.
+func dashboardResourceHandler(w http.ResponseWriter, req *http.Request, admin *User) error {
+	if req.Method != http.MethodPost {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	id := req.FormValue("id")
+	if len(filterResources(p.enabled(), []string{id})) == 0 {
+		return Error{Code: http.StatusNotFound, Message: "no enabled resource '" + id + "'"}
+	}
+	log.Printf("dashboard.dashboardResourceHandler(): '%s' asked to sync '%s'", admin.key, id)
+	s.trigger(id)
+	return dashboardRedirect(w, req, "Syncing "+id+", the resources below show when it's done")
+}
+
+// dashboardRedirect shows msg on the dashboard it sends the browser back to.
+func dashboardRedirect(w http.ResponseWriter, req *http.Request, msg string) error {
+	session, _ := store.Get(req, "session")
+	session.AddFlash(msg)
+	if err := session.Save(req, w); err != nil {
+		return fmt.Errorf("dashboard.dashboardRedirect(): error saving session: %v", err)
+	}
+	http.Redirect(w, req, "/admin", http.StatusSeeOther)
+	return nil
+}
+
+func revocationSummary(rv Revocation) string {
+	var pending []string
+	for _, res := range rv.Resources {
+		if !res.Removed {
+			pending = append(pending, res.Id)
+		}
+	}
+	if len(pending) == 0 {
+		return ""
+	}
+	return ", still on " + strings.Join(pending, ", ") + " until it's retried"
+}
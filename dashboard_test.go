@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// signedInCookie returns the session cookie of a user signed in as key, with
+// groups.
+func signedInCookie(t *testing.T, key string, groups []string) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	session, _ := store.Get(req, "session")
+	session.Values["key"] = key
+	session.Values["groups"] = groups
+	if err := session.Save(req, rec); err != nil {
+		t.Fatalf("could not save session: %v", err)
+	}
+	return rec.Header().Get("Set-Cookie")
+}
+
+func TestAdminGroupOnly(t *testing.T) {
+	c.Debug = false
+	defer func() { c.Auth.Type, c.Admin.Group = "", nil }()
+	c.Auth.Type = "oidc"
+	store = sessions.NewCookieStore([]byte("test-session-key"))
+
+	tests := []struct {
+		name       string
+		adminGroup []string
+		groups     []string
+		wantCode   int
+	}{
+		{"dashboard disabled", nil, []string{"ops"}, http.StatusNotFound},
+		{"not an admin", []string{"ops"}, []string{"devs"}, http.StatusForbidden},
+		{"admin", []string{"ops"}, []string{"devs", "ops"}, http.StatusOK},
+	}
+
+	for _, f := range tests {
+		c.Admin.Group = f.adminGroup
+		var admin *User
+		h := adminGroupOnly(func(w http.ResponseWriter, req *http.Request, u *User) error {
+			admin = u
+			return nil
+		})
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		req.RemoteAddr = "203.0.113.9:5555"
+		req.Header.Set("Cookie", signedInCookie(t, "alice", f.groups))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != f.wantCode {
+			t.Errorf("%s: got %d, want %d", f.name, rec.Code, f.wantCode)
+		}
+		if (f.wantCode == http.StatusOK) != (admin != nil && admin.key == "alice") {
+			t.Errorf("%s: handler called with %+v", f.name, admin)
+		}
+	}
+}
+
+func TestDashboardEntryActions(t *testing.T) {
+	testRedisInstance := CreateTestRedis(t)
+	var rc RedisConfiguration
+	rc.Host = testRedisInstance.Host
+	rc.Port = testRedisInstance.Port
+	rc.Token = testRedisInstance.Token
+	if !r.connect(rc) {
+		t.Fatal("could not connect to test redis")
+	}
+	defer DeleteTestRedis(t, testRedisInstance)
+	defer p.set(nil)
+	defer func() { c.TTL, c.MaxTTL = 0, 0 }()
+	c.TTL, c.MaxTTL = 24, 0
+	p.set([]Resource{
+		{Provider: &fakeProvider{name: "devs", group: []string{"devs"}}, Config: ResourceConfiguration{MaxTTL: 4}},
+		{Provider: &fakeProvider{name: "ops", group: []string{"ops"}}},
+	})
+
+	runs := make(chan string, 4)
+	defer func() { s.window, s.run = 0, nil }()
+	s.window = time.Millisecond
+	s.run = func(ids ...string) SyncReport {
+		runs <- strings.Join(ids, ",")
+		return SyncReport{}
+	}
+	synced := func() string {
+		select {
+		case ids := <-runs:
+			return ids
+		case <-time.After(5 * time.Second):
+			return "nothing"
+		}
+	}
+
+	ctx := context.Background()
+	if err := r.addIp(ctx, "bob", "203.0.113.7/32", time.Hour); err != nil {
+		t.Fatalf("could not add ip: %v", err)
+	}
+	if err := r.addGroups(ctx, "bob", []string{"devs"}, time.Hour); err != nil {
+		t.Fatalf("could not add groups: %v", err)
+	}
+
+	entries, err := activeEntries(ctx)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("activeEntries() = %+v, %v, want bob's entry", entries, err)
+	}
+	if e := entries[0]; e.Key != "bob" || e.IP != "203.0.113.7/32" || e.TTL != time.Hour || strings.Join(e.Resources, ",") != "fake/devs" {
+		t.Errorf("activeEntries() = %+v, want bob on fake/devs for an hour", e)
+	}
+
+	admin := &User{key: "alice"}
+	action := func(action string, key string, hours string) (string, error) {
+		form := url.Values{"action": {action}, "key": {key}, "hours": {hours}}
+		req := httptest.NewRequest(http.MethodPost, "/admin/entry", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return entryAction(req, admin, req.FormValue("action"), req.FormValue("key"))
+	}
+
+	if _, err := action("extend", "nobody", "2"); !isStatus(err, http.StatusNotFound) {
+		t.Errorf("extend of a missing entry: got %v, want 404", err)
+	}
+	if _, err := action("extend", "bob", "0"); !isStatus(err, http.StatusBadRequest) {
+		t.Errorf("extend by 0 hours: got %v, want 400", err)
+	}
+	if _, err := action("extend", "bob", "2"); err != nil {
+		t.Fatalf("extend returned error: %v", err)
+	}
+	if _, ttl, _ := r.getIp(ctx, "bob"); ttl < 3*time.Hour-time.Minute || ttl > 3*time.Hour {
+		t.Errorf("extended ttl = %v, want 3h", ttl)
+	}
+	if msg, err := action("extend", "bob", "2"); err != nil || !strings.Contains(msg, "4h0m0s left") {
+		t.Errorf("extend past max_ttl = %q, %v, want capped at 4h", msg, err)
+	}
+	if _, ttl, _ := r.getIp(ctx, "bob"); ttl < 4*time.Hour-time.Minute || ttl > 4*time.Hour {
+		t.Errorf("extended ttl = %v, want capped at 4h", ttl)
+	}
+
+	if _, err := action("sync", "bob", ""); err != nil {
+		t.Errorf("sync returned error: %v", err)
+	}
+	if ids := synced(); ids != "fake/devs" {
+		t.Errorf("sync synced %s, want fake/devs", ids)
+	}
+
+	if _, err := action("revoke", "bob", ""); err != nil {
+		t.Fatalf("revoke returned error: %v", err)
+	}
+	if cidr, _, _ := r.getIp(ctx, "bob"); cidr != "" {
+		t.Errorf("revoke left %s whitelisted", cidr)
+	}
+	if ids := synced(); ids != "fake/devs" {
+		t.Errorf("revoke synced %s, want fake/devs again", ids)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Drift modes, set per resource with `drift:`.
+const (
+	driftCorrect = "correct" // put the resource back to the desired rules
+	driftAlert   = "alert"   // only report the drift
+)
+
+// ResourceDrift is the drift found on one resource: entries it should hold
+// but doesn't (Add) and entries it holds that it shouldn't (Remove).
+type ResourceDrift struct {
+	ResourcePlan
+	Mode      string `json:"mode"`
+	Corrected bool   `json:"corrected"`
+	// CorrectError is set when auto-correcting the resource failed.
+	CorrectError string `json:"correct_error,omitempty"`
+}
+
+// DriftReport is the outcome of one drift check. Resources lists only the
+// resources that drifted or couldn't be read.
+type DriftReport struct {
+	Checked   time.Time       `json:"checked"`
+	Total     int             `json:"total"`
+	Resources []ResourceDrift `json:"resources"`
+}
+
+// lastDrift holds the most recent drift report, served at /admin/drift.
+var lastDrift struct {
+	mu     sync.RWMutex
+	report *DriftReport
+}
+
+// driftMode returns how drift on a resource is handled, defaulting to
+// auto-correct.
+func driftMode(rc ResourceConfiguration) (string, error) {
+	switch strings.ToLower(rc.Drift) {
+	case "", driftCorrect:
+		return driftCorrect, nil
+	case driftAlert:
+		return driftAlert, nil
+	}
+	return "", errors.New("unsupported drift mode '" + rc.Drift + "' for resource '" + rc.Name + "', expected '" + driftCorrect + "' or '" + driftAlert + "'")
+}
+
+// detectDrift compares every resource's live rules with those it should hold
+// for list, reports the difference and, for resources in correct mode, applies
+// the desired rules again. Without correct every resource is only reported,
+// as in alert mode.
+func detectDrift(ctx context.Context, resources []Resource, list map[string]string, getGroups func(string) []string, correct bool) DriftReport {
+	report := DriftReport{Checked: time.Now(), Total: len(resources), Resources: []ResourceDrift{}}
+
+	var fix []Resource
+	var corrected []int
+	for i, rp := range planResources(ctx, resources, list, getGroups) {
+		if rp.Error == "" && !rp.changed() {
+			continue
+		}
+		mode, _ := driftMode(resources[i].Config)
+		if !correct {
+			mode = driftAlert
+		}
+		report.Resources = append(report.Resources, ResourceDrift{ResourcePlan: rp, Mode: mode})
+		if rp.Error != "" {
+			log.Print("drift.detectDrift(): could not read '" + rp.Resource + "': " + rp.Error)
+			continue
+		}
+		log.Printf("drift.detectDrift(): '%s' has drifted, %d missing %v, %d unexpected %v", rp.Resource, len(rp.Add), rp.Add, len(rp.Remove), rp.Remove)
+		if mode == driftCorrect {
+			fix = append(fix, resources[i])
+			corrected = append(corrected, len(report.Resources)-1)
+		}
+	}
+
+	if len(fix) != 0 {
+		sc := applySyncDefaults(c.Sync)
+		sr := reconcile(ctx, fix, list, sc.Concurrency, syncTimeout())
+		q.record(sr)
+		for i, res := range sr.Results {
+			rd := &report.Resources[corrected[i]]
+			if res.Err != nil {
+				rd.CorrectError = res.Err.Error()
+				continue
+			}
+			rd.Corrected = true
+			log.Print("drift.detectDrift(): '" + res.Resource + "' corrected")
+		}
+	}
+
+	recordDriftMetrics(report)
+	return report
+}
+
+// checkDrift runs a drift check against the current whitelist and keeps the
+// report for /admin/drift. It holds the sync lock so a sync in progress isn't
+// mistaken for drift. Only the leader corrects resources; elsewhere the drift
+// is just reported.
+func checkDrift() (DriftReport, error) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	ctx, cancel := redisContext()
+	list, err := r.getWhitelist(ctx)
+	cancel()
+	if err != nil {
+		log.Print("drift.checkDrift(): could not read the whitelist: ", err)
+		return DriftReport{}, err
+	}
+
+	report := detectDrift(context.Background(), p.enabled(), list, r.getGroups, l.leading())
+	log.Printf("drift.checkDrift(): %d of %d resources drifted", len(report.Resources), report.Total)
+
+	lastDrift.mu.Lock()
+	lastDrift.report = &report
+	lastDrift.mu.Unlock()
+	return report, nil
+}
+
+// driftInterval is how often resources are checked for drift, 0 when
+// disabled.
+func driftInterval() time.Duration {
+	if c.Drift.Interval <= 0 {
+		return 0
+	}
+	return time.Duration(c.Drift.Interval) * time.Second
+}
+
+// drift periodically checks resources for drift, if enabled.
+func (*Whitelist) drift() {
+	interval := driftInterval()
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		if l.leading() {
+			checkDrift()
+		}
+	}
+}
+
+// recordDriftMetrics publishes a drift report as metrics.
+func recordDriftMetrics(report DriftReport) {
+	m.add("ip_whitelister_drift_checks_total", nil, 1)
+	m.reset("ip_whitelister_drift_entries")
+	m.reset("ip_whitelister_drift_read_errors")
+	for _, rd := range report.Resources {
+		if rd.Error != "" {
+			m.set("ip_whitelister_drift_read_errors", map[string]string{"resource": rd.Resource}, 1)
+			continue
+		}
+		m.set("ip_whitelister_drift_entries", map[string]string{"resource": rd.Resource, "kind": "missing"}, float64(len(rd.Add)))
+		m.set("ip_whitelister_drift_entries", map[string]string{"resource": rd.Resource, "kind": "unexpected"}, float64(len(rd.Remove)))
+		if rd.Mode == driftCorrect {
+			result := "ok"
+			if !rd.Corrected {
+				result = "failed"
+			}
+			m.add("ip_whitelister_drift_corrections_total", map[string]string{"resource": rd.Resource, "result": result}, 1)
+		}
+	}
+}
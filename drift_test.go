@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDetectDrift(t *testing.T) {
+	defer func() { m = Metrics{} }()
+
+	inSync := &fakeProvider{name: "in-sync", entries: []string{"1.1.1.1/32", "2.2.2.2/32"}}
+	fixed := &fakeProvider{name: "fixed", entries: []string{"1.1.1.1/32", "6.6.6.6/32"}}
+	alerted := &fakeProvider{name: "alerted", entries: []string{"1.1.1.1/32"}}
+	broken := &fakeProvider{name: "broken", entries: []string{}, fail: errors.New("conflict")}
+	unreadable := &fakeProvider{name: "unreadable", err: errors.New("forbidden")}
+	resources := []Resource{
+		{Provider: inSync},
+		{Provider: fixed},
+		{Provider: alerted, Config: ResourceConfiguration{Drift: "alert"}},
+		{Provider: broken, Config: ResourceConfiguration{Drift: "correct"}},
+		{Provider: unreadable},
+	}
+	list := map[string]string{"alice": "1.1.1.1/32", "bob": "2.2.2.2/32"}
+
+	report := detectDrift(context.Background(), resources, list, func(string) []string { return nil }, true)
+
+	if report.Total != 5 || len(report.Resources) != 4 {
+		t.Fatalf("detectDrift() = %+v, want 4 of 5 resources reported", report)
+	}
+	got := map[string]ResourceDrift{}
+	for _, rd := range report.Resources {
+		got[rd.Resource] = rd
+	}
+	if _, ok := got["fake/in-sync"]; ok || inSync.updated() {
+		t.Errorf("in-sync resource was reported or updated")
+	}
+	if rd := got["fake/fixed"]; !rd.Corrected || rd.Mode != driftCorrect || strings.Join(rd.Add, ",") != "2.2.2.2/32" || strings.Join(rd.Remove, ",") != "6.6.6.6/32" || !fixed.updated() {
+		t.Errorf("fixed resource = %+v, want bob's ip missing, 6.6.6.6 unexpected, corrected", rd)
+	}
+	if rd := got["fake/alerted"]; rd.Corrected || rd.Mode != driftAlert || alerted.updated() {
+		t.Errorf("alert-only resource = %+v, updated %v, want it left alone", rd, alerted.updated())
+	}
+	if rd := got["fake/broken"]; rd.Corrected || rd.CorrectError != "conflict" {
+		t.Errorf("broken resource = %+v, want correct error conflict", rd)
+	}
+	if rd := got["fake/unreadable"]; rd.Error != "forbidden" || unreadable.updated() {
+		t.Errorf("unreadable resource = %+v, want read error and no update", rd)
+	}
+
+	var out bytes.Buffer
+	m.write(&out)
+	for _, line := range []string{
+		"ip_whitelister_drift_checks_total 1",
+		`ip_whitelister_drift_entries{kind="missing",resource="fake/fixed"} 1`,
+		`ip_whitelister_drift_entries{kind="unexpected",resource="fake/fixed"} 1`,
+		`ip_whitelister_drift_corrections_total{resource="fake/fixed",result="ok"} 1`,
+		`ip_whitelister_drift_corrections_total{resource="fake/broken",result="failed"} 1`,
+		`ip_whitelister_drift_read_errors{resource="fake/unreadable"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("metrics missing %q, got:\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "fake/alerted\",result") {
+		t.Errorf("alert-only resource counted as a correction:\n%s", out.String())
+	}
+}
+
+func TestDetectDriftFollower(t *testing.T) {
+	defer func() { m = Metrics{} }()
+
+	drifted := &fakeProvider{name: "drifted", entries: []string{"6.6.6.6/32"}}
+	list := map[string]string{"alice": "1.1.1.1/32"}
+
+	// a follower only reports: the leader may be syncing the same resource
+	report := detectDrift(context.Background(), []Resource{{Provider: drifted}}, list, func(string) []string { return nil }, false)
+
+	if len(report.Resources) != 1 || report.Resources[0].Mode != driftAlert || report.Resources[0].Corrected || drifted.updated() {
+		t.Errorf("detectDrift() = %+v, updated %v, want the drift reported only", report, drifted.updated())
+	}
+}
+
+func TestDriftMode(t *testing.T) {
+	tests := []struct {
+		drift string
+		want  string
+		err   bool
+	}{
+		{"", driftCorrect, false},
+		{"correct", driftCorrect, false},
+		{"Alert", driftAlert, false},
+		{"ignore", "", true},
+	}
+
+	for _, f := range tests {
+		got, err := driftMode(ResourceConfiguration{Name: "kv", Drift: f.drift})
+		if got != f.want || (err != nil) != f.err {
+			t.Errorf("driftMode(%q) = %q, %v", f.drift, got, err)
+		}
+	}
+
+	_, err := loadProviders([]ResourceConfiguration{{Cloud: "azure", Type: "keyvault", Name: "kv", Drift: "ignore"}})
+	if err == nil || !strings.Contains(err.Error(), "'ignore'") {
+		t.Errorf("loadProviders() error = %v, want unsupported drift mode", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// forwardAuthResource is the resource id /auth checks api token restrictions
+// against; no token names it, so tokens restricted to resources don't pass.
+const forwardAuthResource = "auth"
+
+// forwardAuthHandler answers the check a reverse proxy (nginx auth_request,
+// Traefik ForwardAuth) makes before each request it lets through: 200 when the
+// caller's IP is whitelisted, by a user in ?group=<group> when given, and 401
+// otherwise, or a redirect to the sign-in page with ?redirect=true.
+func forwardAuthHandler(w http.ResponseWriter, req *http.Request) error {
+	group := req.FormValue("group")
+
+	ip, err := forwardAuthIP(req)
+	if err != nil {
+		if c.Debug {
+			log.Print("forwardauth.forwardAuthHandler(): ", err)
+		}
+		return forwardAuthDenied(w, req)
+	}
+	cidr, err := addNetmask(ip)
+	if err != nil {
+		return forwardAuthDenied(w, req)
+	}
+	list, err := r.whitelistedAt(req.Context(), cidr)
+	if err != nil {
+		log.Print("forwardauth.forwardAuthHandler(): ", err)
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not read the whitelist"}
+	}
+	key, ok := whitelistedBy(ip, group, list, r.getGroups)
+	if !ok {
+		if c.Debug {
+			log.Print("forwardauth.forwardAuthHandler(): " + ip + " isn't whitelisted for group '" + group + "'")
+		}
+		return forwardAuthDenied(w, req)
+	}
+
+	w.Header().Set("X-Whitelist-User", key)
+	w.Write([]byte("ok"))
+	return nil
+}
+
+// forwardAuthIP returns the address a proxy asks /auth about. Proxies pass the
+// client's own headers on to /auth, so ip_header can't be trusted here: only
+// X-Forwarded-For is, walked past the trusted proxies that appended to it.
+func forwardAuthIP(req *http.Request) (string, error) {
+	ip, err := remoteIP(req)
+	if err != nil {
+		return "", err
+	}
+	proxies := trustedProxies()
+	if xff := req.Header.Values("X-Forwarded-For"); len(xff) != 0 && isTrusted(ip, proxies) {
+		if fwd := forwardedFor(strings.Join(xff, ","), proxies); fwd != nil {
+			ip = fwd
+		}
+	}
+	return whitelistableIP(ip)
+}
+
+func forwardAuthDenied(w http.ResponseWriter, req *http.Request) error {
+	if req.FormValue("redirect") == "true" {
+		http.Redirect(w, req, c.Url+"/", http.StatusFound)
+		return nil
+	}
+	return Error{Code: http.StatusUnauthorized}
+}
+
+// whitelistedBy returns who ip is whitelisted by: the key of a user whose
+// entry covers it, and who is in group when one is given, or "ip_whitelist"
+// for the static whitelist, which, as on every resource, passes any group.
+func whitelistedBy(ip string, group string, list map[string]string, getGroups func(string) []string) (string, bool) {
+	if w.inRange(ip, c.IPWhiteList) {
+		return "ip_whitelist", true
+	}
+	var groups []string
+	if group != "" {
+		groups = []string{group}
+	}
+	for _, key := range sortedKeys(list) {
+		if !w.inRange(ip, []string{list[key]}) {
+			continue
+		}
+		userGroups := getGroups(key)
+		if hasGroup(groups, userGroups) && hasResource(forwardAuthResource, userGroups) {
+			return key, true
+		}
+	}
+	return "", false
+}
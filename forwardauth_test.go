@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWhitelistedBy(t *testing.T) {
+	c.Debug = false
+	defer func() { c.IPWhiteList = nil }()
+	c.IPWhiteList = []string{"85.0.0.0/24"}
+
+	list := map[string]string{
+		"alice":   "203.0.113.9/32",
+		"bob":     "198.51.100.7/32",
+		"tokenci": "192.0.2.10/32",
+	}
+	groups := map[string][]string{
+		"alice":   {"devs"},
+		"bob":     {"ops"},
+		"tokenci": {"devs", "resource:azure/keyvault/rg/kv"},
+	}
+	getGroups := func(key string) []string { return groups[key] }
+
+	tests := []struct {
+		ip      string
+		group   string
+		wantKey string
+		wantOk  bool
+	}{
+		{"203.0.113.9", "", "alice", true},
+		{"203.0.113.9", "devs", "alice", true},
+		{"203.0.113.9", "ops", "", false},
+		{"198.51.100.7", "ops", "bob", true},
+		{"203.0.113.10", "", "", false},
+		// static entries pass any group, as they do on every resource
+		{"85.0.0.12", "ops", "ip_whitelist", true},
+		// a token restricted to resources isn't good for /auth
+		{"192.0.2.10", "devs", "", false},
+	}
+
+	for _, f := range tests {
+		key, ok := whitelistedBy(f.ip, f.group, list, getGroups)
+		if key != f.wantKey || ok != f.wantOk {
+			t.Errorf("whitelistedBy(%q, %q) = %q, %v, want %q, %v", f.ip, f.group, key, ok, f.wantKey, f.wantOk)
+		}
+	}
+}
+
+func TestForwardAuthIP(t *testing.T) {
+	c.Debug = false
+	defer func() { c.Auth.IPHeader = "" }()
+
+	tests := []struct {
+		name       string
+		ipHeader   string
+		remoteAddr string
+		header     map[string]string
+		want       string
+	}{
+		{"proxy sets X-Forwarded-For", "", "10.0.0.1:5555", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"client prepends to X-Forwarded-For", "", "10.0.0.1:5555", map[string]string{"X-Forwarded-For": "198.51.100.7, 203.0.113.9"}, "203.0.113.9"},
+		// proxies pass the client's headers on, so the sign-in ip_header is spoofable
+		{"spoofed default ip_header", "", "10.0.0.1:5555", map[string]string{"X-Azure-Clientip": "198.51.100.7", "X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"spoofed configured ip_header", "Cf-Connecting-Ip", "10.0.0.1:5555", map[string]string{"Cf-Connecting-Ip": "198.51.100.7", "X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"untrusted caller", "", "203.0.113.9:5555", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "203.0.113.9"},
+	}
+
+	for _, f := range tests {
+		c.Auth.IPHeader = f.ipHeader
+		req := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		req.RemoteAddr = f.remoteAddr
+		for k, v := range f.header {
+			req.Header.Set(k, v)
+		}
+		if got, err := forwardAuthIP(req); got != f.want || err != nil {
+			t.Errorf("%s: forwardAuthIP() = %q, %v, want %q", f.name, got, err, f.want)
+		}
+	}
+
+	// only the spoofed header names a public address: the proxy's own is private
+	req := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("X-Azure-Clientip", "198.51.100.7")
+	if got, err := forwardAuthIP(req); err == nil {
+		t.Errorf("forwardAuthIP() = %q with only X-Azure-Clientip, want an error", got)
+	}
+}
+
+func TestForwardAuthHandlerDenied(t *testing.T) {
+	c.Debug = false
+	defer func() { c.Url = "" }()
+	c.Url = "https://whitelist.example.com"
+
+	tests := []struct {
+		target       string
+		wantCode     int
+		wantLocation string
+	}{
+		{"/auth", http.StatusUnauthorized, ""},
+		{"/auth?group=devs", http.StatusUnauthorized, ""},
+		{"/auth?redirect=true", http.StatusFound, "https://whitelist.example.com/"},
+	}
+
+	for _, f := range tests {
+		// a private caller is never whitelisted, so redis isn't needed
+		req := httptest.NewRequest(http.MethodGet, f.target, nil)
+		req.RemoteAddr = "10.0.0.1:5555"
+		req.Header.Set("X-Forwarded-For", "192.168.1.20")
+		rec := httptest.NewRecorder()
+		handle(forwardAuthHandler).ServeHTTP(rec, req)
+		if rec.Code != f.wantCode || rec.Header().Get("Location") != f.wantLocation {
+			t.Errorf("%s: got %d %q, want %d %q", f.target, rec.Code, rec.Header().Get("Location"), f.wantCode, f.wantLocation)
+		}
+	}
+}
+
+func TestForwardAuthHandler(t *testing.T) {
+	testRedisInstance := CreateTestRedis(t)
+	var rc RedisConfiguration
+	rc.Host = testRedisInstance.Host
+	rc.Port = testRedisInstance.Port
+	rc.Token = testRedisInstance.Token
+	if !r.connect(rc) {
+		t.Fatal("could not connect to test redis")
+	}
+	defer DeleteTestRedis(t, testRedisInstance)
+	c.Debug = false
+
+	ctx := context.Background()
+	if err := r.addIp(ctx, "alice", "198.51.100.7/32", time.Hour); err != nil {
+		t.Fatalf("could not add ip: %v", err)
+	}
+	if err := r.addGroups(ctx, "alice", []string{"devs"}, time.Hour); err != nil {
+		t.Fatalf("could not add groups: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		header   map[string]string
+		wantCode int
+	}{
+		{"whitelisted", map[string]string{"X-Forwarded-For": "198.51.100.7"}, http.StatusOK},
+		{"spoofed ip_header through the proxy", map[string]string{"X-Azure-Clientip": "198.51.100.7", "X-Forwarded-For": "203.0.113.50"}, http.StatusUnauthorized},
+		{"not whitelisted", map[string]string{"X-Forwarded-For": "203.0.113.50"}, http.StatusUnauthorized},
+	}
+
+	for _, f := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/auth?group=devs", nil)
+		req.RemoteAddr = "10.0.0.1:5555"
+		for k, v := range f.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handle(forwardAuthHandler).ServeHTTP(rec, req)
+		if rec.Code != f.wantCode {
+			t.Errorf("%s: got %d, want %d", f.name, rec.Code, f.wantCode)
+		}
+		if f.wantCode == http.StatusOK && rec.Header().Get("X-Whitelist-User") != "alice" {
+			t.Errorf("%s: X-Whitelist-User = %q, want alice", f.name, rec.Header().Get("X-Whitelist-User"))
+		}
+	}
+}
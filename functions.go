@@ -80,6 +80,25 @@ func hasGroup(resourceGroups []string, userGroups []string) bool {
 	return false
 }
 
+// resourceScope marks the entries of a user's groups that restrict them to
+// named resources, as api tokens can be.
+const resourceScope = "resource:"
+
+// hasResource reports whether a user may be whitelisted on the resource id:
+// always, unless their groups restrict them to other resources.
+func hasResource(id string, userGroups []string) bool {
+	scoped := false
+	for _, ug := range userGroups {
+		if strings.HasPrefix(ug, resourceScope) {
+			if strings.TrimPrefix(ug, resourceScope) == id {
+				return true
+			}
+			scoped = true
+		}
+	}
+	return !scoped
+}
+
 // isValidIpOrNetV4 reports whether ip is a parseable IPv4 address or IPv4 CIDR.
 func isValidIpOrNetV4(ip string) bool {
 	ipType, err := ipVersion(ip)
@@ -81,6 +81,26 @@ func TestHasGroup(t *testing.T) {
 
 }
 
+func TestHasResource(t *testing.T) {
+	tests := []struct {
+		id         string
+		userGroups []string
+		want       bool
+	}{
+		{"azure/keyvault/rg/kv", nil, true},
+		{"azure/keyvault/rg/kv", []string{"group1"}, true},
+		{"azure/keyvault/rg/kv", []string{"group1", "resource:azure/keyvault/rg/kv"}, true},
+		{"azure/keyvault/rg/kv", []string{"resource:unifi/networklist/default/ci", "resource:azure/keyvault/rg/kv"}, true},
+		{"azure/keyvault/rg/kv", []string{"group1", "resource:unifi/networklist/default/ci"}, false},
+	}
+
+	for _, f := range tests {
+		if got := hasResource(f.id, f.userGroups); got != f.want {
+			t.Errorf("hasResource(%q, %v) = %v, want %v", f.id, f.userGroups, got, f.want)
+		}
+	}
+}
+
 func TestIsValidIpOrNetV4(t *testing.T) {
 	tests := []struct {
 		ip      string
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// GitHubConfiguration signs users in with a GitHub OAuth app, for
+// auth.type: github.
+type GitHubConfiguration struct {
+	ClientId     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Orgs         []string `yaml:"orgs"` // users must be a member of one of these
+}
+
+// GitHubUser is a signed-in GitHub user, with their orgs and teams as groups.
+type GitHubUser struct {
+	Login  string
+	Name   string
+	Groups []string
+}
+
+// githubAPI is the GitHub REST API users are looked up with.
+var githubAPI = "https://api.github.com"
+
+var errNotOrgMember = errors.New("not a member of any of the configured orgs")
+
+func (a *Authentication) initGitHub() {
+	ctx = context.Background()
+
+	if len(a.GitHub.Orgs) == 0 {
+		log.Fatalln("http.initGitHub(): auth.github.orgs is empty, anyone with a GitHub account could whitelist themselves")
+	}
+	oauthConfig = &oauth2.Config{
+		ClientID:     a.GitHub.ClientId,
+		ClientSecret: a.GitHub.ClientSecret,
+		RedirectURL:  c.Url + "/callback",
+		Endpoint:     github.Endpoint,
+		// read:org shows private org and team membership
+		Scopes: []string{"read:user", "read:org"},
+	}
+
+	http.Handle("/live", handle(livenessHandler))
+	http.Handle("/ready", handle(readinessHandler))
+	http.Handle("/callback", handle(githubCallbackHandler))
+	http.Handle("/", handle(signInIndexHandler))
+	log.Fatal(http.ListenAndServe(":8090", nil))
+}
+
+// githubCallbackHandler exchanges the authorization code and whitelists the
+// GitHub user, if they're in one of the configured orgs.
+func githubCallbackHandler(w http.ResponseWriter, req *http.Request) error {
+	if err := checkClientIP(req); err != nil {
+		return err
+	}
+	token, _, err := completeLogin(w, req)
+	if err != nil {
+		return err
+	}
+
+	gu, err := lookupGitHubUser(oauthConfig.Client(ctx, token), c.Auth.GitHub.Orgs)
+	if err == errNotOrgMember {
+		return Error{Code: http.StatusForbidden, Message: "Sign-in failed: you're not a member of " + strings.Join(c.Auth.GitHub.Orgs, " or ")}
+	}
+	if err != nil {
+		log.Print("http.githubCallbackHandler(): ", err)
+		return Error{Code: http.StatusBadGateway, Message: "Sign-in failed: your account could not be looked up"}
+	}
+
+	var u User
+	if u.newFromGitHub(gu, req) == nil {
+		return Error{Code: http.StatusForbidden, Message: "Your IP address can't be whitelisted"}
+	}
+	if !u.whitelist() {
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not whitelist " + u.ip}
+	}
+
+	if err := saveSignIn(w, req, &u); err != nil {
+		return fmt.Errorf("http.githubCallbackHandler(): error saving session: %v", err)
+	}
+
+	http.Redirect(w, req, "/", http.StatusFound)
+	return nil
+}
+
+// lookupGitHubUser reads the signed-in user, checks they're an active member
+// of one of orgs, and returns those orgs and the user's teams in them as
+// groups: "<org>" and "<org>/<team-slug>", in lower case.
+func lookupGitHubUser(client *http.Client, orgs []string) (GitHubUser, error) {
+	var gu GitHubUser
+	var user struct {
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if _, err := githubGet(client, githubAPI+"/user", &user); err != nil {
+		return gu, err
+	}
+	gu.Login, gu.Name = user.Login, user.Name
+
+	member := make(map[string]bool)
+	for _, org := range orgs {
+		org = strings.ToLower(org)
+		var membership struct {
+			State string `json:"state"`
+		}
+		_, err := githubGet(client, githubAPI+"/user/memberships/orgs/"+org, &membership)
+		if status, _ := errorStatus(err); status == http.StatusNotFound || status == http.StatusForbidden {
+			continue
+		}
+		if err != nil {
+			return gu, err
+		}
+		if membership.State == "active" {
+			member[org] = true
+			gu.Groups = append(gu.Groups, org)
+		}
+	}
+	if len(member) == 0 {
+		return gu, errNotOrgMember
+	}
+
+	next := githubAPI + "/user/teams?per_page=100"
+	for next != "" {
+		var teams []struct {
+			Slug         string `json:"slug"`
+			Organization struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}
+		var err error
+		if next, err = githubGet(client, next, &teams); err != nil {
+			return gu, err
+		}
+		for _, team := range teams {
+			org := strings.ToLower(team.Organization.Login)
+			if member[org] {
+				gu.Groups = append(gu.Groups, org+"/"+strings.ToLower(team.Slug))
+			}
+		}
+	}
+	return gu, nil
+}
+
+// githubLinkNext finds the next page in a Link header.
+var githubLinkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// githubGet decodes a GitHub API response into v, and returns the URL of the
+// next page, if any.
+func githubGet(client *http.Client, url string, v interface{}) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return "", newStatusError("github", resp)
+	}
+	var next string
+	if m := githubLinkNext.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+	return next, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// newFromGitHub builds a User keyed on their GitHub login.
+func (u *User) newFromGitHub(gu GitHubUser, req *http.Request) *User {
+	u.name = gu.Name
+	if u.name == "" {
+		u.name = gu.Login
+	}
+	u.groups = gu.Groups
+
+	if c.Debug {
+		log.Printf("user.newFromGitHub(): %v groups: %v", u.name, u.groups)
+	}
+
+	if err := u.finishUser(gu.Login, req); err != nil {
+		log.Printf("user.newFromGitHub(): %v", err)
+		return nil
+	}
+
+	log.Println("user.newFromGitHub(): authentication successful - " + u.name + " (" + gu.Login + ") - " + u.ip)
+	return u
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeGitHub serves the GitHub API calls a sign-in makes. memberships maps an
+// org to the answer of its membership lookup, not found when missing.
+func fakeGitHub(memberships map[string]fakeResponse) *httptest.Server {
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"login":"Octocat","name":"The Octocat"}`))
+	})
+	mux.HandleFunc("/user/memberships/orgs/", func(w http.ResponseWriter, req *http.Request) {
+		m, ok := memberships[strings.TrimPrefix(req.URL.Path, "/user/memberships/orgs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(m.status)
+		w.Write([]byte(m.body))
+	})
+	mux.HandleFunc("/user/teams", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `<`+srv.URL+`/user/teams?per_page=100&page=2>; rel="next", <`+srv.URL+`/user/teams?per_page=100&page=2>; rel="last"`)
+			w.Write([]byte(`[{"slug":"infra","organization":{"login":"Acme"}},{"slug":"other","organization":{"login":"elsewhere"}}]`))
+			return
+		}
+		w.Write([]byte(`[{"slug":"Web-Team","organization":{"login":"acme"}}]`))
+	})
+	srv = httptest.NewServer(mux)
+	return srv
+}
+
+func TestLookupGitHubUser(t *testing.T) {
+	defer func(u string) { githubAPI = u }(githubAPI)
+
+	tests := []struct {
+		name        string
+		orgs        []string
+		memberships map[string]fakeResponse
+		wantGroups  []string
+		wantErr     error
+		wantAnyErr  bool
+	}{
+		{
+			name:        "member with teams across pages",
+			orgs:        []string{"Acme"},
+			memberships: map[string]fakeResponse{"acme": {200, `{"state":"active"}`}, "elsewhere": {200, `{"state":"active"}`}},
+			wantGroups:  []string{"acme", "acme/infra", "acme/web-team"},
+		},
+		{
+			name:        "member of one of several orgs",
+			orgs:        []string{"other-org", "acme"},
+			memberships: map[string]fakeResponse{"acme": {200, `{"state":"active"}`}},
+			wantGroups:  []string{"acme", "acme/infra", "acme/web-team"},
+		},
+		{
+			name:        "pending invitation isn't membership",
+			orgs:        []string{"acme"},
+			memberships: map[string]fakeResponse{"acme": {200, `{"state":"pending"}`}},
+			wantErr:     errNotOrgMember,
+		},
+		{
+			name:        "not a member",
+			orgs:        []string{"acme"},
+			memberships: map[string]fakeResponse{},
+			wantErr:     errNotOrgMember,
+		},
+		{
+			name:        "org blocks the app",
+			orgs:        []string{"acme"},
+			memberships: map[string]fakeResponse{"acme": {403, `{"state":""}`}},
+			wantErr:     errNotOrgMember,
+		},
+		{
+			name:        "github error",
+			orgs:        []string{"acme"},
+			memberships: map[string]fakeResponse{"acme": {500, `{"state":""}`}},
+			wantAnyErr:  true,
+		},
+	}
+
+	for _, f := range tests {
+		t.Run(f.name, func(t *testing.T) {
+			srv := fakeGitHub(f.memberships)
+			defer srv.Close()
+			githubAPI = srv.URL
+
+			gu, err := lookupGitHubUser(srv.Client(), f.orgs)
+			if f.wantAnyErr || f.wantErr != nil {
+				if err == nil || (f.wantErr != nil && err != f.wantErr) {
+					t.Fatalf("lookupGitHubUser() error = %v, want %v", err, f.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupGitHubUser() returned error: %v", err)
+			}
+			if gu.Login != "Octocat" || gu.Name != "The Octocat" {
+				t.Errorf("user = %+v", gu)
+			}
+			if strings.Join(gu.Groups, ",") != strings.Join(f.wantGroups, ",") {
+				t.Errorf("groups = %v, want %v", gu.Groups, f.wantGroups)
+			}
+		})
+	}
+}
+
+func TestUserNewFromGitHub(t *testing.T) {
+	c.Debug = false
+	req := httptest.NewRequest("GET", "/callback", nil)
+	req.RemoteAddr = "203.0.113.9:5555"
+
+	var u User
+	if u.newFromGitHub(GitHubUser{Login: "Octo-Cat", Groups: []string{"acme/infra"}}, req) == nil {
+		t.Fatal("newFromGitHub() returned nil")
+	}
+	if u.key != "octocat" || u.name != "Octo-Cat" || u.ip != "203.0.113.9" || !hasGroup([]string{"acme/infra"}, u.groups) {
+		t.Errorf("newFromGitHub() = %+v", u)
+	}
+}
@@ -2,14 +2,11 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/gob"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
-	"net/url"
 	"strings"
 
 	"github.com/gorilla/sessions"
@@ -23,8 +20,8 @@ var httpLive bool = true
 var httpReady bool = false
 
 type Error struct {
-	Code    int
-	Message string
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
 var indexTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
@@ -40,10 +37,15 @@ var indexTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
         <h1>Dynamic IP Whitelist</h1>
 {{with .Token}}
 				<div id="displayName"></div>
-				<i>Note: It can take a few minutes for your whitelisting to become active.</i>
+				<i>Note: It can take a few minutes for your whitelisting to become active, <a href="/status">My access</a> shows how far it has got.</i>
 				<br>
 				<br>
 				<a href="/?new=true">Whitelist again</a>
+				<br>
+				<br>
+				<form method="post" action="/revoke">
+					<button type="submit" class="btn btn-default">Remove my whitelisting</button>
+				</form>
 {{else}}
 				Whitelisting your IP........
 				<meta http-equiv="refresh" content="0; URL={{$.AuthURL}}" />
@@ -57,7 +59,7 @@ var indexTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
       var token = {{.}};
 
       $.ajax({
-        url: 'https://graph.windows.net/me?api-version=1.6',
+        url: 'https://graph.microsoft.com/v1.0/me',
         dataType: 'json',
         success: function(data, status) {
         	$('#displayName').text('Welcome ' + data.displayName + ', your IP (' + {{$.IPAddress}} + ') has been whitelisted. Please note that IPv6 cannot be whitelisted on all resources.');
@@ -72,7 +74,7 @@ var indexTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
 </html>
 `))
 
-var noAuthTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+var welcomeTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
 <html>
   <head>
     <title>Dynamic IP Whitelist</title>
@@ -85,7 +87,17 @@ var noAuthTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
         <h1>Dynamic IP Whitelist</h1>
         Welcome{{with .Name}} {{.}}{{end}}, your IP ({{.IPAddress}}) has been whitelisted.
         <br>
-        <i>Note: It can take a few minutes for your whitelisting to become active. Please note that IPv6 cannot be whitelisted on all resources.</i>
+        <i>Note: It can take a few minutes for your whitelisting to become active, <a href="/status">My access</a> shows how far it has got. Please note that IPv6 cannot be whitelisted on all resources.</i>
+{{if .Again}}
+        <br>
+        <br>
+        <a href="/?new=true">Whitelist again</a>
+{{end}}
+        <br>
+        <br>
+        <form method="post" action="/revoke">
+          <button type="submit" class="btn btn-default">Remove my whitelisting</button>
+        </form>
       </div>
     </div>
   </body>
@@ -104,7 +116,7 @@ func (h handle) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		log.Printf("http.ServeHTTP(): %v", err)
 
 		if httpErr, ok := err.(Error); ok {
-			http.Error(w, httpErr.Message, httpErr.Code)
+			writeError(w, req, httpErr)
 		}
 	}
 }
@@ -116,41 +128,38 @@ func (e Error) Error() string {
 	return fmt.Sprintf("%d: %s", e.Code, e.Message)
 }
 
-func SessionState(session *sessions.Session) string {
-	return base64.StdEncoding.EncodeToString(sha256.New().Sum([]byte(session.ID)))
-}
-
 var (
-	// Authentication + Encryption key pairs
-	sessionStoreKeyPairs = [][]byte{
-		[]byte("s0m2th1ng-v3ry-v3ry-s3cr3tive-l0v3-413c"),
-		nil,
-	}
 	oauthConfig *oauth2.Config
 	store       sessions.Store
 	ctx         context.Context
 )
 
 type Authentication struct {
-	Type         string `yaml:"type"`
-	Header       string `yaml:"header"`
-	IPHeader     string `yaml:"ip_header"`
-	TenantId     string `yaml:"tenant_id"`
-	ClientId     string `yaml:"client_id"`
-	ClientSecret string `yaml:"client_secret"`
+	Type         string              `yaml:"type"`
+	Header       string              `yaml:"header"`
+	IPHeader     string              `yaml:"ip_header"`
+	TenantId     string              `yaml:"tenant_id"`
+	ClientId     string              `yaml:"client_id"`
+	ClientSecret string              `yaml:"client_secret"`
+	OIDC         OIDCConfiguration   `yaml:"oidc"`
+	GitHub       GitHubConfiguration `yaml:"github"`
+	Verify       VerifyConfiguration `yaml:"verify"`
 }
 
 func (*Authentication) init(a Authentication) {
-	// Create file system store with no size limit
-	fsStore := sessions.NewFilesystemStore("/tmp", sessionStoreKeyPairs...)
-	fsStore.MaxLength(0)
-	store = fsStore
+	store = newSessionStore(c.Session)
 
 	gob.Register(&oauth2.Token{})
 
+	registerAdminHandlers()
+
 	switch strings.ToLower(a.Type) {
 	case "azure":
 		a.initAzure()
+	case "oidc":
+		a.initOIDC()
+	case "github":
+		a.initGitHub()
 	case "none", "disabled":
 		a.initNoAuth()
 	default:
@@ -162,8 +171,8 @@ func (a *Authentication) initAzure() {
 	ctx = context.Background()
 
 	var redirectURL = c.Url + "/callback"
-	var authURL = fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/authorize?resource=https://graph.windows.net", c.Auth.TenantId)
-	var tokenURL = fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/token", c.Auth.TenantId)
+	var authURL = fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/authorize", c.Auth.TenantId)
+	var tokenURL = fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", c.Auth.TenantId)
 
 	oauthConfig = &oauth2.Config{
 		ClientID:     a.ClientId,
@@ -174,34 +183,72 @@ func (a *Authentication) initAzure() {
 			TokenURL: tokenURL,
 		},
 
-		Scopes: []string{"profile"},
+		// the id token may carry the user's groups, Graph is used for the
+		// rest of the user and for groups that don't fit in the token
+		Scopes: []string{"openid", "profile", "User.Read", "GroupMember.Read.All"},
 	}
 
 	http.Handle("/live", handle(livenessHandler))
 	http.Handle("/ready", handle(readinessHandler))
 	http.Handle("/callback", handle(callbackHandler))
+	registerCliHandlers()
 	http.Handle("/", handle(IndexHandler))
 	log.Fatal(http.ListenAndServe(":8090", nil))
 }
 
 func noAuthIndexHandler(w http.ResponseWriter, req *http.Request) error {
-	var u User
-	if u.newFromRequest(req) == nil {
-		return Error{Code: http.StatusBadRequest, Message: "could not determine client IP"}
+	if err := checkClientIP(req); err != nil {
+		return err
+	}
+	u, err := noAuthUser(req)
+	if err != nil {
+		return err
+	}
+	if !u.whitelist() {
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not whitelist " + u.ip}
 	}
-	u.whitelist()
 
 	var data = struct {
 		Name      string
 		IPAddress string
+		Again     bool
 	}{
 		Name:      u.name,
 		IPAddress: u.ip,
 	}
-	return noAuthTempl.Execute(w, &data)
+	return welcomeTempl.Execute(w, &data)
 }
 
-func (*Authentication) initNoAuth() {
+// noAuthUser builds the user an SSO proxy in front of the app vouches for, in
+// auth.type: none.
+func noAuthUser(req *http.Request) (*User, error) {
+	var u User
+	if headerVerifier != nil {
+		// identity and groups come from the proxy's signed token
+		claims, err := headerVerifier.verify(req)
+		if err != nil {
+			log.Print("http.noAuthUser(): ", err)
+			return nil, Error{Code: http.StatusUnauthorized, Message: "Your sign-in could not be verified"}
+		}
+		vc := c.Auth.Verify
+		if u.newFromClaims(claims, vc.UserClaim, vc.NameClaim, vc.GroupsClaim, req) == nil {
+			return nil, Error{Code: http.StatusForbidden, Message: "Your sign-in has no '" + vc.UserClaim + "' to whitelist you by"}
+		}
+	} else if u.newFromRequest(req) == nil {
+		return nil, Error{Code: http.StatusBadRequest, Message: "could not determine client IP"}
+	}
+	return &u, nil
+}
+
+func (a *Authentication) initNoAuth() {
+	if a.Verify.Type != "" {
+		v, err := newHeaderVerifier(a.Verify)
+		if err != nil {
+			log.Fatalln("http.initNoAuth(): ", err)
+		}
+		headerVerifier = v
+	}
+
 	http.Handle("/live", handle(livenessHandler))
 	http.Handle("/ready", handle(readinessHandler))
 	http.Handle("/", handle(noAuthIndexHandler))
@@ -214,34 +261,36 @@ func (a *Authentication) start() {
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
-/*
-*
-Method to handle OAuth callback, not library specific
-*/
+// callbackHandler completes an AzureAD sign-in and whitelists the user.
 func callbackHandler(w http.ResponseWriter, req *http.Request) error {
-	session, _ := store.Get(req, "session")
-	queryParts, _ := url.ParseQuery(req.URL.RawQuery)
-
-	// Use the authorization code that is pushed to the redirect
-	// URL.
-	code := queryParts["code"][0]
-
-	// Exchange will do the handshake to retrieve the initial access token.
-	token, err := oauthConfig.Exchange(ctx, code)
+	if err := checkClientIP(req); err != nil {
+		return err
+	}
+	token, nonce, err := completeLogin(w, req)
 	if err != nil {
-		log.Fatal("http.callbackHandler():", err)
+		return err
 	}
+
+	idToken, _ := token.Extra("id_token").(string)
+	claims, err := parseIdToken(idToken)
+	if err != nil || claims.Nonce != nonce {
+		return Error{Code: http.StatusUnauthorized, Message: "Sign-in failed: the id token doesn't match this sign-in"}
+	}
+
 	// The HTTP Client returned by conf.Client will refresh the token as necessary.
 	client := oauthConfig.Client(ctx, token)
 
 	var u User
-	u.new(client, req)
-	u.whitelist()
+	if u.new(client, idToken, req) == nil {
+		return Error{Code: http.StatusBadGateway, Message: "Sign-in failed: your account could not be looked up"}
+	}
+	if !u.whitelist() {
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not whitelist " + u.ip}
+	}
 
-	session.Values["token"] = &token
-	session.Values["name"] = &u.name
-	session.Values["ip_address"] = &u.ip
-	if err := sessions.Save(req, w); err != nil {
+	session, _ := store.Get(req, "session")
+	session.Values["token"] = token
+	if err := saveSignIn(w, req, &u); err != nil {
 		return fmt.Errorf("http.callbackHandler(): error saving session: %v", err)
 	}
 
@@ -256,15 +305,18 @@ func IndexHandler(w http.ResponseWriter, req *http.Request) error {
 	var ipAddress string
 
 	if req.FormValue("new") != "" {
-		session.Values["token"] = nil
-		session.Values["ip_address"] = nil
-		sessions.Save(req, w)
+		delete(session.Values, "token")
+		delete(session.Values, "ip_address")
 	} else {
-		if v, ok := session.Values["token"]; ok {
-			token = v.(*oauth2.Token)
-		}
-		if v, ok := session.Values["ip_address"]; ok {
-			ipAddress = v.(string)
+		token, _ = session.Values["token"].(*oauth2.Token)
+		ipAddress, _ = session.Values["ip_address"].(string)
+	}
+
+	var authURL string
+	if token == nil {
+		var err error
+		if authURL, err = beginLogin(w, req, session); err != nil {
+			return fmt.Errorf("http.IndexHandler(): error saving session: %v", err)
 		}
 	}
 
@@ -274,7 +326,7 @@ func IndexHandler(w http.ResponseWriter, req *http.Request) error {
 		IPAddress string
 	}{
 		Token:     token,
-		AuthURL:   oauthConfig.AuthCodeURL(SessionState(session), oauth2.AccessTypeOnline),
+		AuthURL:   authURL,
 		IPAddress: ipAddress,
 	}
 
@@ -295,7 +347,7 @@ func livenessHandler(w http.ResponseWriter, req *http.Request) error {
 
 func readinessHandler(w http.ResponseWriter, req *http.Request) error {
 	var err error
-	if httpReady {
+	if httpReady && !redisDown.Load() {
 		w.WriteHeader(200)
 		_, err = w.Write([]byte("ok"))
 	} else {
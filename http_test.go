@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"net/http"
 	"net/http/httptest"
@@ -117,23 +118,9 @@ func TestServeHTTP(t *testing.T) {
 	panicHandler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil)) // must not panic
 }
 
-func TestSessionState(t *testing.T) {
-	s := sessions.NewSession(sessions.NewCookieStore(), "session")
-	s.ID = "abc123"
-
-	got := SessionState(s)
-	if got == "" {
-		t.Fatal("SessionState() returned an empty string")
-	}
-	// deterministic for a given session ID
-	if again := SessionState(s); again != got {
-		t.Errorf("SessionState() not deterministic: %q vs %q", got, again)
-	}
-}
-
 func TestIndexHandler(t *testing.T) {
 	// Minimal wiring normally done by Authentication.init / initAzure.
-	store = sessions.NewFilesystemStore(t.TempDir(), sessionStoreKeyPairs...)
+	store = sessions.NewFilesystemStore(t.TempDir(), sessionKeyPairs([]string{"test-session-key"})...)
 	oauthConfig = &oauth2.Config{
 		ClientID:    "test-client",
 		RedirectURL: "http://localhost/callback",
@@ -171,7 +158,7 @@ func TestIndexHandler(t *testing.T) {
 func TestIndexHandlerWithToken(t *testing.T) {
 	// Minimal wiring normally done by Authentication.init / initAzure.
 	gob.Register(&oauth2.Token{})
-	store = sessions.NewFilesystemStore(t.TempDir(), sessionStoreKeyPairs...)
+	store = sessions.NewFilesystemStore(t.TempDir(), sessionKeyPairs([]string{"test-session-key"})...)
 	oauthConfig = &oauth2.Config{
 		ClientID:    "test-client",
 		RedirectURL: "http://localhost/callback",
@@ -235,6 +222,7 @@ func TestNoAuthIndexHandler(t *testing.T) {
 	defer func() { c.Auth.IPHeader = "" }()
 
 	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:5555" // behind a trusted proxy
 	req.Header.Set("Cf-Access-Authenticated-User-Email", "alice@example.com")
 	req.Header.Set("Cf-Connecting-Ip", "203.0.113.7")
 	rr := httptest.NewRecorder()
@@ -257,7 +245,8 @@ func TestNoAuthIndexHandler(t *testing.T) {
 		t.Errorf("body unexpectedly rendered the OAuth redirect branch:\n%s", body)
 	}
 
-	if got := r.getWhitelist()["aliceexamplecom"]; got != "203.0.113.7/32" {
+	if list, _ := r.getWhitelist(context.Background()); list["aliceexamplecom"] != "203.0.113.7/32" {
+		got := list["aliceexamplecom"]
 		t.Errorf("redis whitelist entry = %q, want %q", got, "203.0.113.7/32")
 	}
 }
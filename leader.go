@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Leader elects one replica, through a lease in redis, to sync resources.
+// The leader runs the scheduled and triggered syncs, drift checks and retries;
+// every other replica forwards its sync requests to the leader and takes over
+// once the leader's lease expires.
+type Leader struct {
+	mu      sync.Mutex
+	id      string
+	started bool // campaigning; until then this replica acts alone
+	held    bool // this replica holds the lease
+}
+
+// syncRequest is a sync forwarded from a follower to the leader.
+type syncRequest struct {
+	ID        string   `json:"id"`
+	Resources []string `json:"resources,omitempty"` // empty for every resource
+}
+
+// syncReply is the leader's report for a forwarded sync.
+type syncReply struct {
+	Results []syncReplyResult `json:"results"`
+}
+
+type syncReplyResult struct {
+	Resource string        `json:"resource"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// leaseDuration is how long the leader lease lasts without being renewed.
+func leaseDuration() time.Duration {
+	return time.Duration(applySyncDefaults(c.Sync).Lease) * time.Second
+}
+
+// instanceId names this replica, hostname first so the lease holder can be
+// told apart in redis.
+func instanceId() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "ip-whitelister"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// leading reports whether this replica should sync resources: it holds the
+// lease, or isn't campaigning at all.
+func (l *Leader) leading() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.started || l.held
+}
+
+// campaign tries for the lease now, so the startup sync knows whether to run
+// or forward, then keeps renewing or retrying it every third of the lease and
+// serves forwarded syncs while leading.
+func (l *Leader) campaign() {
+	l.mu.Lock()
+	l.id = instanceId()
+	l.started = true
+	l.mu.Unlock()
+	m.set("ip_whitelister_leader", nil, 0)
+
+	lease := leaseDuration()
+	l.elect(lease)
+	go func() {
+		for range time.Tick(lease / 3) {
+			l.elect(lease)
+		}
+	}()
+	go l.serve()
+}
+
+// elect renews the lease when held, or takes it when free.
+func (l *Leader) elect(lease time.Duration) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	l.mu.Lock()
+	id, held := l.id, l.held
+	l.mu.Unlock()
+
+	if held {
+		renewed, err := r.renewLease(ctx, id, lease)
+		if renewed {
+			return
+		}
+		// without a renewal another replica may take over once the lease
+		// runs out, so stop syncing now rather than risk two leaders
+		if err != nil {
+			log.Print("leader.elect(): could not renew the leader lease, stepping down: ", err)
+		} else {
+			log.Print("leader.elect(): leader lease lost, stepping down")
+		}
+		l.mu.Lock()
+		l.held = false
+		l.mu.Unlock()
+		m.set("ip_whitelister_leader", nil, 0)
+		return
+	}
+
+	acquired, err := r.acquireLease(ctx, id, lease)
+	if err != nil {
+		log.Print("leader.elect(): ", err)
+		return
+	}
+	if !acquired {
+		return
+	}
+	log.Println("leader.elect(): '" + id + "' is now the leader")
+	l.mu.Lock()
+	l.held = true
+	l.mu.Unlock()
+	m.set("ip_whitelister_leader", nil, 1)
+
+	// pick up the previous leader's pending retries, and sync everything in
+	// case it went away mid-sync
+	q.load()
+	s.trigger()
+}
+
+// serve runs the syncs forwarded by followers while leading. Each request is
+// handed to the coordinator, so forwarded syncs coalesce with local ones.
+func (l *Leader) serve() {
+	for {
+		if !l.leading() {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		ctx, cancel := redisContext()
+		b, err := r.popSyncRequest(ctx, 5*time.Second)
+		cancel()
+		if err != nil {
+			log.Print("leader.serve(): ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if b == nil {
+			continue
+		}
+
+		var req syncRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			log.Print("leader.serve(): dropping unreadable sync request: ", err)
+			continue
+		}
+		go func() {
+			reply, err := json.Marshal(newSyncReply(s.trigger(req.Resources...).wait()))
+			if err != nil {
+				log.Print("leader.serve(): ", err)
+				return
+			}
+			ctx, cancel := redisContext()
+			defer cancel()
+			if err := r.pushSyncReply(ctx, req.ID, reply); err != nil {
+				log.Print("leader.serve(): could not reply to sync request '"+req.ID+"': ", err)
+			}
+		}()
+	}
+}
+
+// runSync is the coordinator's sync: run here when leading, or forwarded to
+// the leader otherwise.
+func (l *Leader) runSync(ids ...string) SyncReport {
+	if l.leading() {
+		return w.updateResources(ids...)
+	}
+	return l.forward(ids...)
+}
+
+// forward asks the leader to sync the given resources and waits for its
+// report. Should this replica be elected while waiting it syncs them itself;
+// if no report arrives in time every resource is reported as failed, the
+// leader's own retries still apply.
+func (l *Leader) forward(ids ...string) SyncReport {
+	resources := p.enabled()
+	if len(ids) != 0 {
+		resources = filterResources(resources, ids)
+	}
+	req := syncRequest{ID: instanceId(), Resources: ids}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return failedReport(resources, err)
+	}
+
+	ctx, cancel := redisContext()
+	err = r.pushSyncRequest(ctx, b)
+	cancel()
+	if err != nil {
+		log.Print("leader.forward(): could not forward sync request: ", err)
+		m.add("ip_whitelister_sync_forwarded_total", map[string]string{"result": "error"}, 1)
+		return failedReport(resources, err)
+	}
+
+	// the leader may be collecting triggers for a window, and then wait
+	// for a sync in progress before running this one
+	lease := leaseDuration()
+	deadline := time.Now().Add(syncWindow() + 2*syncTimeout() + lease)
+	for time.Now().Before(deadline) {
+		if l.leading() {
+			log.Print("leader.forward(): elected while waiting for the leader, syncing here")
+			return w.updateResources(ids...)
+		}
+
+		ctx, cancel := redisContext()
+		b, err := r.popSyncReply(ctx, req.ID, time.Second)
+		cancel()
+		if err != nil {
+			log.Print("leader.forward(): ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if b == nil {
+			continue
+		}
+
+		var reply syncReply
+		if err := json.Unmarshal(b, &reply); err != nil {
+			m.add("ip_whitelister_sync_forwarded_total", map[string]string{"result": "error"}, 1)
+			return failedReport(resources, err)
+		}
+		m.add("ip_whitelister_sync_forwarded_total", map[string]string{"result": "ok"}, 1)
+		return reply.report()
+	}
+
+	log.Print("leader.forward(): no reply from the leader to sync request '" + req.ID + "'")
+	m.add("ip_whitelister_sync_forwarded_total", map[string]string{"result": "timeout"}, 1)
+	return failedReport(resources, errors.New("no reply from the leader"))
+}
+
+func newSyncReply(report SyncReport) syncReply {
+	reply := syncReply{Results: make([]syncReplyResult, len(report.Results))}
+	for i, res := range report.Results {
+		reply.Results[i] = syncReplyResult{Resource: res.Resource, Duration: res.Duration}
+		if res.Err != nil {
+			reply.Results[i].Error = res.Err.Error()
+		}
+	}
+	return reply
+}
+
+func (sr syncReply) report() SyncReport {
+	report := SyncReport{Results: make([]SyncResult, len(sr.Results))}
+	for i, res := range sr.Results {
+		report.Results[i] = SyncResult{Resource: res.Resource, Duration: res.Duration}
+		if res.Error != "" {
+			report.Results[i].Err = errors.New(res.Error)
+		}
+	}
+	return report
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSyncReply(t *testing.T) {
+	report := SyncReport{Results: []SyncResult{
+		{Resource: "azure/keyvault/rg/kv", Duration: time.Second},
+		{Resource: "unifi/default/office", Err: errors.New("unifi: status 503"), Duration: 2 * time.Second},
+	}}
+
+	got := newSyncReply(report).report()
+	if len(got.Results) != len(report.Results) {
+		t.Fatalf("syncReply.report(): got %d results, want %d", len(got.Results), len(report.Results))
+	}
+	for i, want := range report.Results {
+		res := got.Results[i]
+		if res.Resource != want.Resource || res.Duration != want.Duration {
+			t.Errorf("syncReply.report(): result %d, got '%v', want '%v'", i, res, want)
+		}
+		if (res.Err == nil) != (want.Err == nil) || (res.Err != nil && res.Err.Error() != want.Err.Error()) {
+			t.Errorf("syncReply.report(): result %d error, got '%v', want '%v'", i, res.Err, want.Err)
+		}
+	}
+}
+
+func TestLeaderLeading(t *testing.T) {
+	var fl Leader
+	if !fl.leading() {
+		t.Errorf("leader.leading(): before campaigning, got false, want true")
+	}
+	fl.started = true
+	if fl.leading() {
+		t.Errorf("leader.leading(): campaigning without the lease, got true, want false")
+	}
+	fl.held = true
+	if !fl.leading() {
+		t.Errorf("leader.leading(): holding the lease, got false, want true")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+var errorTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Dynamic IP Whitelist</title>
+
+    <link href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.7/css/bootstrap.min.css" rel="stylesheet" integrity="sha384-BVYiiSIFeK1dGmJRAkycuHAHRg32OmUcww7on3RYdg4Va+PmSTsz/K68vbdEjh4u" crossorigin="anonymous">
+  </head>
+  <body class="container-fluid">
+    <div class="row">
+      <div class="col-xs-4 col-xs-offset-4">
+        <h1>Dynamic IP Whitelist</h1>
+        <div class="alert alert-danger">{{.Message}}</div>
+        <a href="/?new=true">Try again</a>
+      </div>
+    </div>
+  </body>
+</html>
+`))
+
+// randomString returns n random bytes, base64url encoded.
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// beginLogin starts a sign-in: a fresh state, PKCE verifier and nonce are kept
+// in the session, and the returned URL sends the user to the identity
+// provider with them.
+func beginLogin(w http.ResponseWriter, req *http.Request, session *sessions.Session) (string, error) {
+	state, verifier, nonce := randomString(32), randomString(32), randomString(32)
+	session.Values["oauth_state"] = state
+	session.Values["oauth_verifier"] = verifier
+	session.Values["oauth_nonce"] = nonce
+	if err := session.Save(req, w); err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	return oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOnline,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oauth2.SetAuthURLParam("nonce", nonce),
+	), nil
+}
+
+// completeLogin checks a callback from the identity provider against the
+// sign-in begun in this session, and exchanges its code for a token. It
+// returns the nonce the ID token must carry. A sign-in can only be completed
+// once.
+func completeLogin(w http.ResponseWriter, req *http.Request) (*oauth2.Token, string, error) {
+	session, _ := store.Get(req, "session")
+	state, _ := session.Values["oauth_state"].(string)
+	verifier, _ := session.Values["oauth_verifier"].(string)
+	nonce, _ := session.Values["oauth_nonce"].(string)
+	delete(session.Values, "oauth_state")
+	delete(session.Values, "oauth_verifier")
+	delete(session.Values, "oauth_nonce")
+	if err := session.Save(req, w); err != nil {
+		return nil, "", err
+	}
+
+	if e := req.FormValue("error"); e != "" {
+		msg := "Sign-in failed: " + e
+		if desc := req.FormValue("error_description"); desc != "" {
+			msg += " (" + desc + ")"
+		}
+		return nil, "", Error{Code: http.StatusUnauthorized, Message: msg}
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(req.FormValue("state"))) != 1 {
+		return nil, "", Error{Code: http.StatusBadRequest, Message: "Sign-in expired or was started in another browser, please try again"}
+	}
+	code := req.FormValue("code")
+	if code == "" {
+		return nil, "", Error{Code: http.StatusBadRequest, Message: "Sign-in failed: no authorization code was returned"}
+	}
+
+	token, err := oauthConfig.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		log.Print("http.completeLogin(): code exchange failed: ", err)
+		return nil, "", Error{Code: http.StatusBadGateway, Message: "Sign-in failed: the sign-in could not be completed"}
+	}
+	return token, nonce, nil
+}
+
+// writeError shows an error to the user: a page for browsers, plain text
+// otherwise.
+func writeError(w http.ResponseWriter, req *http.Request, e Error) {
+	if e.Message == "" {
+		e.Message = http.StatusText(e.Code)
+	}
+	if !acceptsHTML(req) {
+		http.Error(w, e.Message, e.Code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.Code)
+	errorTempl.Execute(w, e)
+}
+
+func acceptsHTML(req *http.Request) bool {
+	return strings.Contains(strings.ToLower(req.Header.Get("Accept")), "text/html")
+}
+
+// saveSignIn keeps who signed in in their session: the name and ip the
+// welcome page shows, and the key and groups the api whitelists them with.
+func saveSignIn(w http.ResponseWriter, req *http.Request, u *User) error {
+	session, _ := store.Get(req, "session")
+	session.Values["name"] = u.name
+	session.Values["ip_address"] = u.ip
+	session.Values["key"] = u.key
+	session.Values["groups"] = u.groups
+	return sessions.Save(req, w)
+}
+
+// signInIndexHandler shows who was whitelisted, or sends the user to the
+// identity provider to sign in. It serves the auth types whose callback
+// leaves the user's name and ip in the session, e.g. oidc and github.
+func signInIndexHandler(w http.ResponseWriter, req *http.Request) error {
+	session, _ := store.Get(req, "session")
+
+	name, _ := session.Values["name"].(string)
+	ipAddress, _ := session.Values["ip_address"].(string)
+	if req.FormValue("new") != "" || ipAddress == "" {
+		delete(session.Values, "name")
+		delete(session.Values, "ip_address")
+		authURL, err := beginLogin(w, req, session)
+		if err != nil {
+			return fmt.Errorf("login.signInIndexHandler(): error saving session: %v", err)
+		}
+		http.Redirect(w, req, authURL, http.StatusFound)
+		return nil
+	}
+
+	var data = struct {
+		Name      string
+		IPAddress string
+		Again     bool
+	}{
+		Name:      name,
+		IPAddress: ipAddress,
+		Again:     true,
+	}
+	return welcomeTempl.Execute(w, &data)
+}
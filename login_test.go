@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+// startLogin begins a sign-in the way the index page does, returning the
+// session cookies and the parameters sent to the identity provider.
+func startLogin(t *testing.T) ([]*http.Cookie, url.Values) {
+	req := httptest.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	session, _ := store.Get(req, "session")
+	authURL, err := beginLogin(rr, req, session)
+	if err != nil {
+		t.Fatalf("beginLogin(): %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("beginLogin(): %v", err)
+	}
+	return rr.Result().Cookies(), u.Query()
+}
+
+func TestBeginLogin(t *testing.T) {
+	store = sessions.NewCookieStore([]byte("test-session-key"))
+	oauthConfig = &oauth2.Config{ClientID: "test-client", Endpoint: oauth2.Endpoint{AuthURL: "https://login.example.com/authorize"}}
+
+	_, first := startLogin(t)
+	_, second := startLogin(t)
+	for _, param := range []string{"state", "nonce", "code_challenge"} {
+		if first.Get(param) == "" {
+			t.Errorf("beginLogin(): auth url has no %s", param)
+		}
+		if first.Get(param) == second.Get(param) {
+			t.Errorf("beginLogin(): %s repeated across sign-ins", param)
+		}
+	}
+	if first.Get("code_challenge_method") != "S256" {
+		t.Errorf("beginLogin(): code_challenge_method = %q, want S256", first.Get("code_challenge_method"))
+	}
+}
+
+func TestCompleteLogin(t *testing.T) {
+	// token endpoint checking the PKCE verifier against the challenge sent
+	// with the sign-in
+	var challenge string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sum := sha256.Sum256([]byte(req.FormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge || req.FormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer"})
+	}))
+	defer tokenServer.Close()
+
+	store = sessions.NewCookieStore([]byte("test-session-key"))
+	oauthConfig = &oauth2.Config{
+		ClientID: "test-client",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://login.example.com/authorize", TokenURL: tokenServer.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+	ctx = context.Background()
+
+	tests := []struct {
+		name     string
+		query    func(sent url.Values) string
+		noCookie bool
+		wantCode int // 0 for success
+	}{
+		{"valid callback", func(sent url.Values) string { return "state=" + sent.Get("state") + "&code=good-code" }, false, 0},
+		{"idp error", func(sent url.Values) string {
+			return "state=" + sent.Get("state") + "&error=access_denied&error_description=user+cancelled"
+		}, false, http.StatusUnauthorized},
+		{"wrong state", func(sent url.Values) string { return "state=forged&code=good-code" }, false, http.StatusBadRequest},
+		{"no sign-in in this session", func(sent url.Values) string { return "state=" + sent.Get("state") + "&code=good-code" }, true, http.StatusBadRequest},
+		{"missing code", func(sent url.Values) string { return "state=" + sent.Get("state") }, false, http.StatusBadRequest},
+		{"exchange rejected", func(sent url.Values) string { return "state=" + sent.Get("state") + "&code=bad-code" }, false, http.StatusBadGateway},
+	}
+
+	for _, f := range tests {
+		t.Run(f.name, func(t *testing.T) {
+			cookies, sent := startLogin(t)
+			challenge = sent.Get("code_challenge")
+
+			req := httptest.NewRequest("GET", "/callback?"+f.query(sent), nil)
+			if !f.noCookie {
+				for _, cookie := range cookies {
+					req.AddCookie(cookie)
+				}
+			}
+			token, nonce, err := completeLogin(httptest.NewRecorder(), req)
+			if f.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("completeLogin(): %v", err)
+				}
+				if token.AccessToken != "access" || nonce != sent.Get("nonce") {
+					t.Errorf("completeLogin(): got token %q nonce %q, want 'access' %q", token.AccessToken, nonce, sent.Get("nonce"))
+				}
+				return
+			}
+			if e, ok := err.(Error); !ok || e.Code != f.wantCode {
+				t.Errorf("completeLogin(): got error %v, want code %d", err, f.wantCode)
+			}
+		})
+	}
+
+	// a completed sign-in's state can't be replayed
+	cookies, sent := startLogin(t)
+	challenge = sent.Get("code_challenge")
+	req := httptest.NewRequest("GET", "/callback?state="+sent.Get("state")+"&code=good-code", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	if _, _, err := completeLogin(rr, req); err != nil {
+		t.Fatalf("completeLogin(): %v", err)
+	}
+	replay := httptest.NewRequest("GET", "/callback?state="+sent.Get("state")+"&code=good-code", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		replay.AddCookie(cookie)
+	}
+	if _, _, err := completeLogin(httptest.NewRecorder(), replay); err == nil {
+		t.Errorf("completeLogin(): replayed callback succeeded, want an error")
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	e := Error{Code: http.StatusUnauthorized, Message: "Sign-in failed: access_denied"}
+
+	req := httptest.NewRequest("GET", "/callback", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rr := httptest.NewRecorder()
+	writeError(rr, req, e)
+	if rr.Code != e.Code || !strings.Contains(rr.Body.String(), "Try again") || !strings.Contains(rr.Body.String(), e.Message) {
+		t.Errorf("writeError(): browser got %d %q, want the error page", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	writeError(rr, httptest.NewRequest("GET", "/callback", nil), e)
+	if rr.Code != e.Code || strings.TrimSpace(rr.Body.String()) != e.Message {
+		t.Errorf("writeError(): got %d %q, want plain %q", rr.Code, rr.Body.String(), e.Message)
+	}
+}
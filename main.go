@@ -1,14 +1,36 @@
 package main
 
+import (
+	"flag"
+	"os"
+)
+
 var (
 	c Configuration
 	r RedisConfiguration
 	h Authentication
 	w Whitelist
-	a Azure
-	u Unifi
+	p Providers
+	m Metrics
+	q Retries
+	s SyncCoordinator
+	l Leader
 )
 
 func main() {
+	// login, renew and revoke make this a command-line client of a server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "login", "renew", "revoke":
+			os.Exit(runClient(os.Args[1], os.Args[2:], os.Stdout))
+		}
+	}
+
+	planOnly := flag.Bool("plan", false, "print the changes a sync would make to each resource, without applying them, and exit")
+	flag.Parse()
+
+	if *planOnly {
+		os.Exit(w.plan(os.Stdout))
+	}
 	w.init()
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// metricDefs describes every metric exposed at /metrics.
+var metricDefs = map[string]struct{ typ, help string }{
+	"ip_whitelister_drift_checks_total":      {"counter", "Drift checks run."},
+	"ip_whitelister_drift_entries":           {"gauge", "Entries a resource was missing or held unexpectedly at the last drift check."},
+	"ip_whitelister_drift_read_errors":       {"gauge", "Resources whose rules could not be read at the last drift check."},
+	"ip_whitelister_drift_corrections_total": {"counter", "Drifted resources put back to their desired rules, by result."},
+	"ip_whitelister_retries_pending":         {"gauge", "Resource updates waiting to be retried."},
+	"ip_whitelister_retries_total":           {"counter", "Failed resource updates scheduled for retry, by error class."},
+	"ip_whitelister_retries_exhausted_total": {"counter", "Resource updates given up on after every retry failed."},
+	"ip_whitelister_leader":                  {"gauge", "1 while this replica holds the leader lease and syncs resources, 0 while it forwards syncs to the leader."},
+	"ip_whitelister_sync_forwarded_total":    {"counter", "Sync requests forwarded to the leader, by result."},
+}
+
+// Metrics is a minimal in-memory registry, exposed in the Prometheus text
+// format.
+type Metrics struct {
+	mu     sync.Mutex
+	series map[string]map[string]float64 // name -> rendered labels -> value
+}
+
+func (m *Metrics) get(name string) map[string]float64 {
+	if m.series == nil {
+		m.series = make(map[string]map[string]float64)
+	}
+	if m.series[name] == nil {
+		m.series[name] = make(map[string]float64)
+	}
+	return m.series[name]
+}
+
+// set sets a gauge.
+func (m *Metrics) set(name string, labels map[string]string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(name)[renderLabels(labels)] = v
+}
+
+// add increments a counter.
+func (m *Metrics) add(name string, labels map[string]string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(name)[renderLabels(labels)] += v
+}
+
+// reset drops every series of a gauge, so resources that are no longer
+// reported disappear.
+func (m *Metrics) reset(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.series, name)
+}
+
+// write prints every metric in the Prometheus text format.
+func (m *Metrics) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, name := range sortedKeys(m.series) {
+		if def, ok := metricDefs[name]; ok {
+			fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, def.help, name, def.typ)
+		}
+		for _, labels := range sortedKeys(m.series[name]) {
+			fmt.Fprintf(out, "%s%s %v\n", name, labels, m.series[name][labels])
+		}
+	}
+}
+
+// renderLabels formats labels as {k="v",...}, sorted by key.
+func renderLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, k := range sortedKeys(labels) {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		parts = append(parts, k+`="`+v+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func metricsHandler(w http.ResponseWriter, req *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	var mt Metrics
+	mt.add("ip_whitelister_drift_checks_total", nil, 1)
+	mt.add("ip_whitelister_drift_checks_total", nil, 1)
+	mt.set("ip_whitelister_drift_entries", map[string]string{"resource": `a"b`, "kind": "missing"}, 3)
+	mt.set("ip_whitelister_drift_read_errors", map[string]string{"resource": "x"}, 1)
+	mt.reset("ip_whitelister_drift_read_errors")
+
+	var out bytes.Buffer
+	mt.write(&out)
+
+	want := `# HELP ip_whitelister_drift_checks_total Drift checks run.
+# TYPE ip_whitelister_drift_checks_total counter
+ip_whitelister_drift_checks_total 2
+# HELP ip_whitelister_drift_entries Entries a resource was missing or held unexpectedly at the last drift check.
+# TYPE ip_whitelister_drift_entries gauge
+ip_whitelister_drift_entries{kind="missing",resource="a\"b"} 3
+`
+	if out.String() != want {
+		t.Errorf("write() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
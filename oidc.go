@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfiguration is a generic OpenID Connect issuer, e.g. Keycloak or Okta,
+// for auth.type: oidc.
+type OIDCConfiguration struct {
+	IssuerURL    string   `yaml:"issuer_url"`
+	ClientId     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`       // default openid, profile and email
+	UserClaim    string   `yaml:"user_claim"`   // claim the whitelist key is derived from, default 'email'
+	NameClaim    string   `yaml:"name_claim"`   // claim shown as the user's name, default 'name'
+	GroupsClaim  string   `yaml:"groups_claim"` // claim matched against resource groups, default 'groups'
+}
+
+var oidcVerifier *oidc.IDTokenVerifier
+
+// applyOIDCDefaults fills in the scopes and claims most issuers use.
+func applyOIDCDefaults(o OIDCConfiguration) OIDCConfiguration {
+	if len(o.Scopes) == 0 {
+		o.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	if o.UserClaim == "" {
+		o.UserClaim = "email"
+	}
+	if o.NameClaim == "" {
+		o.NameClaim = "name"
+	}
+	if o.GroupsClaim == "" {
+		o.GroupsClaim = "groups"
+	}
+	return o
+}
+
+func (a *Authentication) initOIDC() {
+	ctx = context.Background()
+
+	if err := discoverOIDC(ctx, a.OIDC); err != nil {
+		log.Fatalln("http.initOIDC(): ", err)
+	}
+
+	http.Handle("/live", handle(livenessHandler))
+	http.Handle("/ready", handle(readinessHandler))
+	http.Handle("/callback", handle(oidcCallbackHandler))
+	http.Handle("/", handle(signInIndexHandler))
+	log.Fatal(http.ListenAndServe(":8090", nil))
+}
+
+// discoverOIDC reads the issuer's discovery document and sets up the OAuth
+// client and ID token verifier from it.
+func discoverOIDC(ctx context.Context, o OIDCConfiguration) error {
+	provider, err := oidc.NewProvider(ctx, o.IssuerURL)
+	if err != nil {
+		return fmt.Errorf("discovery for issuer '%s' failed: %v", o.IssuerURL, err)
+	}
+
+	oauthConfig = &oauth2.Config{
+		ClientID:     o.ClientId,
+		ClientSecret: o.ClientSecret,
+		RedirectURL:  c.Url + "/callback",
+		Endpoint:     provider.Endpoint(),
+		Scopes:       o.Scopes,
+	}
+	oidcVerifier = provider.Verifier(&oidc.Config{ClientID: o.ClientId})
+	return nil
+}
+
+// oidcCallbackHandler exchanges the authorization code, verifies the ID token
+// that comes with it and whitelists the user it names.
+func oidcCallbackHandler(w http.ResponseWriter, req *http.Request) error {
+	if err := checkClientIP(req); err != nil {
+		return err
+	}
+	token, nonce, err := completeLogin(w, req)
+	if err != nil {
+		return err
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Error{Code: http.StatusBadGateway, Message: "Sign-in failed: the issuer returned no id token"}
+	}
+	idToken, err := oidcVerifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		log.Print("http.oidcCallbackHandler(): ", err)
+		return Error{Code: http.StatusUnauthorized, Message: "Sign-in failed: invalid id token"}
+	}
+	if idToken.Nonce != nonce {
+		return Error{Code: http.StatusUnauthorized, Message: "Sign-in failed: the id token doesn't match this sign-in"}
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		log.Print("http.oidcCallbackHandler(): ", err)
+		return Error{Code: http.StatusUnauthorized, Message: "Sign-in failed: invalid id token"}
+	}
+
+	o := c.Auth.OIDC
+	var u User
+	if u.newFromClaims(claims, o.UserClaim, o.NameClaim, o.GroupsClaim, req) == nil {
+		return Error{Code: http.StatusForbidden, Message: "Sign-in failed: your account has no '" + c.Auth.OIDC.UserClaim + "' to whitelist you by"}
+	}
+	if !u.whitelist() {
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not whitelist " + u.ip}
+	}
+
+	if err := saveSignIn(w, req, &u); err != nil {
+		return fmt.Errorf("http.oidcCallbackHandler(): error saving session: %v", err)
+	}
+
+	http.Redirect(w, req, "/", http.StatusFound)
+	return nil
+}
+
+// newFromClaims builds a User from verified token claims: the key from
+// userClaim, the name from nameClaim and the groups from groupsClaim. Claim
+// names may be dotted paths into nested claims, e.g. realm_access.roles.
+func (u *User) newFromClaims(claims map[string]interface{}, userClaim, nameClaim, groupsClaim string, req *http.Request) *User {
+	identity := claimString(claims, userClaim)
+	if identity == "" {
+		log.Print("user.newFromClaims(): token has no '" + userClaim + "' claim")
+		return nil
+	}
+	u.name = claimString(claims, nameClaim)
+	if u.name == "" {
+		u.name = identity
+	}
+	u.groups = claimStrings(claims, groupsClaim)
+
+	if c.Debug {
+		log.Printf("user.newFromClaims(): %v groups: %v", u.name, u.groups)
+	}
+
+	if err := u.finishUser(identity, req); err != nil {
+		log.Printf("user.newFromClaims(): %v", err)
+		return nil
+	}
+
+	log.Println("user.newFromClaims(): authentication successful - " + u.name + " (" + identity + ") - " + u.ip)
+	return u
+}
+
+// claim returns the claim at a dotted path, or nil.
+func claim(claims map[string]interface{}, path string) interface{} {
+	var v interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+// claimString returns a string claim, or "".
+func claimString(claims map[string]interface{}, path string) string {
+	s, _ := claim(claims, path).(string)
+	return s
+}
+
+// claimStrings returns a list claim, also accepting a single string.
+func claimStrings(claims map[string]interface{}, path string) []string {
+	switch v := claim(claims, path).(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
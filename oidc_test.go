@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// testIssuer is a stand-in OpenID Connect issuer: it serves discovery and its
+// signing keys, and answers every code exchange with an ID token holding
+// claims, signed with key or, when set, signWith.
+type testIssuer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	signWith *rsa.PrivateKey
+	claims   map[string]interface{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := &testIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                ti.URL,
+			"authorization_endpoint":                ti.URL + "/authorize",
+			"token_endpoint":                        ti.URL + "/token",
+			"jwks_uri":                              ti.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &ti.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     ti.sign(t, ti.claims),
+		})
+	})
+	ti.Server = httptest.NewServer(mux)
+	return ti
+}
+
+func (ti *testIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	key := ti.key
+	if ti.signWith != nil {
+		key = ti.signWith
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestOIDCCallback(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	c.Url = "http://localhost:8080"
+	c.Auth.OIDC = applyOIDCDefaults(OIDCConfiguration{IssuerURL: ti.URL, ClientId: "whitelister"})
+	defer func() { c.Auth.OIDC = OIDCConfiguration{} }()
+	// no redis here, the static whitelist has the ip whitelisted
+	c.IPWhiteList = []string{"1.2.3.4/32"}
+	defer func() { c.IPWhiteList = nil }()
+	store = sessions.NewCookieStore([]byte("test-session-key"))
+	ctx = context.Background()
+	if err := discoverOIDC(ctx, c.Auth.OIDC); err != nil {
+		t.Fatalf("discoverOIDC(): %v", err)
+	}
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   ti.URL,
+			"aud":   "whitelister",
+			"sub":   "1234",
+			"email": "alice@example.com",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+		}
+	}
+	withNonce := func(claims func() map[string]interface{}, nonce string) func() map[string]interface{} {
+		return func() map[string]interface{} { cl := claims(); cl["nonce"] = nonce; return cl }
+	}
+
+	tests := []struct {
+		name     string
+		claims   func() map[string]interface{}
+		key      *rsa.PrivateKey // signs the id token instead of the issuer's key
+		nonce    string          // replaces the sign-in's nonce in the id token
+		wantCode int
+	}{
+		{"valid id token", valid, nil, "", http.StatusFound},
+		{"wrong audience", func() map[string]interface{} { cl := valid(); cl["aud"] = "another-app"; return cl }, nil, "", http.StatusUnauthorized},
+		{"expired", func() map[string]interface{} { cl := valid(); cl["exp"] = time.Now().Add(-time.Hour).Unix(); return cl }, nil, "", http.StatusUnauthorized},
+		{"signed by another key", valid, other, "", http.StatusUnauthorized},
+		{"nonce from another sign-in", valid, nil, "replayed", http.StatusUnauthorized},
+		{"no user claim", func() map[string]interface{} { cl := valid(); delete(cl, "email"); return cl }, nil, "", http.StatusForbidden},
+	}
+
+	for _, f := range tests {
+		t.Run(f.name, func(t *testing.T) {
+			cookies, sent := startLogin(t)
+			nonce := sent.Get("nonce")
+			if f.nonce != "" {
+				nonce = f.nonce
+			}
+			ti.claims, ti.signWith = withNonce(f.claims, nonce)(), f.key
+
+			req := httptest.NewRequest("GET", "/callback?code=abc&state="+sent.Get("state"), nil)
+			req.Header.Set("X-Azure-Clientip", "1.2.3.4")
+			req.RemoteAddr = "10.0.0.1:5555"
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+			rr := httptest.NewRecorder()
+			handle(oidcCallbackHandler).ServeHTTP(rr, req)
+			if rr.Code != f.wantCode {
+				t.Errorf("oidcCallbackHandler(): code = %d, want %d (%s)", rr.Code, f.wantCode, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestUserNewFromClaims(t *testing.T) {
+	c.Debug = false
+
+	tests := []struct {
+		name       string
+		oidc       OIDCConfiguration
+		claims     string
+		wantNil    bool
+		wantName   string
+		wantKey    string
+		wantGroups []string
+	}{
+		{
+			name:       "default claims",
+			claims:     `{"email":"alice@example.com","name":"Alice","groups":["/contractors","/ops"]}`,
+			wantName:   "Alice",
+			wantKey:    "aliceexamplecom",
+			wantGroups: []string{"/contractors", "/ops"},
+		},
+		{
+			name:       "nested groups claim",
+			oidc:       OIDCConfiguration{UserClaim: "preferred_username", GroupsClaim: "realm_access.roles"},
+			claims:     `{"preferred_username":"bob","realm_access":{"roles":["contractor"]}}`,
+			wantName:   "bob",
+			wantKey:    "bob",
+			wantGroups: []string{"contractor"},
+		},
+		{
+			name:       "single group as a string",
+			claims:     `{"email":"alice@example.com","groups":"ops"}`,
+			wantName:   "alice@example.com",
+			wantKey:    "aliceexamplecom",
+			wantGroups: []string{"ops"},
+		},
+		{
+			name:    "missing user claim",
+			claims:  `{"name":"Alice"}`,
+			wantNil: true,
+		},
+	}
+
+	for _, f := range tests {
+		t.Run(f.name, func(t *testing.T) {
+			o := applyOIDCDefaults(f.oidc)
+			var claims map[string]interface{}
+			if err := json.Unmarshal([]byte(f.claims), &claims); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("GET", "/callback", nil)
+			req.Header.Set("X-Azure-Clientip", "1.2.3.4")
+			req.RemoteAddr = "10.0.0.1:5555"
+
+			var u User
+			got := u.newFromClaims(claims, o.UserClaim, o.NameClaim, o.GroupsClaim, req)
+			if f.wantNil {
+				if got != nil {
+					t.Errorf("user.newFromClaims() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("user.newFromClaims() returned nil, want a populated user")
+			}
+			if u.name != f.wantName {
+				t.Errorf("name: got %q, want %q", u.name, f.wantName)
+			}
+			if u.key != f.wantKey {
+				t.Errorf("key: got %q, want %q", u.key, f.wantKey)
+			}
+			if !reflect.DeepEqual(u.groups, f.wantGroups) {
+				t.Errorf("groups: got %v, want %v", u.groups, f.wantGroups)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+)
+
+// ResourcePlan is what a sync would change on one resource: the entries it
+// would add and remove, and those already in place.
+type ResourcePlan struct {
+	Resource  string   `json:"resource"`
+	Add       []string `json:"add"`
+	Remove    []string `json:"remove"`
+	Unchanged []string `json:"unchanged"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// changed reports whether applying the plan would modify the resource.
+func (rp ResourcePlan) changed() bool {
+	return len(rp.Add) != 0 || len(rp.Remove) != 0
+}
+
+// diffEntries compares a resource's current entries with the desired ones.
+// Each result is sorted and de-duplicated.
+func diffEntries(current []string, desired []string) (add []string, remove []string, unchanged []string) {
+	have := make(map[string]bool)
+	for _, e := range current {
+		have[e] = true
+	}
+	want := make(map[string]bool)
+	for _, e := range desired {
+		want[e] = true
+	}
+
+	add, remove, unchanged = []string{}, []string{}, []string{}
+	for e := range want {
+		if have[e] {
+			unchanged = append(unchanged, e)
+		} else {
+			add = append(add, e)
+		}
+	}
+	for e := range have {
+		if !want[e] {
+			remove = append(remove, e)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(remove)
+	sort.Strings(unchanged)
+	return add, remove, unchanged
+}
+
+// canonicalEntries writes IP entries as CIDRs the way net renders them, so a
+// configured 1.2.3.4 matches the 1.2.3.4/32 a resource reports back. Other
+// entries, like postgres ranges, are left as they are.
+func canonicalEntries(entries []string) []string {
+	canonical := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if ip := net.ParseIP(e); ip != nil {
+			if ip.To4() != nil {
+				e = ip.String() + "/32"
+			} else {
+				e = ip.String() + "/128"
+			}
+		} else if _, ipNet, err := net.ParseCIDR(e); err == nil {
+			e = ipNet.String()
+		}
+		canonical = append(canonical, e)
+	}
+	return canonical
+}
+
+// planResources computes, without writing anything, what a sync would change
+// on each resource: the desired state for list compared with what the
+// resource holds right now.
+func planResources(ctx context.Context, resources []Resource, list map[string]string, getGroups func(string) []string) []ResourcePlan {
+	plans := make([]ResourcePlan, len(resources))
+	sc := applySyncDefaults(c.Sync)
+	forEachResource(ctx, resources, sc.Concurrency, syncTimeout(), func(ctx context.Context, i int, res Resource) {
+		plans[i].Resource = res.id()
+		current, err := res.current(ctx)
+		if err != nil {
+			plans[i].Error = err.Error()
+			return
+		}
+		plans[i].Add, plans[i].Remove, plans[i].Unchanged = diffEntries(canonicalEntries(current), canonicalEntries(res.desired(list, getGroups)))
+	})
+	return plans
+}
+
+// writePlan prints plans in a terraform-like format: + for entries a sync
+// would add, - for those it would remove.
+func writePlan(out io.Writer, plans []ResourcePlan) {
+	var changes int
+	for _, rp := range plans {
+		switch {
+		case rp.Error != "":
+			fmt.Fprintf(out, "! %s\n    error: %s\n", rp.Resource, rp.Error)
+		case rp.changed():
+			changes++
+			fmt.Fprintf(out, "~ %s\n", rp.Resource)
+			for _, e := range rp.Add {
+				fmt.Fprintf(out, "    + %s\n", e)
+			}
+			for _, e := range rp.Remove {
+				fmt.Fprintf(out, "    - %s\n", e)
+			}
+			fmt.Fprintf(out, "      (%d unchanged)\n", len(rp.Unchanged))
+		default:
+			fmt.Fprintf(out, "  %s\n      (%d unchanged)\n", rp.Resource, len(rp.Unchanged))
+		}
+	}
+	fmt.Fprintf(out, "\n%d of %d resources would change.\n", changes, len(plans))
+}
+
+// plan loads the config, computes a plan for every enabled resource against
+// the current whitelist and prints it to out. It returns the process exit
+// code: 1 if any resource couldn't be read.
+func (*Whitelist) plan(out io.Writer) int {
+	c.load()
+
+	if !r.connect(c.Redis) {
+		return 1
+	}
+
+	ctx, cancel := redisContext()
+	list, err := r.getWhitelist(ctx)
+	cancel()
+	if err != nil {
+		log.Print("plan.plan(): could not read the whitelist: ", err)
+		return 1
+	}
+
+	plans := planResources(context.Background(), p.enabled(), list, r.getGroups)
+	writePlan(out, plans)
+
+	for _, rp := range plans {
+		if rp.Error != "" {
+			log.Print("plan.plan(): could not read '" + rp.Resource + "'")
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDiffEntries(t *testing.T) {
+	tests := []struct {
+		current, desired       []string
+		add, remove, unchanged []string
+	}{
+		{nil, nil, []string{}, []string{}, []string{}},
+		{nil, []string{"b", "a"}, []string{"a", "b"}, []string{}, []string{}},
+		{[]string{"a", "b"}, nil, []string{}, []string{"a", "b"}, []string{}},
+		{[]string{"c", "a", "b"}, []string{"b", "d", "c"}, []string{"d"}, []string{"a"}, []string{"b", "c"}},
+		{[]string{"a", "a"}, []string{"a", "a"}, []string{}, []string{}, []string{"a"}},
+	}
+
+	for _, f := range tests {
+		add, remove, unchanged := diffEntries(f.current, f.desired)
+		if !reflect.DeepEqual(add, f.add) || !reflect.DeepEqual(remove, f.remove) || !reflect.DeepEqual(unchanged, f.unchanged) {
+			t.Errorf("diffEntries(%v, %v) = %v, %v, %v, want %v, %v, %v", f.current, f.desired, add, remove, unchanged, f.add, f.remove, f.unchanged)
+		}
+	}
+}
+
+func TestCanonicalEntries(t *testing.T) {
+	got := canonicalEntries([]string{"1.2.3.4", "1.2.3.4/32", "10.0.0.7/24", "2001:DB8::1", "2001:db8::/48", "office: 1.2.3.4-1.2.3.4", "alice"})
+	want := []string{"1.2.3.4/32", "1.2.3.4/32", "10.0.0.0/24", "2001:db8::1/128", "2001:db8::/48", "office: 1.2.3.4-1.2.3.4", "alice"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("canonicalEntries() = %v, want %v", got, want)
+	}
+}
+
+func TestPlanResources(t *testing.T) {
+	fakes := []*fakeProvider{
+		{name: "a", entries: []string{"1.1.1.1/32", "3.3.3.3/32"}},
+		{name: "b", err: errors.New("forbidden")},
+		{name: "c", entries: []string{"1.1.1.1/32", "2.2.2.2/32"}},
+		// a static 1.2.3.4 is reported back by the resource as 1.2.3.4/32
+		{name: "d", entries: []string{"1.2.3.4/32", "1.1.1.1/32", "2.2.2.2/32"}, static: []string{"1.2.3.4"}},
+	}
+	var resources []Resource
+	for _, f := range fakes {
+		resources = append(resources, Resource{Provider: f})
+	}
+	list := map[string]string{"alice": "1.1.1.1/32", "bob": "2.2.2.2/32"}
+
+	plans := planResources(context.Background(), resources, list, func(string) []string { return nil })
+
+	want := []ResourcePlan{
+		{Resource: "fake/a", Add: []string{"2.2.2.2/32"}, Remove: []string{"3.3.3.3/32"}, Unchanged: []string{"1.1.1.1/32"}},
+		{Resource: "fake/b", Error: "forbidden"},
+		{Resource: "fake/c", Add: []string{}, Remove: []string{}, Unchanged: []string{"1.1.1.1/32", "2.2.2.2/32"}},
+		{Resource: "fake/d", Add: []string{}, Remove: []string{}, Unchanged: []string{"1.1.1.1/32", "1.2.3.4/32", "2.2.2.2/32"}},
+	}
+	if !reflect.DeepEqual(plans, want) {
+		t.Errorf("planResources() = %+v, want %+v", plans, want)
+	}
+	for _, f := range fakes {
+		if f.updated() {
+			t.Errorf("planResources() updated %s", f.id())
+		}
+	}
+}
+
+func TestWritePlan(t *testing.T) {
+	plans := []ResourcePlan{
+		{Resource: "fake/a", Add: []string{"1.1.1.1/32"}, Remove: []string{"3.3.3.3/32"}, Unchanged: []string{"2.2.2.2/32"}},
+		{Resource: "fake/b", Error: "forbidden"},
+		{Resource: "fake/c", Unchanged: []string{"1.1.1.1/32", "2.2.2.2/32"}},
+	}
+
+	var out bytes.Buffer
+	writePlan(&out, plans)
+
+	want := `~ fake/a
+    + 1.1.1.1/32
+    - 3.3.3.3/32
+      (1 unchanged)
+! fake/b
+    error: forbidden
+  fake/c
+      (2 unchanged)
+
+1 of 3 resources would change.
+`
+	if out.String() != want {
+		t.Errorf("writePlan() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
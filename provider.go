@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Provider is a single whitelist target (a FrontDoor policy, a Key Vault, a
+// UniFi Network List, ...) whose firewall the app keeps in sync with the
+// current whitelist.
+type Provider interface {
+	// id uniquely identifies the resource, e.g. "azure/keyvault/my-rg/my-kv".
+	id() string
+	// enabled reports whether the resource should be synced at all. Providers
+	// use it to stay clear of the placeholder values in the sample config.
+	enabled() bool
+	// desired computes the entries the resource's firewall should hold for
+	// list (key = user, value = cidr), in the resource's own notation.
+	desired(list map[string]string, getGroups func(string) []string) []string
+	// current reads the entries the resource's firewall holds right now, in
+	// the same notation as desired.
+	current(ctx context.Context) ([]string, error)
+	// update reconciles the resource against list, giving up when ctx is done.
+	update(ctx context.Context, list map[string]string) error
+}
+
+// ProviderFactory builds a Provider from a resource's configuration.
+type ProviderFactory func(rc ResourceConfiguration) (Provider, error)
+
+// providerFactories is the registry of known providers, keyed by "cloud/type".
+var providerFactories = make(map[string]ProviderFactory)
+
+// registerProvider makes a provider available to config files as
+// `cloud: <cloud>` / `type: <typ>`. Providers call it from an init() in their
+// own file, so adding one never means touching config loading or syncing.
+func registerProvider(cloud string, typ string, f ProviderFactory) {
+	key := providerKey(cloud, typ)
+	if _, ok := providerFactories[key]; ok {
+		log.Fatalln("provider.registerProvider(): provider '" + key + "' is already registered")
+	}
+	providerFactories[key] = f
+}
+
+func providerKey(cloud string, typ string) string {
+	return strings.ToLower(cloud) + "/" + strings.ToLower(typ)
+}
+
+// newProvider builds the Provider registered for rc's cloud and type.
+func newProvider(rc ResourceConfiguration) (Provider, error) {
+	if f, ok := providerFactories[providerKey(rc.Cloud, rc.Type)]; ok {
+		return f(rc)
+	}
+	for key := range providerFactories {
+		if strings.HasPrefix(key, strings.ToLower(rc.Cloud)+"/") {
+			return nil, errors.New("unsupported " + rc.Cloud + " resource type '" + rc.Type + "'")
+		}
+	}
+	return nil, errors.New("unsupported cloud '" + rc.Cloud + "'")
+}
+
+// Resource is a configured whitelist target: the Provider that syncs it plus
+// the configuration it was built from.
+type Resource struct {
+	Provider
+	Config ResourceConfiguration
+}
+
+// Providers holds the resources built by the most recent config load. A reload
+// swaps the list while a sync may be iterating it, so access goes through
+// set() and all().
+type Providers struct {
+	mu   sync.RWMutex
+	list []Resource
+}
+
+func (p *Providers) set(list []Resource) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.list = list
+}
+
+// all returns a snapshot of the configured resources.
+func (p *Providers) all() []Resource {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]Resource(nil), p.list...)
+}
+
+// enabled returns a snapshot of the resources that should be synced.
+func (p *Providers) enabled() []Resource {
+	var resources []Resource
+	for _, res := range p.all() {
+		if res.enabled() {
+			resources = append(resources, res)
+		}
+	}
+	return resources
+}
+
+// filterResources returns the resources whose id is in ids, keeping their
+// order.
+func filterResources(resources []Resource, ids []string) []Resource {
+	want := make(map[string]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	var filtered []Resource
+	for _, res := range resources {
+		if want[res.id()] {
+			filtered = append(filtered, res)
+		}
+	}
+	return filtered
+}
+
+// loadProviders builds a Resource for every resource configuration.
+func loadProviders(resources []ResourceConfiguration) ([]Resource, error) {
+	list := make([]Resource, 0, len(resources))
+	for _, rc := range resources {
+		pr, err := newProvider(rc)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := driftMode(rc); err != nil {
+			return nil, err
+		}
+		list = append(list, Resource{Provider: pr, Config: rc})
+	}
+	return list, nil
+}
+
+// whitelistedIps returns the dynamic whitelist entries (key = user, value =
+// cidr) that resource id should allow: those not already covered by its static
+// whitelist and whose user belongs to one of its groups. When v4Only is set,
+// IPv6 entries are dropped for resources that can't take them.
+func whitelistedIps(id string, list map[string]string, static []string, groups []string, getGroups func(string) []string, v4Only bool) map[string]string {
+	ips := make(map[string]string)
+	for key, ip := range list {
+		if w.inRange(ip, static) {
+			continue
+		}
+		if v4Only && !isValidIpOrNetV4(ip) {
+			continue
+		}
+		userGroups := getGroups(key)
+		if !hasGroup(groups, userGroups) {
+			if c.Debug {
+				log.Print("provider.whitelistedIps(): user '"+key+"' is not part of any of the groups ", groups, " required for '"+id+"'")
+			}
+			continue
+		}
+		if !hasResource(id, userGroups) {
+			if c.Debug {
+				log.Print("provider.whitelistedIps(): user '" + key + "' is restricted to other resources than '" + id + "'")
+			}
+			continue
+		}
+		ips[key] = ip
+	}
+	return ips
+}
+
+// coveredResources returns the ids of the enabled resources u's whitelisting
+// adds an entry to.
+func coveredResources(u *User) []string {
+	ids := []string{}
+	for _, res := range p.enabled() {
+		if covers(res, u.key, u.cidr, u.groups) {
+			ids = append(ids, res.id())
+		}
+	}
+	return ids
+}
+
+// covers reports whether whitelisting cidr for user, with groups, adds an
+// entry to res.
+func covers(res Resource, user string, cidr string, groups []string) bool {
+	getGroups := func(string) []string { return groups }
+	without := res.desired(map[string]string{}, getGroups)
+	with := res.desired(map[string]string{user: cidr}, getGroups)
+	add, _, _ := diffEntries(without, with)
+	return len(add) > 0
+}
+
+// sortedKeys returns the keys of m in a stable order, so generated firewall
+// rules don't reshuffle from one sync to the next.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// staticWhitelist returns the global static whitelist followed by a
+// resource's own static entries, without touching c.IPWhiteList's backing array.
+func staticWhitelist(resource []string) []string {
+	return append(append([]string{}, c.IPWhiteList...), resource...)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewProvider(t *testing.T) {
+	tests := []struct {
+		rc      ResourceConfiguration
+		wantId  string
+		wantErr string
+	}{
+		{ResourceConfiguration{Cloud: "azure", Type: "keyvault", ResourceGroup: "rg", Name: "kv"}, "azure/keyvault/rg/kv", ""},
+		// cloud and type are case-insensitive
+		{ResourceConfiguration{Cloud: "Azure", Type: "FrontDoor", ResourceGroup: "rg", PolicyName: "waf"}, "azure/frontdoor/rg/waf", ""},
+		{ResourceConfiguration{Cloud: "unifi", Type: "networklist", Name: "list"}, "unifi/networklist/list", ""},
+		{ResourceConfiguration{Cloud: "azure", Type: "nope"}, "", "unsupported azure resource type 'nope'"},
+		{ResourceConfiguration{Cloud: "gcp", Type: "firewall"}, "", "unsupported cloud 'gcp'"},
+	}
+
+	for _, f := range tests {
+		pr, err := newProvider(f.rc)
+		if f.wantErr != "" {
+			if err == nil || err.Error() != f.wantErr {
+				t.Errorf("newProvider(%+v) error = %v, want %q", f.rc, err, f.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newProvider(%+v) unexpected error: %v", f.rc, err)
+			continue
+		}
+		if pr.id() != f.wantId {
+			t.Errorf("newProvider(%+v) id = %q, want %q", f.rc, pr.id(), f.wantId)
+		}
+	}
+}
+
+// fakeProvider is the Provider the tests use. It wants the cidr of each user
+// in group, IPv4 only unless ipv6 is set, plus its static entries; it holds
+// entries, and records the updates it's given.
+type fakeProvider struct {
+	name    string
+	group   []string
+	ipv6    bool
+	static  []string
+	entries []string       // returned by current, with err
+	err     error          // returned by current
+	fail    error          // returned by update
+	delay   time.Duration  // how long an update takes
+	tracker *updateTracker // shared by fakes to count updates running at once
+
+	mu      sync.Mutex
+	updates int
+	seen    map[string]string // the list of the last update
+}
+
+// updateTracker counts the updates running at once, and the most there were.
+type updateTracker struct {
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (f *fakeProvider) id() string  { return "fake/" + f.name }
+func (*fakeProvider) enabled() bool { return true }
+func (f *fakeProvider) desired(list map[string]string, getGroups func(string) []string) []string {
+	var entries []string
+	for _, ip := range whitelistedIps(f.id(), list, f.static, f.group, getGroups, !f.ipv6) {
+		entries = append(entries, ip)
+	}
+	return append(entries, f.static...)
+}
+func (f *fakeProvider) current(context.Context) ([]string, error) { return f.entries, f.err }
+
+func (f *fakeProvider) update(ctx context.Context, list map[string]string) error {
+	f.mu.Lock()
+	f.updates++
+	f.seen = list
+	f.mu.Unlock()
+	if tr := f.tracker; tr != nil {
+		tr.mu.Lock()
+		tr.running++
+		tr.peak = max(tr.peak, tr.running)
+		tr.mu.Unlock()
+		defer func() {
+			tr.mu.Lock()
+			tr.running--
+			tr.mu.Unlock()
+		}()
+	}
+
+	select {
+	case <-time.After(f.delay):
+		return f.fail
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// updated reports whether the fake has been updated.
+func (f *fakeProvider) updated() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.updates != 0
+}
+
+func TestRegisterProvider(t *testing.T) {
+	registerProvider("Test", "Provider", func(rc ResourceConfiguration) (Provider, error) {
+		return &fakeProvider{name: rc.Name}, nil
+	})
+	defer delete(providerFactories, "test/provider")
+
+	resources, err := loadProviders([]ResourceConfiguration{{Cloud: "test", Type: "provider", Name: "one"}})
+	if err != nil {
+		t.Fatalf("loadProviders() unexpected error: %v", err)
+	}
+	if len(resources) != 1 || resources[0].id() != "fake/one" {
+		t.Fatalf("loadProviders() = %+v, want the one resource the registered factory built", resources)
+	}
+	if resources[0].Config.Name != "one" {
+		t.Errorf("resource config not kept, got %+v", resources[0].Config)
+	}
+}
+
+func TestLoadProvidersUnsupported(t *testing.T) {
+	_, err := loadProviders([]ResourceConfiguration{
+		{Cloud: "azure", Type: "keyvault", Name: "kv"},
+		{Cloud: "azure", Type: "vm", Name: "nope"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "'vm'") {
+		t.Errorf("loadProviders() error = %v, want unsupported resource type 'vm'", err)
+	}
+}
+
+func TestWhitelistedIps(t *testing.T) {
+	c.Debug = false
+	getGroups := func(user string) []string {
+		if user == "alice" {
+			return []string{"group-a"}
+		}
+		return nil
+	}
+	list := map[string]string{
+		"alice": "1.1.1.1/32",
+		"bob":   "2.2.2.2/32",                                  // not in group-a
+		"carol": "85.0.0.5/32",                                 // covered by the static whitelist
+		"dave":  "2a00:11c7:1234:b801:a16e:12af:5e42:1100/128", // ipv6
+	}
+
+	got := whitelistedIps("test", list, []string{"85.0.0.0/24"}, []string{"group-a"}, getGroups, true)
+	if !reflect.DeepEqual(got, map[string]string{"alice": "1.1.1.1/32"}) {
+		t.Errorf("whitelistedIps() with group filter = %v", got)
+	}
+
+	got = whitelistedIps("test", list, []string{"85.0.0.0/24"}, nil, getGroups, false)
+	want := map[string]string{"alice": "1.1.1.1/32", "bob": "2.2.2.2/32", "dave": "2a00:11c7:1234:b801:a16e:12af:5e42:1100/128"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("whitelistedIps() without group filter = %v, want %v", got, want)
+	}
+}
+
+func TestStaticWhitelist(t *testing.T) {
+	c.IPWhiteList = make([]string, 1, 10)
+	c.IPWhiteList[0] = "85.0.0.0/24"
+	defer func() { c.IPWhiteList = nil }()
+
+	a := staticWhitelist([]string{"1.1.1.1/32"})
+	b := staticWhitelist([]string{"2.2.2.2/32"})
+	if !reflect.DeepEqual(a, []string{"85.0.0.0/24", "1.1.1.1/32"}) {
+		t.Errorf("staticWhitelist() = %v", a)
+	}
+	if !reflect.DeepEqual(b, []string{"85.0.0.0/24", "2.2.2.2/32"}) {
+		t.Errorf("staticWhitelist() = %v, earlier call leaked into it", b)
+	}
+}
+
+func TestCoveredResources(t *testing.T) {
+	defer p.set(nil)
+	p.set([]Resource{
+		{Provider: &fakeProvider{name: "open"}},
+		{Provider: &fakeProvider{name: "devs", group: []string{"devs"}}},
+		{Provider: &fakeProvider{name: "ops", group: []string{"ops"}}},
+	})
+
+	u := &User{key: "testuser", cidr: "203.0.113.9/32", groups: []string{"devs"}}
+	got := coveredResources(u)
+	if len(got) != 2 || got[0] != "fake/open" || got[1] != "fake/devs" {
+		t.Errorf("coveredResources() = %v, want [fake/open fake/devs]", got)
+	}
+}
@@ -1,25 +1,99 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
-	"sort"
+	"net"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
 type RedisConfiguration struct {
-	Host            string       `yaml:"host"`
-	Port            int          `yaml:"port"`
-	Token           string       `yaml:"token"`
-	Connection      []redis.Conn // db0 (used for whitelist), db1 (used for groups cache), db2 (used for api spam prevention)
-	Running         []bool       // concurrency check
-	CurrentDatabase int
+	Host   string `yaml:"host"`
+	Port   int    `yaml:"port"`
+	Token  string `yaml:"token"`
+	DB     int    `yaml:"db"`     // database to use, default 0
+	Prefix string `yaml:"prefix"` // prepended to every key, default 'ip-whitelister:'
+	// Migrate moves keys from the old one-database-per-kind layout on start.
+	// Off by default: the old keys can only be told apart from other apps'
+	// by their values
+	Migrate bool `yaml:"migrate"`
+	// ConfigureEvents lets the app turn on expired key events itself with
+	// CONFIG SET, which changes the whole server
+	ConfigureEvents bool        `yaml:"configure_events"`
+	Pool            *redis.Pool `yaml:"-"`
 }
 
-var redisDBCount int = 3
+// Key kinds, each kept under <prefix><kind>:<name>.
+const (
+	keyWhitelist = "whitelist" // user -> whitelisted cidr
+	keyGroups    = "groups"    // user -> cached groups
+	keyApi       = "api"       // user -> set while their api calls are throttled
+	keyRetry     = "retry"     // resource -> pending retry
+	keyLeader    = "leader"    // lease -> id of the replica holding the leader lease
+	keySync      = "sync"      // requests -> queued sync requests, reply:<id> -> their reports
+	keySession   = "session"   // session id -> gob encoded session values
+	keyToken     = "token"     // sha256 of an api token -> the token's json
+	keySince     = "since"     // user -> when their current cidr was whitelisted
+	keyStatus    = "status"    // resource -> json outcome of its last sync
+	keyIp        = "ip"        // cidr -> users whitelisted for it, scored by expiry
+)
+
+var defaultRedisPrefix = "ip-whitelister:"
+
+// redisTimeout bounds a redis call made without a caller's context.
+var redisTimeout = 10 * time.Second
+
+// redisDown is set while the health check can't reach redis; the app isn't
+// ready then.
+var redisDown atomic.Bool
+
+var errRedisNotConnected = errors.New("redis: not connected")
+
+// redisContext returns a context for a redis call that has none of its own.
+func redisContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisTimeout)
+}
+
+// key returns the redis key for name of the given kind
+func (r RedisConfiguration) key(kind string, name string) string {
+	return r.Prefix + kind + ":" + name
+}
+
+// dial opens a new connection to database db
+func (r RedisConfiguration) dial(ctx context.Context, db int) (redis.Conn, error) {
+	return redis.DialContext(ctx, "tcp", r.Host+":"+strconv.Itoa(r.Port),
+		redis.DialPassword(r.Token),
+		redis.DialDatabase(db),
+		redis.DialConnectTimeout(redisTimeout),
+	)
+}
+
+// newPool returns a connection pool for the configured database. Broken
+// connections are dropped by the pool and replaced on the next call, and
+// connections idle for a while are pinged before being reused.
+func (r RedisConfiguration) newPool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 5 * time.Minute,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return r.dial(ctx, r.DB)
+		},
+		TestOnBorrow: func(conn redis.Conn, lastUsed time.Time) error {
+			if time.Since(lastUsed) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+}
 
 // connect
 func (r *RedisConfiguration) connect(rc RedisConfiguration) bool {
@@ -27,119 +101,272 @@ func (r *RedisConfiguration) connect(rc RedisConfiguration) bool {
 		log.Print("redis.connect(): no redis database configuration was found")
 		return false
 	}
+	if rc.Prefix == "" {
+		rc.Prefix = defaultRedisPrefix
+	}
 
-	r.Connection = make([]redis.Conn, redisDBCount)
-	r.Running = make([]bool, redisDBCount)
+	log.Println("redis.connect(): connecting to redis database '" + rc.Host + ":" + strconv.Itoa(rc.Port) + "/" + strconv.Itoa(rc.DB) + "', key prefix '" + rc.Prefix + "'")
 
-	log.Println("redis.connect(): connecting to redis database '" + rc.Host + ":" + strconv.Itoa(rc.Port) + "'")
+	r.close()
+	r.Host, r.Port, r.Token, r.DB, r.Prefix, r.Migrate, r.ConfigureEvents = rc.Host, rc.Port, rc.Token, rc.DB, rc.Prefix, rc.Migrate, rc.ConfigureEvents
+	r.Pool = r.newPool()
 
-	for db := 0; db <= (redisDBCount - 1); db++ {
-		c, err := redis.Dial("tcp", rc.Host+":"+strconv.Itoa(rc.Port))
-		if err != nil {
-			log.Printf("redis.connect(): %v ", err)
-			return false
-		}
-
-		_, err = c.Do("AUTH", rc.Token)
-		if err != nil {
-			log.Printf("redis.connect(): %v ", err)
-			return false
-		}
+	ctx, cancel := redisContext()
+	defer cancel()
+	if err := r.ping(ctx); err != nil {
+		log.Printf("redis.connect(): %v ", err)
+		r.close()
+		return false
+	}
 
-		_, err = c.Do("SELECT", db)
-		if err != nil {
-			log.Fatal("redis.connect():", err)
-			return false
+	if r.Migrate {
+		if err := r.migrate(ctx); err != nil {
+			log.Print("redis.connect(): could not migrate keys from the old layout: ", err)
 		}
-
-		r.Running[db] = false
-		r.Connection[db] = c
+	}
+	if err := r.indexWhitelist(ctx); err != nil {
+		log.Print("redis.connect(): could not index the whitelist: ", err)
 	}
 
-	go r.keepAlive()
 	log.Println("redis.connect(): connected")
 	return true
 }
 
-// exec
-func (r RedisConfiguration) exec(db int, commandName string, args ...interface{}) (reply interface{}, err error) {
-	r.wait(db)
-	r.Running[db] = true
-	reply, err = r.Connection[db].Do(commandName, args[:]...)
-	r.Running[db] = false
-	return reply, err
+// close the connection pool
+func (r *RedisConfiguration) close() {
+	if r.Pool != nil {
+		r.Pool.Close()
+	}
+	r.Pool = nil
 }
 
-// wait
-func (r RedisConfiguration) wait(db int) {
-	// redigo library doesn't support concurrency so we need to run single commands at a time
-	for ok := true; ok; ok = r.Running[db] {
-		// command currently running
+// exec runs a single command on a pooled connection
+func (r RedisConfiguration) exec(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	if r.Pool == nil {
+		return nil, errRedisNotConnected
 	}
+	conn, err := r.Pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return redis.DoContext(conn, ctx, commandName, args...)
 }
 
-// add ip
-func (r RedisConfiguration) addIp(user string, ip string) bool {
-	_, err := r.exec(0, "SET", user, ip)
+// ping checks redis can be reached
+func (r RedisConfiguration) ping(ctx context.Context) error {
+	_, err := r.exec(ctx, "PING")
+	return err
+}
+
+// healthCheck pings redis every 30 seconds, marking the app not ready while
+// it can't be reached
+func (r RedisConfiguration) healthCheck() {
+	for range time.Tick(30 * time.Second) {
+		ctx, cancel := redisContext()
+		err := r.ping(ctx)
+		cancel()
+
+		if wasDown := redisDown.Swap(err != nil); err != nil && !wasDown {
+			log.Print("redis.healthCheck(): redis is unreachable: ", err)
+		} else if err == nil && wasDown {
+			log.Print("redis.healthCheck(): redis is reachable again")
+		}
+	}
+}
+
+// scan returns the names of every key of the given kind, using SCAN so large
+// or shared databases aren't blocked
+func (r RedisConfiguration) scan(ctx context.Context, kind string) ([]string, error) {
+	match := r.key(kind, "*")
+	var names []string
+	cursor := 0
+	for {
+		reply, err := redis.Values(r.exec(ctx, "SCAN", cursor, "MATCH", match, "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			names = append(names, strings.TrimPrefix(key, r.key(kind, "")))
+		}
+		if cursor == 0 {
+			return names, nil
+		}
+	}
+}
+
+// values returns every key of the given kind with its value. Keys expiring
+// between the SCAN and the MGET are left out.
+func (r RedisConfiguration) values(ctx context.Context, kind string) (map[string]string, error) {
+	values := make(map[string]string)
+
+	names, err := r.scan(ctx, kind)
+	if err != nil || len(names) == 0 {
+		return values, err
+	}
+	keys := make([]interface{}, len(names))
+	for index, name := range names {
+		keys[index] = r.key(kind, name)
+	}
+	reply, err := redis.Strings(r.exec(ctx, "MGET", keys...))
 	if err != nil {
-		log.Fatal("redis.addIp():", err)
-		return false
+		return nil, err
+	}
+	for index, name := range names {
+		if reply[index] != "" {
+			values[name] = reply[index]
+		}
 	}
+	return values, nil
+}
 
-	// expire this key in x hours
-	return r.setIpExpiry(user)
+// add ip
+func (r RedisConfiguration) addIp(ctx context.Context, user string, ip string, ttl time.Duration) error {
+	// each key is set with its expiry, so none outlives the whitelisting
+	if _, err := r.exec(ctx, "SET", r.key(keyWhitelist, user), ip, "PX", ttl.Milliseconds()); err != nil {
+		return err
+	}
+	if err := r.indexIp(ctx, user, ip, ttl); err != nil {
+		return err
+	}
+	// set after the ip, so a sync that read the whitelist later has it
+	_, err := r.exec(ctx, "SET", r.key(keySince, user), time.Now().UTC().Format(time.RFC3339Nano), "PX", ttl.Milliseconds())
+	return err
 }
 
 // set ttl on ip
-func (r RedisConfiguration) setIpExpiry(user string) bool {
-	_, err := r.exec(0, "EXPIRE", user, strconv.Itoa(c.TTL*3600))
-	if err != nil {
-		log.Fatal("redis.setIpExpiry():", err)
-		return false
+func (r RedisConfiguration) setIpExpiry(ctx context.Context, user string, ttl time.Duration) error {
+	if _, err := r.exec(ctx, "PEXPIRE", r.key(keyWhitelist, user), ttl.Milliseconds()); err != nil {
+		return err
 	}
-	return true
+	if _, err := r.exec(ctx, "PEXPIRE", r.key(keySince, user), ttl.Milliseconds()); err != nil {
+		return err
+	}
+	ip, _, err := r.getIp(ctx, user)
+	if err != nil || ip == "" {
+		return err
+	}
+	return r.indexIp(ctx, user, ip, ttl)
 }
 
-// delete ip
-func (r RedisConfiguration) deleteIp(user string) bool {
-	_, err := r.exec(0, "DEL", user)
+// indexIpScript adds a user to the index of a cidr until their entry
+// expires, drops users whose entries have expired, and expires the index
+// with its last entry
+var indexIpScript = `redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", "(" .. ARGV[3])
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+return redis.call("PEXPIREAT", KEYS[1], last[2])`
+
+// index a user's whitelisted ip, so who is whitelisted for an ip can be
+// looked up without reading the whole whitelist
+func (r RedisConfiguration) indexIp(ctx context.Context, user string, ip string, ttl time.Duration) error {
+	now := time.Now()
+	_, err := r.exec(ctx, "EVAL", indexIpScript, 1, r.key(keyIp, ip), user, now.Add(ttl).UnixMilli(), now.UnixMilli())
+	return err
+}
+
+// indexWhitelist indexes every whitelisted ip, for entries made before the
+// index existed or moved by migrate
+func (r RedisConfiguration) indexWhitelist(ctx context.Context) error {
+	list, err := r.values(ctx, keyWhitelist)
 	if err != nil {
-		log.Fatal("redis.deleteIp():", err)
-		return false
+		return err
 	}
-	return true
+	for user, ip := range list {
+		ms, err := redis.Int64(r.exec(ctx, "PTTL", r.key(keyWhitelist, user)))
+		if err != nil {
+			return err
+		}
+		if ms <= 0 {
+			continue
+		}
+		if err := r.indexIp(ctx, user, ip, time.Duration(ms)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// get whitelist
-func (r RedisConfiguration) getWhitelist() map[string]string {
-	wl := make(map[string]string)
-
-	redisResponse1 := time.Now()
+// get the users whitelisted for exactly ip, with their entry
+func (r RedisConfiguration) whitelistedAt(ctx context.Context, ip string) (map[string]string, error) {
+	list := make(map[string]string)
+	users, err := redis.Strings(r.exec(ctx, "ZRANGEBYSCORE", r.key(keyIp, ip), time.Now().UnixMilli(), "+inf"))
+	if err != nil || len(users) == 0 {
+		return list, err
+	}
+	keys := make([]interface{}, len(users))
+	for index, user := range users {
+		keys[index] = r.key(keyWhitelist, user)
+	}
+	reply, err := redis.Strings(r.exec(ctx, "MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+	// users may have moved to another ip since
+	for index, user := range users {
+		if reply[index] == ip {
+			list[user] = ip
+		}
+	}
+	return list, nil
+}
 
-	keysI, err := redis.Values(r.exec(0, "KEYS", "*"))
+// get when a user's current ip was whitelisted, zero when it isn't known
+func (r RedisConfiguration) getSince(ctx context.Context, user string) (time.Time, error) {
+	v, err := redis.String(r.exec(ctx, "GET", r.key(keySince, user)))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
 	if err != nil {
-		log.Fatal("redis.getWhitelist(): ", err)
+		return time.Time{}, err
 	}
-	if len(keysI) == 0 {
-		return wl
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// get a user's whitelisted ip and how long it has left, "" when they have none
+func (r RedisConfiguration) getIp(ctx context.Context, user string) (string, time.Duration, error) {
+	ip, err := redis.String(r.exec(ctx, "GET", r.key(keyWhitelist, user)))
+	if err == redis.ErrNil {
+		return "", 0, nil
 	}
-	values, err := redis.Strings(r.exec(0, "MGET", keysI[:]...))
 	if err != nil {
-		log.Fatal("redis.getWhitelist(): ", err)
+		return "", 0, err
+	}
+	ms, err := redis.Int64(r.exec(ctx, "PTTL", r.key(keyWhitelist, user)))
+	if ms < 0 {
+		ms = 0
 	}
-	keys, err := redis.Strings(keysI, err)
+	return ip, time.Duration(ms) * time.Millisecond, err
+}
+
+// delete ip
+func (r RedisConfiguration) deleteIp(ctx context.Context, user string) error {
+	ip, _, err := r.getIp(ctx, user)
 	if err != nil {
-		log.Fatal("redis.getWhitelist(): ", err)
+		return err
 	}
+	if _, err := r.exec(ctx, "DEL", r.key(keyWhitelist, user), r.key(keySince, user)); err != nil || ip == "" {
+		return err
+	}
+	_, err = r.exec(ctx, "ZREM", r.key(keyIp, ip), user)
+	return err
+}
+
+// get whitelist
+func (r RedisConfiguration) getWhitelist(ctx context.Context) (map[string]string, error) {
+	redisResponse1 := time.Now()
 
-	for index, key := range keys {
-		ip := values[index]
-		wl[key] = ip
+	wl, err := r.values(ctx, keyWhitelist)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Println("redis.getWhitelist(): ## current ip whitelist ##")
-	sort.Strings(keys)
-	for _, key := range keys {
+	for _, key := range sortedKeys(wl) {
 		log.Println("redis.getWhitelist(): " + key + " : " + wl[key])
 	}
 	log.Println("redis.getWhitelist(): ##                      ##")
@@ -147,58 +374,60 @@ func (r RedisConfiguration) getWhitelist() map[string]string {
 	redisResponse2 := time.Now()
 	log.Println("redis.getWhitelist(): response time:", redisResponse2.Sub(redisResponse1))
 
-	return wl
+	return wl, nil
 }
 
 // add group
-func (r RedisConfiguration) addGroups(user string, groups []string) bool {
+func (r RedisConfiguration) addGroups(ctx context.Context, user string, groups []string, ttl time.Duration) error {
 	jsonGroups, err := json.Marshal(groups)
 	if err != nil {
-		log.Print("redis.addGroups():", err)
-		return false
-	}
-	_, err = r.exec(1, "SET", user, jsonGroups)
-	if err != nil {
-		log.Fatal("redis.addGroups():", err)
-		return false
+		return err
 	}
-
-	// expire this key in x hours
-	return r.setGroupExpiry(user)
+	// expire this key just after the whitelisting
+	_, err = r.exec(ctx, "SET", r.key(keyGroups, user), jsonGroups, "PX", (ttl + 10*time.Second).Milliseconds())
+	return err
 }
 
 // set group expiry
-func (r RedisConfiguration) setGroupExpiry(user string) bool {
-	_, err := r.exec(1, "EXPIRE", user, strconv.Itoa(c.TTL*3600+10))
+func (r RedisConfiguration) setGroupExpiry(ctx context.Context, user string, ttl time.Duration) error {
+	_, err := r.exec(ctx, "PEXPIRE", r.key(keyGroups, user), (ttl + 10*time.Second).Milliseconds())
+	return err
+}
+
+// get groups, logging any error; matches the getGroups func resources are
+// given
+func (r RedisConfiguration) getGroups(user string) []string {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	g, err := r.getUserGroups(ctx, user)
 	if err != nil {
-		log.Fatal("redis.setGroupExpiry():", err)
-		return false
+		log.Print("redis.getGroups(): ", err)
 	}
-	return true
+	return g
 }
 
-// get groups
-func (r RedisConfiguration) getGroups(user string) []string {
+// delete a user's cached groups
+func (r RedisConfiguration) deleteGroups(ctx context.Context, user string) error {
+	_, err := r.exec(ctx, "DEL", r.key(keyGroups, user))
+	return err
+}
+
+// get a user's cached groups, none if they've expired
+func (r RedisConfiguration) getUserGroups(ctx context.Context, user string) ([]string, error) {
 	var g []string
 
 	redisResponse1 := time.Now()
 
-	keysI, err := redis.Values(r.exec(1, "KEYS", user))
-	if err != nil {
-		log.Print("redis.getGroups(): ", err)
-		return g
-	}
-	if len(keysI) == 0 {
-		return g
+	value, err := redis.String(r.exec(ctx, "GET", r.key(keyGroups, user)))
+	if err == redis.ErrNil {
+		return g, nil
 	}
-	value, err := redis.String(r.exec(1, "GET", user))
 	if err != nil {
-		log.Print("redis.getGroups(): ", err)
-		return g
+		return g, err
 	}
 	if err := json.Unmarshal([]byte(value), &g); err != nil {
-		log.Println("redis.getGroups():", err)
-		return g
+		return g, err
 	}
 
 	redisResponse2 := time.Now()
@@ -206,41 +435,329 @@ func (r RedisConfiguration) getGroups(user string) []string {
 		log.Println("redis.getGroups(): response time:", redisResponse2.Sub(redisResponse1))
 	}
 
-	return g
+	return g, nil
 }
 
 // user caused api call
-func (r RedisConfiguration) apiCalled(user string) {
+func (r RedisConfiguration) apiCalled(ctx context.Context, user string) error {
 	// all user to cause api calls every 120 seconds
-	_, err := redis.String(r.exec(2, "SETEX", user, 120, "."))
+	_, err := r.exec(ctx, "SETEX", r.key(keyApi, user), 120, ".")
+	return err
+}
+
+// can user call api
+func (r RedisConfiguration) canCallApi(ctx context.Context, user string) (bool, error) {
+	exists, err := redis.Int(r.exec(ctx, "EXISTS", r.key(keyApi, user)))
 	if err != nil {
-		log.Fatal("redis.apiCalled():", err)
+		return false, err
 	}
+	return exists == 0, nil
 }
 
-// can user call api
-func (r RedisConfiguration) canCallApi(user string) bool {
-	exists, err := redis.Int(r.exec(2, "EXISTS", user))
+// save a pending retry
+func (r RedisConfiguration) setRetry(ctx context.Context, resource string, retry []byte) error {
+	_, err := r.exec(ctx, "SET", r.key(keyRetry, resource), retry)
+	return err
+}
+
+// delete a pending retry
+func (r RedisConfiguration) deleteRetry(ctx context.Context, resource string) error {
+	_, err := r.exec(ctx, "DEL", r.key(keyRetry, resource))
+	return err
+}
+
+// get pending retries
+func (r RedisConfiguration) getRetries(ctx context.Context) (map[string]string, error) {
+	return r.values(ctx, keyRetry)
+}
+
+// get a session's values, nil when it doesn't exist or has expired
+func (r RedisConfiguration) getSession(ctx context.Context, id string) ([]byte, error) {
+	b, err := redis.Bytes(r.exec(ctx, "GET", r.key(keySession, id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return b, err
+}
+
+// store a session's values until ttl passes
+func (r RedisConfiguration) setSession(ctx context.Context, id string, values []byte, ttl time.Duration) error {
+	_, err := r.exec(ctx, "SET", r.key(keySession, id), values, "PX", ttl.Milliseconds())
+	return err
+}
+
+func (r RedisConfiguration) deleteSession(ctx context.Context, id string) error {
+	_, err := r.exec(ctx, "DEL", r.key(keySession, id))
+	return err
+}
+
+// get an api token by its hash, nil when it doesn't exist or has expired
+func (r RedisConfiguration) getToken(ctx context.Context, id string) ([]byte, error) {
+	b, err := redis.Bytes(r.exec(ctx, "GET", r.key(keyToken, id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return b, err
+}
+
+// store the outcome of a resource's last sync
+func (r RedisConfiguration) setSyncStatus(ctx context.Context, resource string, status []byte) error {
+	_, err := r.exec(ctx, "SET", r.key(keyStatus, resource), status)
+	return err
+}
+
+// get the outcome of every resource's last sync, keyed by resource
+func (r RedisConfiguration) getSyncStatuses(ctx context.Context) (map[string]string, error) {
+	return r.values(ctx, keyStatus)
+}
+
+// store an api token until ttl passes
+func (r RedisConfiguration) setToken(ctx context.Context, id string, token []byte, ttl time.Duration) error {
+	_, err := r.exec(ctx, "SET", r.key(keyToken, id), token, "PX", ttl.Milliseconds())
+	return err
+}
+
+// delete an api token, reporting whether it existed
+func (r RedisConfiguration) deleteToken(ctx context.Context, id string) (bool, error) {
+	n, err := redis.Int(r.exec(ctx, "DEL", r.key(keyToken, id)))
+	return n > 0, err
+}
+
+// renewLeaseScript extends a lease only while it's still held by the caller
+var renewLeaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+
+// take the leader lease for id if nobody holds it
+func (r RedisConfiguration) acquireLease(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	_, err := redis.String(r.exec(ctx, "SET", r.key(keyLeader, "lease"), id, "NX", "PX", ttl.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// extend the leader lease, if id still holds it
+func (r RedisConfiguration) renewLease(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	renewed, err := redis.Int(r.exec(ctx, "EVAL", renewLeaseScript, 1, r.key(keyLeader, "lease"), id, ttl.Milliseconds()))
+	return renewed == 1, err
+}
+
+// queue a sync request for the leader
+func (r RedisConfiguration) pushSyncRequest(ctx context.Context, request []byte) error {
+	_, err := r.exec(ctx, "RPUSH", r.key(keySync, "requests"), request)
+	return err
+}
+
+// wait up to timeout for a queued sync request, nil if none arrived
+func (r RedisConfiguration) popSyncRequest(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	return r.blockingPop(ctx, r.key(keySync, "requests"), timeout)
+}
+
+// hand a sync request's report back to the replica that asked
+func (r RedisConfiguration) pushSyncReply(ctx context.Context, request string, reply []byte) error {
+	key := r.key(keySync, "reply:"+request)
+	if _, err := r.exec(ctx, "RPUSH", key, reply); err != nil {
+		return err
+	}
+	// nobody collects the reply if the requester has gone
+	_, err := r.exec(ctx, "EXPIRE", key, 60)
+	return err
+}
+
+// wait up to timeout for a sync request's report, nil if none arrived
+func (r RedisConfiguration) popSyncReply(ctx context.Context, request string, timeout time.Duration) ([]byte, error) {
+	return r.blockingPop(ctx, r.key(keySync, "reply:"+request), timeout)
+}
+
+// pop the head of a list, waiting up to timeout for one to be pushed
+func (r RedisConfiguration) blockingPop(ctx context.Context, key string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout+redisTimeout)
+	defer cancel()
+
+	reply, err := redis.ByteSlices(r.exec(ctx, "BLPOP", key, int(timeout.Seconds())))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
 	if err != nil {
-		log.Fatal("redis.canCallApi():", err)
-		return false
+		return nil, err
 	}
-	if exists == 1 {
-		return false
-	} else {
-		return true
+	return reply[1], nil
+}
+
+// watch whitelist expiry
+func (r RedisConfiguration) watchExpiry(expired func(user string)) {
+	for {
+		err := r.subscribeExpiry(expired)
+		log.Print("redis.watchExpiry(): ", err, ", resubscribing in 5 seconds")
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// subscribe to whitelist expiry events, calling expired with each expired user
+// until the connection fails
+func (r RedisConfiguration) subscribeExpiry(expired func(user string)) error {
+	// subscriptions hold their connection, so this doesn't use the pool
+	conn, err := r.dial(context.Background(), r.DB)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// expired events are off by default. The setting is server-wide, so it's
+	// only changed with configure_events; managed services such as Azure
+	// Cache refuse CONFIG, there it has to be set on the server
+	current, err := redis.StringMap(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err == nil {
+		if flags, changed := expiryNotifyFlags(current["notify-keyspace-events"]); changed {
+			if r.ConfigureEvents {
+				_, err = conn.Do("CONFIG", "SET", "notify-keyspace-events", flags)
+			} else {
+				log.Print("redis.subscribeExpiry(): notify-keyspace-events is '" + current["notify-keyspace-events"] + "', without expired events, expired whitelistings are removed by the sweep sync; set it to 'Ex' on the server, or redis.configure_events to let the app do it")
+			}
+		}
+	}
+	if err != nil {
+		log.Print("redis.subscribeExpiry(): could not check expiry events, set notify-keyspace-events to 'Ex' on the server: ", err)
+	}
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe("__keyevent@" + strconv.Itoa(r.DB) + "__:expired"); err != nil {
+		return err
+	}
+	log.Print("redis.subscribeExpiry(): watching for expired whitelistings")
+
+	// the database is shared, only whitelist keys are ours to act on
+	whitelistKey := r.key(keyWhitelist, "")
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			if key := string(v.Data); strings.HasPrefix(key, whitelistKey) {
+				expired(strings.TrimPrefix(key, whitelistKey))
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+// expiryNotifyFlags adds keyevent expired notifications to the server's
+// notify-keyspace-events flags, keeping any already enabled.
+func expiryNotifyFlags(flags string) (string, bool) {
+	changed := false
+	if !strings.Contains(flags, "E") {
+		flags += "E"
+		changed = true
+	}
+	if !strings.Contains(flags, "x") && !strings.Contains(flags, "A") {
+		flags += "x"
+		changed = true
+	}
+	return flags, changed
+}
+
+// legacyDatabases are the databases the old layout kept each kind of key in,
+// unprefixed. API throttling (db2) only lives for two minutes and isn't moved.
+var legacyDatabases = []struct {
+	db    int
+	kind  string
+	valid func(value string) bool
+}{
+	{0, keyWhitelist, func(v string) bool {
+		_, _, err := net.ParseCIDR(v)
+		return err == nil
+	}},
+	{1, keyGroups, func(v string) bool {
+		var g []string
+		return json.Unmarshal([]byte(v), &g) == nil
+	}},
+}
+
+// migrate moves keys from the old layout, one database per kind of key, to
+// prefixed keys in the configured database, keeping their expiry. It runs
+// once: afterwards a marker key is set. Only keys whose value looks like the
+// kind being moved are touched, in case the databases hold other data.
+func (r RedisConfiguration) migrate(ctx context.Context) error {
+	marker := r.Prefix + "layout"
+	done, err := redis.Int(r.exec(ctx, "EXISTS", marker))
+	if err != nil || done == 1 {
+		return err
+	}
+
+	moved := 0
+	for _, legacy := range legacyDatabases {
+		n, err := r.migrateDatabase(ctx, legacy.db, legacy.kind, legacy.valid)
+		moved += n
+		if err != nil && legacy.db == r.DB {
+			return err
+		}
+		if err != nil {
+			// managed redis may not allow other databases, which means the
+			// old layout can't have been used there
+			log.Printf("redis.migrate(): skipping db%d: %v", legacy.db, err)
+		}
 	}
+
+	if _, err := r.exec(ctx, "SET", marker, "2"); err != nil {
+		return err
+	}
+	if moved != 0 {
+		log.Printf("redis.migrate(): moved %d keys to the '%s' prefix in db%d", moved, r.Prefix, r.DB)
+	}
+	return nil
 }
 
-// keep alive
-func (r RedisConfiguration) keepAlive() {
-	// run every 5 minutes
-	for range time.Tick(time.Minute * 5) {
-		for db := 0; db <= (redisDBCount - 1); db++ {
-			_, err := redis.Strings(r.exec(db, "KEYS", "1"))
+// migrateDatabase moves the valid unprefixed keys of database db under kind.
+func (r RedisConfiguration) migrateDatabase(ctx context.Context, db int, kind string, valid func(string) bool) (int, error) {
+	conn, err := r.dial(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	moved := 0
+	cursor := 0
+	for {
+		reply, err := redis.Values(redis.DoContext(conn, ctx, "SCAN", cursor, "COUNT", 100))
+		if err != nil {
+			return moved, err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return moved, err
+		}
+
+		for _, key := range keys {
+			if strings.HasPrefix(key, r.Prefix) {
+				continue
+			}
+			// anything that isn't a string, or has gone, isn't ours
+			value, err := redis.String(redis.DoContext(conn, ctx, "GET", key))
+			if err != nil || !valid(value) {
+				continue
+			}
+			ttl, err := redis.Int64(redis.DoContext(conn, ctx, "PTTL", key))
 			if err != nil {
-				log.Fatal("redis.keepAlive(): ", err)
+				return moved, err
+			}
+			if ttl == -2 {
+				// expired since the GET
+				continue
 			}
+
+			args := []interface{}{r.key(kind, key), value}
+			if ttl > 0 {
+				args = append(args, "PX", ttl)
+			}
+			if _, err := r.exec(ctx, "SET", args...); err != nil {
+				return moved, err
+			}
+			if _, err := redis.DoContext(conn, ctx, "DEL", key); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+
+		if cursor == 0 {
+			return moved, nil
 		}
 	}
 }
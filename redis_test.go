@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http/httptest"
 	"os"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/ory/dockertest/v3"
 	"github.com/ory/dockertest/v3/docker"
 )
@@ -137,9 +140,25 @@ func TestAddIp(t *testing.T) {
 	ret := r.connect(rc)
 	if ret == true {
 		for _, f := range users {
-			ret = r.addIp(f.user, f.cidr)
-			if ret != f.success {
-				t.Errorf("redis.addIp(): Add user ip %v, got '%v', want '%v'", f, ret, f.success)
+			err := r.addIp(context.Background(), f.user, f.cidr, 24*time.Hour)
+			if (err == nil) != f.success {
+				t.Errorf("redis.addIp(): Add user ip %v, got '%v', want success '%v'", f, err, f.success)
+			}
+			// the keys carry their expiry from the start
+			for _, key := range []string{r.key(keyWhitelist, f.user), r.key(keySince, f.user)} {
+				if ttl, _ := redis.Int(r.exec(context.Background(), "TTL", key)); ttl <= 0 || ttl > 24*3600 {
+					t.Errorf("redis.addIp(): '%s' expires in %ds, want within 24h", key, ttl)
+				}
+			}
+		}
+
+		// under a second left must not expire the keys straight away
+		if err := r.setIpExpiry(context.Background(), "testuser111111", 500*time.Millisecond); err != nil {
+			t.Errorf("redis.setIpExpiry(): %v", err)
+		}
+		for _, key := range []string{r.key(keyWhitelist, "testuser111111"), r.key(keySince, "testuser111111")} {
+			if ttl, _ := redis.Int(r.exec(context.Background(), "PTTL", key)); ttl <= 0 || ttl > 500 {
+				t.Errorf("redis.setIpExpiry(): '%s' expires in %dms, want within 500ms", key, ttl)
 			}
 		}
 	}
@@ -168,11 +187,11 @@ func TestDeleteIp(t *testing.T) {
 	ret := r.connect(rc)
 	if ret == true {
 		for _, f := range users {
-			ret = r.addIp(f.user, f.cidr)
-			if ret == f.success {
-				ret = r.deleteIp(f.user)
-				if ret != true {
-					t.Errorf("redis.deleteIp(): Delete user ip %v, want '%v', got '%v'", f, ret, f.success)
+			err := r.addIp(context.Background(), f.user, f.cidr, 24*time.Hour)
+			if (err == nil) == f.success {
+				err = r.deleteIp(context.Background(), f.user)
+				if err != nil {
+					t.Errorf("redis.deleteIp(): Delete user ip %v, got '%v', want success", f, err)
 				}
 			}
 		}
@@ -201,9 +220,11 @@ func TestGetWhitelist(t *testing.T) {
 	ret := r.connect(rc)
 	if ret == true {
 		for _, f := range users {
-			ret = r.addIp(f.user, f.cidr)
-			if ret == true {
-				ret := r.getWhitelist()
+			if err := r.addIp(context.Background(), f.user, f.cidr, 24*time.Hour); err == nil {
+				ret, err := r.getWhitelist(context.Background())
+				if err != nil {
+					t.Errorf("redis.getWhitelist(): %v", err)
+				}
 				if ret[f.user] != f.cidr {
 					t.Errorf("redis.getWhitelist(): Get whitelist %v, got '%v', want '%v'", f, f.cidr, ret[f.user])
 				}
@@ -232,9 +253,9 @@ func TestAddGroups(t *testing.T) {
 	ret := r.connect(rc)
 	if ret == true {
 		for _, f := range users {
-			ret = r.addGroups(f.user, f.groups)
-			if ret != f.success {
-				t.Errorf("redis.addGroups(): Add groups %v, got '%v', want '%v'", f, ret, f.success)
+			err := r.addGroups(context.Background(), f.user, f.groups, 24*time.Hour)
+			if (err == nil) != f.success {
+				t.Errorf("redis.addGroups(): Add groups %v, got '%v', want success '%v'", f, err, f.success)
 			}
 		}
 	}
@@ -252,19 +273,23 @@ func TestApiThrottle(t *testing.T) {
 	if ret == true {
 		const user = "testuser111111"
 
+		ctx := context.Background()
+
 		// a user that has never called the api may call it
-		if !r.canCallApi(user) {
+		if ok, _ := r.canCallApi(ctx, user); !ok {
 			t.Errorf("redis.canCallApi(): fresh user %q, got 'false', want 'true'", user)
 		}
 
 		// after recording a call, the user is throttled
-		r.apiCalled(user)
-		if r.canCallApi(user) {
+		if err := r.apiCalled(ctx, user); err != nil {
+			t.Errorf("redis.apiCalled(): %v", err)
+		}
+		if ok, _ := r.canCallApi(ctx, user); ok {
 			t.Errorf("redis.canCallApi(): throttled user %q, got 'true', want 'false'", user)
 		}
 
 		// a different user is unaffected by the throttle
-		if !r.canCallApi("testuser222222") {
+		if ok, _ := r.canCallApi(ctx, "testuser222222"); !ok {
 			t.Errorf("redis.canCallApi(): unrelated user, got 'false', want 'true'")
 		}
 	}
@@ -309,8 +334,7 @@ func TestGetGroups(t *testing.T) {
 	ret := r.connect(rc)
 	if ret == true {
 		for _, f := range users {
-			ret = r.addGroups(f.user, f.groups)
-			if ret == true {
+			if err := r.addGroups(context.Background(), f.user, f.groups, 24*time.Hour); err == nil {
 				ret := r.getGroups(f.user)
 				if len(ret) != f.success {
 					t.Errorf("redis.getWhitelist(): Get whitelist %v, got '%v', want '%v'", f, len(ret), f.success)
@@ -321,3 +345,251 @@ func TestGetGroups(t *testing.T) {
 
 	DeleteTestRedis(t, testRedisInstance)
 }
+
+func TestWhitelistedAt(t *testing.T) {
+	var testRedisInstance = CreateTestRedis(t)
+	var rc RedisConfiguration
+	rc.Host = testRedisInstance.Host
+	rc.Port = testRedisInstance.Port
+	rc.Token = testRedisInstance.Token
+	if !r.connect(rc) {
+		t.Fatal("could not connect to test redis")
+	}
+	defer DeleteTestRedis(t, testRedisInstance)
+	ctx := context.Background()
+
+	// an entry made before the index existed
+	if _, err := r.exec(ctx, "SET", r.key(keyWhitelist, "carol"), "203.0.113.9/32", "PX", time.Hour.Milliseconds()); err != nil {
+		t.Fatalf("redis.exec(): %v", err)
+	}
+	if err := r.indexWhitelist(ctx); err != nil {
+		t.Fatalf("redis.indexWhitelist(): %v", err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if err := r.addIp(ctx, user, "203.0.113.9/32", time.Hour); err != nil {
+			t.Fatalf("redis.addIp(): %v", err)
+		}
+	}
+	// bob moves on, alice's whitelisting is removed
+	if err := r.addIp(ctx, "bob", "198.51.100.7/32", time.Hour); err != nil {
+		t.Fatalf("redis.addIp(): %v", err)
+	}
+	if err := r.deleteIp(ctx, "alice"); err != nil {
+		t.Fatalf("redis.deleteIp(): %v", err)
+	}
+
+	if got, err := r.whitelistedAt(ctx, "203.0.113.9/32"); err != nil || len(got) != 1 || got["carol"] != "203.0.113.9/32" {
+		t.Errorf("redis.whitelistedAt(203.0.113.9/32) = %v, %v, want carol only", got, err)
+	}
+	if got, err := r.whitelistedAt(ctx, "198.51.100.7/32"); err != nil || len(got) != 1 || got["bob"] != "198.51.100.7/32" {
+		t.Errorf("redis.whitelistedAt(198.51.100.7/32) = %v, %v, want bob only", got, err)
+	}
+	if ttl, _ := redis.Int(r.exec(ctx, "TTL", r.key(keyIp, "198.51.100.7/32"))); ttl <= 0 || ttl > 3600 {
+		t.Errorf("index expires in %ds, want with bob's entry", ttl)
+	}
+}
+
+func TestWatchExpiry(t *testing.T) {
+	var testRedisInstance = CreateTestRedis(t)
+	var rc RedisConfiguration
+	rc.Host = testRedisInstance.Host
+	rc.Port = testRedisInstance.Port
+	rc.Token = testRedisInstance.Token
+	rc.ConfigureEvents = true // the test server starts with expiry events off
+	if r.connect(rc) {
+		expired := make(chan string, 1)
+		go r.watchExpiry(func(user string) { expired <- user })
+		time.Sleep(time.Second)
+
+		if _, err := r.exec(context.Background(), "SETEX", r.key(keyWhitelist, "testuser111111"), 1, "10.0.0.1/32"); err != nil {
+			t.Fatalf("redis.watchExpiry(): %v", err)
+		}
+		select {
+		case user := <-expired:
+			if user != "testuser111111" {
+				t.Errorf("redis.watchExpiry(): got expiry for '%v', want 'testuser111111'", user)
+			}
+		case <-time.After(10 * time.Second):
+			t.Error("redis.watchExpiry(): no expiry event received")
+		}
+	}
+
+	DeleteTestRedis(t, testRedisInstance)
+}
+
+func TestExpiryNotifyFlags(t *testing.T) {
+	tests := []struct {
+		flags   string
+		want    string
+		changed bool
+	}{
+		{"", "Ex", true},
+		{"Ex", "Ex", false},
+		{"KA", "KAE", true},
+		{"Kg", "KgEx", true},
+		{"AKE", "AKE", false},
+	}
+
+	for _, f := range tests {
+		got, changed := expiryNotifyFlags(f.flags)
+		if got != f.want || changed != f.changed {
+			t.Errorf("expiryNotifyFlags(%q) = %q, %v, want %q, %v", f.flags, got, changed, f.want, f.changed)
+		}
+	}
+}
+
+func TestExecNotConnected(t *testing.T) {
+	var rc RedisConfiguration
+	if _, err := rc.exec(context.Background(), "PING"); err != errRedisNotConnected {
+		t.Errorf("redis.exec(): not connected, got '%v', want '%v'", err, errRedisNotConnected)
+	}
+	if err := rc.ping(context.Background()); err != errRedisNotConnected {
+		t.Errorf("redis.ping(): not connected, got '%v', want '%v'", err, errRedisNotConnected)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	var testRedisInstance = CreateTestRedis(t)
+	addr := testRedisInstance.Host + ":" + strconv.Itoa(testRedisInstance.Port)
+
+	// the old layout: unprefixed keys, one database per kind
+	legacy := map[int][][2]string{
+		0: {{"testuser111111", "10.0.0.1/32"}, {"not-a-whitelisting", "some other app's value"}},
+		1: {{"testuser111111", `["group1"]`}},
+	}
+	for db, keys := range legacy {
+		conn, err := redis.Dial("tcp", addr, redis.DialPassword(testRedisInstance.Token), redis.DialDatabase(db))
+		if err != nil {
+			t.Fatalf("redis.migrate(): %v", err)
+		}
+		for _, kv := range keys {
+			if _, err := conn.Do("SET", kv[0], kv[1], "EX", 3600); err != nil {
+				t.Fatalf("redis.migrate(): %v", err)
+			}
+		}
+		conn.Close()
+	}
+
+	var rc RedisConfiguration
+	rc.Host = testRedisInstance.Host
+	rc.Port = testRedisInstance.Port
+	rc.Token = testRedisInstance.Token
+	ctx := context.Background()
+	if r.connect(rc) {
+		if list, _ := r.getWhitelist(ctx); len(list) != 0 {
+			t.Errorf("redis.migrate(): whitelist without migrate, got '%v', want nothing moved", list)
+		}
+	}
+
+	rc.Migrate = true
+	if r.connect(rc) {
+		if list, _ := r.getWhitelist(ctx); len(list) != 1 || list["testuser111111"] != "10.0.0.1/32" {
+			t.Errorf("redis.migrate(): whitelist after migration, got '%v'", list)
+		}
+		if groups := r.getGroups("testuser111111"); len(groups) != 1 || groups[0] != "group1" {
+			t.Errorf("redis.migrate(): groups after migration, got '%v'", groups)
+		}
+		if ttl, _ := redis.Int(r.exec(ctx, "TTL", r.key(keyWhitelist, "testuser111111"))); ttl <= 0 || ttl > 3600 {
+			t.Errorf("redis.migrate(): whitelisting ttl after migration, got '%v', want it kept", ttl)
+		}
+		if value, _ := redis.String(r.exec(ctx, "GET", "not-a-whitelisting")); value != "some other app's value" {
+			t.Errorf("redis.migrate(): unrelated key was moved, got '%v'", value)
+		}
+	}
+
+	DeleteTestRedis(t, testRedisInstance)
+}
+
+func TestLeaderLease(t *testing.T) {
+	var testRedisInstance = CreateTestRedis(t)
+
+	var rc RedisConfiguration
+	rc.Host = testRedisInstance.Host
+	rc.Port = testRedisInstance.Port
+	rc.Token = testRedisInstance.Token
+	if r.connect(rc) {
+		ctx := context.Background()
+		lease := 2 * time.Second
+
+		if ok, err := r.acquireLease(ctx, "replica-a", lease); !ok || err != nil {
+			t.Fatalf("redis.acquireLease(): first replica, got '%v' '%v', want true", ok, err)
+		}
+		if ok, err := r.acquireLease(ctx, "replica-b", lease); ok || err != nil {
+			t.Errorf("redis.acquireLease(): while held, got '%v' '%v', want false", ok, err)
+		}
+		if ok, err := r.renewLease(ctx, "replica-b", lease); ok || err != nil {
+			t.Errorf("redis.renewLease(): by another replica, got '%v' '%v', want false", ok, err)
+		}
+		if ok, err := r.renewLease(ctx, "replica-a", lease); !ok || err != nil {
+			t.Errorf("redis.renewLease(): by the holder, got '%v' '%v', want true", ok, err)
+		}
+
+		// once the holder stops renewing, another replica takes over
+		time.Sleep(lease + 500*time.Millisecond)
+		if ok, err := r.acquireLease(ctx, "replica-b", lease); !ok || err != nil {
+			t.Errorf("redis.acquireLease(): after expiry, got '%v' '%v', want true", ok, err)
+		}
+		if ok, _ := r.renewLease(ctx, "replica-a", lease); ok {
+			t.Errorf("redis.renewLease(): by the old holder, got true, want false")
+		}
+
+		if err := r.pushSyncRequest(ctx, []byte(`{"id":"req"}`)); err != nil {
+			t.Fatalf("redis.pushSyncRequest(): %v", err)
+		}
+		if b, err := r.popSyncRequest(ctx, time.Second); string(b) != `{"id":"req"}` || err != nil {
+			t.Errorf("redis.popSyncRequest(): got '%s' '%v'", b, err)
+		}
+		if b, err := r.popSyncReply(ctx, "req", time.Second); b != nil || err != nil {
+			t.Errorf("redis.popSyncReply(): with no reply, got '%s' '%v', want nil", b, err)
+		}
+		if err := r.pushSyncReply(ctx, "req", []byte("{}")); err != nil {
+			t.Fatalf("redis.pushSyncReply(): %v", err)
+		}
+		if b, err := r.popSyncReply(ctx, "req", time.Second); string(b) != "{}" || err != nil {
+			t.Errorf("redis.popSyncReply(): got '%s' '%v'", b, err)
+		}
+	}
+
+	DeleteTestRedis(t, testRedisInstance)
+}
+
+func TestRedisStore(t *testing.T) {
+	var testRedisInstance = CreateTestRedis(t)
+
+	var rc RedisConfiguration
+	rc.Host = testRedisInstance.Host
+	rc.Port = testRedisInstance.Port
+	rc.Token = testRedisInstance.Token
+	if r.connect(rc) {
+		st := newRedisStore(sessionKeyPairs([]string{"test-session-key"})...)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		rr := httptest.NewRecorder()
+		session, _ := st.Get(req, "session")
+		session.Values["ip_address"] = "203.0.113.7"
+		if err := session.Save(req, rr); err != nil {
+			t.Fatalf("RedisStore.Save(): %v", err)
+		}
+
+		// the cookie only carries the id, the values come from redis
+		req = httptest.NewRequest("GET", "/", nil)
+		for _, cookie := range rr.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		loaded, err := st.Get(req, "session")
+		if err != nil || loaded.IsNew || loaded.Values["ip_address"] != "203.0.113.7" {
+			t.Errorf("RedisStore.Get(): got %v %v, want the saved session", loaded.Values, err)
+		}
+
+		// deleting it removes it from redis
+		loaded.Options.MaxAge = -1
+		if err := loaded.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatalf("RedisStore.Save(): %v", err)
+		}
+		if b, _ := r.getSession(context.Background(), loaded.ID); b != nil {
+			t.Errorf("RedisStore.Save(): deleted session still in redis")
+		}
+	}
+
+	DeleteTestRedis(t, testRedisInstance)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// Error classes, deciding whether and how a failed update is retried.
+const (
+	errThrottled = "throttled" // 429, retried honouring Retry-After
+	errConflict  = "conflict"  // 409/412, another operation holds the resource
+	errTransient = "transient" // 5xx, timeouts and network failures
+	errAuth      = "auth"      // 401/403 and token failures, not retried
+	errPermanent = "permanent" // anything else, not retried
+)
+
+// statusError is an unsuccessful HTTP response from a resource's API.
+type statusError struct {
+	msg    string
+	code   int
+	header http.Header
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// newStatusError describes resp's status as an error prefixed with what.
+func newStatusError(what string, resp *http.Response) error {
+	return &statusError{msg: what + ": status " + strconv.Itoa(resp.StatusCode), code: resp.StatusCode, header: resp.Header}
+}
+
+// errorStatus returns the HTTP status behind err and its response headers, or
+// 0 when err didn't come from an HTTP response.
+func errorStatus(err error) (int, http.Header) {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code, se.header
+	}
+
+	var de autorest.DetailedError
+	if !errors.As(err, &de) {
+		var re *azure.RequestError
+		if !errors.As(err, &re) {
+			return 0, nil
+		}
+		de = re.DetailedError
+	}
+	code, _ := de.StatusCode.(int)
+	if code == 0 && de.Response != nil {
+		code = de.Response.StatusCode
+	}
+	var header http.Header
+	if de.Response != nil {
+		header = de.Response.Header
+	}
+	return code, header
+}
+
+// classifyError sorts an update error into one of the error classes.
+func classifyError(err error) string {
+	var tre adal.TokenRefreshError
+	if errors.As(err, &tre) {
+		return errAuth
+	}
+
+	code, _ := errorStatus(err)
+	switch {
+	case code == http.StatusTooManyRequests:
+		return errThrottled
+	case code == http.StatusConflict || code == http.StatusPreconditionFailed:
+		return errConflict
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return errAuth
+	case code == http.StatusRequestTimeout || code >= 500:
+		return errTransient
+	case code != 0:
+		return errPermanent
+	}
+
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) {
+		return errTransient
+	}
+	return errPermanent
+}
+
+// retryable reports whether errors of class are worth retrying.
+func retryable(class string) bool {
+	return class == errThrottled || class == errConflict || class == errTransient
+}
+
+// retryAfter returns the delay asked for by a Retry-After header on err's
+// response, or 0.
+func retryAfter(err error) time.Duration {
+	_, header := errorStatus(err)
+	if header == nil {
+		return 0
+	}
+	v := header.Get("Retry-After")
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// backoff returns how long to wait before retry attempt (1 for the first
+// retry): base doubled per attempt and capped at max, with the upper half
+// randomised so resources failing together don't retry together. A longer
+// Retry-After wins.
+func backoff(rc RetryConfiguration, attempt int, after time.Duration, jitter func() float64) time.Duration {
+	base := time.Duration(rc.Base) * time.Second
+	max := time.Duration(rc.Max) * time.Second
+
+	d := max
+	if exp := math.Pow(2, float64(attempt-1)); exp < float64(max/base) {
+		d = base * time.Duration(exp)
+	}
+	d = d/2 + time.Duration(jitter()*float64(d/2))
+
+	if after > d {
+		return after
+	}
+	return d
+}
+
+// PendingRetry is a resource update waiting to be retried.
+type PendingRetry struct {
+	Resource  string    `json:"resource"`
+	Attempt   int       `json:"attempt"`
+	Due       time.Time `json:"due"`
+	Class     string    `json:"class"`
+	LastError string    `json:"last_error"`
+}
+
+// Retries schedules failed resource updates for retry. With persist set,
+// pending retries are kept in Redis so a restart doesn't lose them.
+type Retries struct {
+	mu      sync.Mutex
+	pending map[string]PendingRetry
+	persist bool
+	jitter  func() float64
+}
+
+// load restores the pending retries saved in Redis and persists from now on.
+func (q *Retries) load() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.persist = true
+	q.pending = make(map[string]PendingRetry)
+
+	ctx, cancel := redisContext()
+	defer cancel()
+	saved, err := r.getRetries(ctx)
+	if err != nil {
+		log.Print("retry.load(): could not restore pending retries: ", err)
+	}
+	for id, v := range saved {
+		var pr PendingRetry
+		if err := json.Unmarshal([]byte(v), &pr); err != nil {
+			log.Print("retry.load(): dropping unreadable retry for '"+id+"': ", err)
+			if err := r.deleteRetry(ctx, id); err != nil {
+				log.Print("retry.load(): ", err)
+			}
+			continue
+		}
+		q.pending[id] = pr
+	}
+	if len(q.pending) != 0 {
+		log.Printf("retry.load(): %d pending retries restored", len(q.pending))
+	}
+	m.set("ip_whitelister_retries_pending", nil, float64(len(q.pending)))
+}
+
+// record updates the schedule from a sync report: resources that updated are
+// cleared, retryable failures are scheduled again with a longer backoff, and
+// anything else is dropped until the next sync.
+func (q *Retries) record(report SyncReport) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending == nil {
+		q.pending = make(map[string]PendingRetry)
+	}
+	if q.jitter == nil {
+		q.jitter = rand.Float64
+	}
+	rc := applySyncDefaults(c.Sync).Retry
+
+	for _, res := range report.Results {
+		if res.Err == nil {
+			q.clear(res.Resource)
+			continue
+		}
+
+		class := classifyError(res.Err)
+		if !retryable(class) {
+			log.Print("retry.record(): not retrying '" + res.Resource + "', " + class + " error")
+			q.clear(res.Resource)
+			continue
+		}
+
+		pr := q.pending[res.Resource]
+		pr.Resource = res.Resource
+		pr.Attempt++
+		if pr.Attempt > rc.Attempts {
+			log.Printf("retry.record(): giving up on '%s' after %d attempts: %v", res.Resource, rc.Attempts, res.Err)
+			m.add("ip_whitelister_retries_exhausted_total", map[string]string{"resource": res.Resource}, 1)
+			q.clear(res.Resource)
+			continue
+		}
+		delay := backoff(rc, pr.Attempt, retryAfter(res.Err), q.jitter)
+		pr.Due = time.Now().Add(delay)
+		pr.Class = class
+		pr.LastError = res.Err.Error()
+		q.pending[res.Resource] = pr
+		log.Printf("retry.record(): %s error on '%s', retry %d of %d in %v", class, res.Resource, pr.Attempt, rc.Attempts, delay.Round(time.Second))
+		m.add("ip_whitelister_retries_total", map[string]string{"resource": res.Resource, "class": class}, 1)
+
+		if q.persist {
+			q.save(pr)
+		}
+	}
+	m.set("ip_whitelister_retries_pending", nil, float64(len(q.pending)))
+}
+
+// clear drops a resource's pending retry. Callers must hold q.mu.
+func (q *Retries) clear(id string) {
+	if _, ok := q.pending[id]; !ok {
+		return
+	}
+	delete(q.pending, id)
+	if q.persist {
+		ctx, cancel := redisContext()
+		defer cancel()
+		if err := r.deleteRetry(ctx, id); err != nil {
+			log.Print("retry.clear(): ", err)
+		}
+	}
+}
+
+// save stores a pending retry in Redis.
+func (q *Retries) save(pr PendingRetry) {
+	v, err := json.Marshal(pr)
+	if err != nil {
+		log.Print("retry.save(): ", err)
+		return
+	}
+	ctx, cancel := redisContext()
+	defer cancel()
+	if err := r.setRetry(ctx, pr.Resource, v); err != nil {
+		log.Print("retry.save(): ", err)
+	}
+}
+
+// due returns the ids of the resources whose retry is due at now.
+func (q *Retries) due(now time.Time) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var ids []string
+	for _, id := range sortedKeys(q.pending) {
+		if !q.pending[id].Due.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// list returns every pending retry, ordered by resource.
+func (q *Retries) list() []PendingRetry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := []PendingRetry{}
+	for _, id := range sortedKeys(q.pending) {
+		list = append(list, q.pending[id])
+	}
+	return list
+}
+
+// retryDue updates the resources whose retry is due against a fresh snapshot
+// of the whitelist. Retries for resources no longer configured are dropped.
+func (q *Retries) retryDue() {
+	ids := q.due(time.Now())
+	if len(ids) == 0 {
+		return
+	}
+
+	byId := make(map[string]Resource)
+	for _, res := range p.enabled() {
+		byId[res.id()] = res
+	}
+	var resources []Resource
+	for _, id := range ids {
+		if res, ok := byId[id]; ok {
+			resources = append(resources, res)
+			continue
+		}
+		q.mu.Lock()
+		q.clear(id)
+		q.mu.Unlock()
+	}
+	if len(resources) == 0 {
+		return
+	}
+
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	ctx, cancel := redisContext()
+	read := time.Now()
+	list, err := r.getWhitelist(ctx)
+	cancel()
+	if err != nil {
+		// leave the retries pending, they're tried again on the next tick
+		log.Print("retry.retryDue(): could not read the whitelist: ", err)
+		return
+	}
+
+	log.Printf("retry.retryDue(): retrying %d resources", len(resources))
+	sc := applySyncDefaults(c.Sync)
+	report := reconcile(context.Background(), resources, list, sc.Concurrency, syncTimeout())
+	q.record(report)
+	recordSyncStatus(report, read)
+}
+
+// retry checks for due retries every 10 seconds, while leading.
+func (q *Retries) retry() {
+	for range time.Tick(10 * time.Second) {
+		if l.leading() {
+			q.retryDue()
+		}
+	}
+}
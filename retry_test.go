@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+func TestClassifyError(t *testing.T) {
+	resp := func(code int) *http.Response {
+		return &http.Response{StatusCode: code, Header: http.Header{}}
+	}
+	azureErr := func(code int) error {
+		// how the SDK clients report a failed response
+		re := &azure.RequestError{DetailedError: autorest.DetailedError{StatusCode: code}}
+		return autorest.NewErrorWithError(re, "keyvault.VaultsClient", "Update", resp(code), "Failure responding to request")
+	}
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{azureErr(429), errThrottled},
+		{azureErr(409), errConflict},
+		{azureErr(412), errConflict},
+		{azureErr(503), errTransient},
+		{azureErr(401), errAuth},
+		{azureErr(403), errAuth},
+		{azureErr(400), errPermanent},
+		{&azure.RequestError{DetailedError: autorest.DetailedError{StatusCode: 500}}, errTransient},
+		{newStatusError("unifi updateFirewallGroup failed", resp(502)), errTransient},
+		{fmt.Errorf("wrapped: %w", newStatusError("unifi login failed", resp(429))), errThrottled},
+		{newStatusError("unifi GET", resp(401)), errAuth},
+		{newStatusError("unifi getFirewallGroup failed", resp(404)), errPermanent},
+		{context.DeadlineExceeded, errTransient},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, errTransient},
+		{errors.New("unifi network list 'x' not found"), errPermanent},
+	}
+
+	for _, f := range tests {
+		if got := classifyError(f.err); got != f.want {
+			t.Errorf("classifyError(%v) = %q, want %q", f.err, got, f.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "120")
+	err := newStatusError("unifi PUT", &http.Response{StatusCode: 429, Header: header})
+	if got := retryAfter(err); got != 2*time.Minute {
+		t.Errorf("retryAfter() = %v, want 2m", got)
+	}
+	if got := retryAfter(errors.New("boom")); got != 0 {
+		t.Errorf("retryAfter() without a response = %v, want 0", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	rc := RetryConfiguration{Attempts: 8, Base: 30, Max: 300}
+	none := func() float64 { return 0 }
+	full := func() float64 { return 1 }
+
+	tests := []struct {
+		attempt int
+		after   time.Duration
+		jitter  func() float64
+		want    time.Duration
+	}{
+		{1, 0, full, 30 * time.Second},
+		{1, 0, none, 15 * time.Second},
+		{2, 0, full, time.Minute},
+		{4, 0, full, 240 * time.Second},
+		{5, 0, full, 300 * time.Second}, // capped
+		{50, 0, none, 150 * time.Second},
+		{1, 10 * time.Minute, full, 10 * time.Minute}, // Retry-After wins
+	}
+
+	for _, f := range tests {
+		if got := backoff(rc, f.attempt, f.after, f.jitter); got != f.want {
+			t.Errorf("backoff(attempt %d, after %v) = %v, want %v", f.attempt, f.after, got, f.want)
+		}
+	}
+}
+
+func TestRetriesRecord(t *testing.T) {
+	c.Sync = SyncConfiguration{Retry: RetryConfiguration{Attempts: 2, Base: 10, Max: 60}}
+	defer func() { c.Sync = SyncConfiguration{}; m = Metrics{} }()
+
+	q := Retries{jitter: func() float64 { return 1 }}
+	throttled := newStatusError("unifi PUT", &http.Response{StatusCode: 429})
+	report := SyncReport{Results: []SyncResult{
+		{Resource: "fake/ok"},
+		{Resource: "fake/busy", Err: throttled},
+		{Resource: "fake/denied", Err: newStatusError("unifi PUT", &http.Response{StatusCode: 403})},
+	}}
+
+	start := time.Now()
+	q.record(report)
+	list := q.list()
+	if len(list) != 1 || list[0].Resource != "fake/busy" || list[0].Attempt != 1 || list[0].Class != errThrottled {
+		t.Fatalf("pending after first failure = %+v, want only fake/busy on attempt 1", list)
+	}
+	if due := list[0].Due.Sub(start); due < 10*time.Second || due > 11*time.Second {
+		t.Errorf("first retry due in %v, want 10s", due)
+	}
+	if ids := q.due(start); len(ids) != 0 {
+		t.Errorf("due(now) = %v, want nothing yet", ids)
+	}
+	if ids := q.due(start.Add(time.Minute)); len(ids) != 1 || ids[0] != "fake/busy" {
+		t.Errorf("due(later) = %v, want fake/busy", ids)
+	}
+
+	failAgain := SyncReport{Results: []SyncResult{{Resource: "fake/busy", Err: throttled}}}
+	q.record(failAgain)
+	if list := q.list(); len(list) != 1 || list[0].Attempt != 2 {
+		t.Fatalf("pending after second failure = %+v, want attempt 2", list)
+	}
+	q.record(failAgain)
+	if list := q.list(); len(list) != 0 {
+		t.Errorf("pending after exhausting attempts = %+v, want none", list)
+	}
+
+	q.record(failAgain)
+	q.record(SyncReport{Results: []SyncResult{{Resource: "fake/busy"}}})
+	if list := q.list(); len(list) != 0 {
+		t.Errorf("pending after a successful update = %+v, want none", list)
+	}
+}
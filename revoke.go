@@ -0,0 +1,93 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// Revocation is the outcome of removing a whitelisting: whether the IP has
+// been taken off each resource it was on.
+type Revocation struct {
+	IP        string            `json:"ip"`
+	Resources []RevokedResource `json:"resources"`
+}
+
+// RevokedResource is whether a revoked IP is off a resource yet. Resources it
+// couldn't be removed from are retried, and the failure is logged.
+type RevokedResource struct {
+	Id      string `json:"id"`
+	Removed bool   `json:"removed"`
+}
+
+var revokedTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Dynamic IP Whitelist</title>
+
+    <link href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.7/css/bootstrap.min.css" rel="stylesheet" integrity="sha384-BVYiiSIFeK1dGmJRAkycuHAHRg32OmUcww7on3RYdg4Va+PmSTsz/K68vbdEjh4u" crossorigin="anonymous">
+  </head>
+  <body class="container-fluid">
+    <div class="row">
+      <div class="col-xs-4 col-xs-offset-4">
+        <h1>Dynamic IP Whitelist</h1>
+        Your whitelisting for {{.IP}} has been removed.
+{{if .Resources}}
+        <ul class="list-unstyled">
+{{range .Resources}}
+          <li>{{.Id}}: {{if .Removed}}<span class="text-success">removed</span>{{else}}<span class="text-warning">not removed yet, it will be retried</span>{{end}}</li>
+{{end}}
+        </ul>
+{{end}}
+        <br>
+        <a href="/?new=true">Whitelist again</a>
+      </div>
+    </div>
+  </body>
+</html>
+`))
+
+// revokeHandler removes the signed-in user's whitelisting, from the form on
+// the welcome page, and shows which resources the IP has been taken off.
+func revokeHandler(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	u, _, err := apiCaller(req)
+	if err != nil {
+		return err
+	}
+	rv, err := revoke(req, u)
+	if err != nil {
+		return err
+	}
+
+	// the welcome page no longer applies
+	session, _ := store.Get(req, "session")
+	delete(session.Values, "token")
+	delete(session.Values, "ip_address")
+	session.Save(req, w)
+
+	return revokedTempl.Execute(w, rv)
+}
+
+// revoke removes u's whitelisting, 404 when they have none, and reports the
+// resources it was removed from.
+func revoke(req *http.Request, u *User) (Revocation, error) {
+	wl, err := currentWhitelisting(req, u)
+	if err != nil {
+		return Revocation{}, err
+	}
+	report, ok := u.unwhitelist()
+	if !ok {
+		return Revocation{}, Error{Code: http.StatusServiceUnavailable, Message: "could not remove the whitelisting"}
+	}
+	return newRevocation(wl.IP, report), nil
+}
+
+func newRevocation(ip string, report SyncReport) Revocation {
+	rv := Revocation{IP: ip, Resources: []RevokedResource{}}
+	for _, res := range report.Results {
+		rv.Resources = append(rv.Resources, RevokedResource{Id: res.Resource, Removed: res.Err == nil})
+	}
+	return rv
+}
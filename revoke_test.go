@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNewRevocation(t *testing.T) {
+	report := SyncReport{Results: []SyncResult{
+		{Resource: "unifi/networklist/default/office"},
+		{Resource: "azure/keyvault/rg/kv", Err: errors.New("403 Forbidden")},
+	}}
+	want := Revocation{IP: "203.0.113.9/32", Resources: []RevokedResource{
+		{Id: "unifi/networklist/default/office", Removed: true},
+		{Id: "azure/keyvault/rg/kv", Removed: false},
+	}}
+	if got := newRevocation("203.0.113.9/32", report); !reflect.DeepEqual(got, want) {
+		t.Errorf("newRevocation() = %+v, want %+v", got, want)
+	}
+
+	// nothing to sync still lists no resources rather than null
+	if got := newRevocation("203.0.113.9/32", SyncReport{}); got.Resources == nil || len(got.Resources) != 0 {
+		t.Errorf("newRevocation() with an empty report = %+v, want an empty list", got)
+	}
+}
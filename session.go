@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+type SessionConfiguration struct {
+	Store string `yaml:"store"` // 'redis' (default) or 'filesystem'
+	Path  string `yaml:"path"`  // directory the filesystem store writes to, default /tmp
+	// Keys sign and encrypt session cookies. The first key is used for new
+	// cookies, the rest are still accepted, so a key can be rotated by
+	// putting the new one first and dropping the old one after max_age.
+	Keys []string `yaml:"keys"`
+}
+
+// sessionKeyPairs derives an authentication and an encryption key from each
+// configured secret, in order.
+func sessionKeyPairs(keys []string) [][]byte {
+	var pairs [][]byte
+	for _, k := range keys {
+		pairs = append(pairs, deriveKey(k, "session authentication"), deriveKey(k, "session encryption"))
+	}
+	return pairs
+}
+
+func deriveKey(secret string, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// sessionMaxAge is how long a session lasts, in seconds: as long as the
+// longest whitelisting, so renewals from it cover all of it.
+func sessionMaxAge() int {
+	if maxTTL() <= 0 {
+		return 86400
+	}
+	return maxTTL() * 3600
+}
+
+// sessionOptions are the session cookie's attributes. SameSite is lax so the
+// cookie comes back on the redirect from the identity provider.
+func sessionOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   sessionMaxAge(),
+		Secure:   strings.HasPrefix(c.Url, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// newSessionStore returns the configured session store.
+func newSessionStore(sc SessionConfiguration) sessions.Store {
+	keys := sc.Keys
+	if len(keys) == 0 {
+		log.Print("session.newSessionStore(): no session keys configured, using a random key; sessions won't survive a restart or work across replicas")
+		keys = []string{randomString(32)}
+	}
+	for i, k := range keys {
+		if len(k) < 32 {
+			log.Printf("session.newSessionStore(): session key %d is shorter than 32 characters", i+1)
+		}
+	}
+	pairs := sessionKeyPairs(keys)
+
+	switch strings.ToLower(sc.Store) {
+	case "filesystem":
+		path := sc.Path
+		if path == "" {
+			path = "/tmp"
+		}
+		fsStore := sessions.NewFilesystemStore(path, pairs...)
+		fsStore.MaxLength(0)
+		fsStore.Options = sessionOptions()
+		fsStore.MaxAge(fsStore.Options.MaxAge)
+		return fsStore
+	case "", "redis":
+		return newRedisStore(pairs...)
+	default:
+		log.Fatalln("session.newSessionStore(): unsupported session store '" + sc.Store + "'")
+		return nil
+	}
+}
+
+// RedisStore keeps sessions in redis, so every replica shares them. The
+// cookie only holds the signed and encrypted session id.
+type RedisStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newRedisStore(keyPairs ...[]byte) *RedisStore {
+	st := &RedisStore{
+		Codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		Options: sessionOptions(),
+	}
+	for _, codec := range st.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(st.Options.MaxAge)
+		}
+	}
+	return st
+}
+
+// Get returns the named session, cached for the request.
+func (st *RedisStore) Get(req *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(req).Get(st, name)
+}
+
+// New loads the session named by the request's cookie, or returns a new one
+// when there's no cookie, it can't be decoded or the session has expired.
+func (st *RedisStore) New(req *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(st, name)
+	opts := *st.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, st.Codecs...); err != nil {
+		session.ID = ""
+		return session, err
+	}
+
+	b, err := r.getSession(req.Context(), session.ID)
+	if err != nil || b == nil {
+		return session, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session in redis and sets its cookie, or deletes both when
+// the session's MaxAge is negative.
+func (st *RedisStore) Save(req *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := r.deleteSession(req.Context(), session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = randomString(32)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if ttl == 0 {
+		ttl = time.Duration(sessionMaxAge()) * time.Second
+	}
+	if err := r.setSession(req.Context(), session.ID, buf.Bytes(), ttl); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, st.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
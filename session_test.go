@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestSessionKeyRotation(t *testing.T) {
+	old := newRedisStore(sessionKeyPairs([]string{"old-key-old-key-old-key-old-key-"})...)
+	encoded, err := securecookie.EncodeMulti("session", "session-id", old.Codecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keys    []string
+		wantErr bool
+	}{
+		{"same key", []string{"old-key-old-key-old-key-old-key-"}, false},
+		{"rotated, old key still accepted", []string{"new-key-new-key-new-key-new-key-", "old-key-old-key-old-key-old-key-"}, false},
+		{"old key dropped", []string{"new-key-new-key-new-key-new-key-"}, true},
+	}
+
+	for _, f := range tests {
+		st := newRedisStore(sessionKeyPairs(f.keys)...)
+		var id string
+		err := securecookie.DecodeMulti("session", encoded, &id, st.Codecs...)
+		if (err != nil) != f.wantErr {
+			t.Errorf("%s: DecodeMulti() error = %v, wantErr %v", f.name, err, f.wantErr)
+		}
+		if err == nil && id != "session-id" {
+			t.Errorf("%s: DecodeMulti() = %q, want %q", f.name, id, "session-id")
+		}
+	}
+}
+
+func TestSessionOptions(t *testing.T) {
+	defer func() { c.Url, c.TTL, c.MaxTTL = "", 0, 0 }()
+
+	c.Url, c.TTL, c.MaxTTL = "https://whitelist.example.com", 12, 0
+	opts := sessionOptions()
+	if !opts.Secure || !opts.HttpOnly || opts.SameSite != http.SameSiteLaxMode || opts.MaxAge != 12*3600 {
+		t.Errorf("sessionOptions(): https url got %+v, want secure, http only, lax and 12 hours", opts)
+	}
+
+	c.Url, c.TTL = "http://localhost:8080", 0
+	if opts := sessionOptions(); opts.Secure || opts.MaxAge != 86400 {
+		t.Errorf("sessionOptions(): http url got %+v, want not secure and a day", opts)
+	}
+
+	c.TTL, c.MaxTTL = 12, 168
+	if opts := sessionOptions(); opts.MaxAge != 168*3600 {
+		t.Errorf("sessionOptions(): max_ttl 168 got MaxAge %d, want a week", opts.MaxAge)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Whitelisting states on a resource, as the "My access" page shows them.
+const (
+	statePending = "pending" // no sync has applied the whitelisting yet
+	stateApplied = "applied" // the last successful sync included it
+	stateFailed  = "failed"  // the sync that would apply it failed, it's retried
+	stateSkipped = "skipped" // the resource can't take IPv6 addresses
+)
+
+// SyncStatus is the outcome of a resource's last sync, kept in Redis so any
+// replica can tell users whether their whitelisting has reached it.
+type SyncStatus struct {
+	Applied time.Time `json:"applied"` // when the last successful sync read the whitelist
+	Failed  bool      `json:"failed"`  // the last sync failed
+	Synced  time.Time `json:"synced"`  // when the last sync finished
+}
+
+// ResourceAccess is a user's whitelisting state on a resource.
+type ResourceAccess struct {
+	Id    string `json:"id"`
+	State string `json:"state"`
+}
+
+var statusTempl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Dynamic IP Whitelist</title>
+
+    <link href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.7/css/bootstrap.min.css" rel="stylesheet" integrity="sha384-BVYiiSIFeK1dGmJRAkycuHAHRg32OmUcww7on3RYdg4Va+PmSTsz/K68vbdEjh4u" crossorigin="anonymous">
+{{if .Pending}}
+    <meta http-equiv="refresh" content="15">
+{{end}}
+  </head>
+  <body class="container-fluid">
+    <div class="row">
+      <div class="col-xs-4 col-xs-offset-4">
+        <h1>My access</h1>
+{{if .IP}}
+        <p>{{with .Name}}{{.}}, your{{else}}Your{{end}} IP {{.IP}} is whitelisted until {{.Expires.Format "02-01-2006 at 15:04 MST"}}.</p>
+        <table class="table table-condensed">
+          <tr><th>Resource</th><th>State</th></tr>
+{{range .Resources}}
+          <tr>
+            <td>{{.Id}}</td>
+{{if eq .State "applied"}}
+            <td class="text-success">applied</td>
+{{else if eq .State "failed"}}
+            <td class="text-danger">failed, it will be retried</td>
+{{else if eq .State "skipped"}}
+            <td class="text-muted">skipped, IPv6 isn't supported</td>
+{{else}}
+            <td class="text-warning">pending</td>
+{{end}}
+          </tr>
+{{else}}
+          <tr><td colspan="2">None of the resources are open to your groups.</td></tr>
+{{end}}
+        </table>
+        <form method="post" action="/extend" class="form-inline">
+          <select name="ttl" class="form-control input-sm">
+{{range .Choices}}
+            <option value="{{.}}"{{if eq . $.TTL}} selected{{end}}>{{.}} hours</option>
+{{end}}
+          </select>
+          <button type="submit" class="btn btn-default">Whitelist me for this long from now</button>
+        </form>
+        <br>
+        <form method="post" action="/revoke">
+          <button type="submit" class="btn btn-default">Remove my whitelisting</button>
+        </form>
+{{else}}
+        <p>You aren't whitelisted.</p>
+{{end}}
+        <br>
+        <a href="/?new=true">Whitelist again</a>
+      </div>
+    </div>
+  </body>
+</html>
+`))
+
+// statusHandler shows the signed-in user their whitelisted IP, when it
+// expires and how far it has got on each resource open to their groups.
+func statusHandler(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	u, _, err := apiCaller(req)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := redisContext()
+	defer cancel()
+	cidr, ttl, err := r.getIp(ctx, u.key)
+	if err != nil {
+		log.Print("status.statusHandler(): ", err)
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not read the whitelist"}
+	}
+
+	var data = struct {
+		Name      string
+		IP        string
+		Expires   time.Time
+		Resources []ResourceAccess
+		Pending   bool
+		Choices   []int
+		TTL       int
+	}{
+		Name: u.name,
+		IP:   cidr,
+		TTL:  c.TTL,
+	}
+	if cidr != "" {
+		u.cidr, u.groups = cidr, r.getGroups(u.key)
+		data.Choices = durationChoices(int(u.maxLifetime().Hours()))
+		data.Expires = time.Now().Add(ttl)
+		data.Resources, err = accessStates(ctx, u.key, cidr)
+		if err != nil {
+			log.Print("status.statusHandler(): ", err)
+			return Error{Code: http.StatusServiceUnavailable, Message: "could not read the sync status"}
+		}
+		for _, ra := range data.Resources {
+			data.Pending = data.Pending || ra.State == statePending
+		}
+	}
+	return statusTempl.Execute(w, &data)
+}
+
+// extendHandler whitelists the signed-in user again, from the form on the
+// "My access" page, for the hours they picked, so their whitelisting can be
+// extended or shortened without signing in again.
+func extendHandler(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	u, t, err := apiCaller(req)
+	if err != nil {
+		return err
+	}
+	if err := chooseTTL(req, u, t); err != nil {
+		return err
+	}
+	if !u.whitelist() {
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not whitelist " + u.ip}
+	}
+	http.Redirect(w, req, "/status", http.StatusSeeOther)
+	return nil
+}
+
+// durationChoices are the whitelisting durations in hours offered up to max.
+func durationChoices(max int) []int {
+	var choices []int
+	for _, hours := range []int{1, 2, 4, 8, 12, 24, 48, 72, 168} {
+		if hours < max {
+			choices = append(choices, hours)
+		}
+	}
+	if max > 0 {
+		choices = append(choices, max)
+	}
+	return choices
+}
+
+// accessStates reads what resourceStates needs from Redis for user's
+// whitelisting of cidr.
+func accessStates(ctx context.Context, user string, cidr string) ([]ResourceAccess, error) {
+	since, err := r.getSince(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	saved, err := r.getSyncStatuses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]SyncStatus)
+	for id, v := range saved {
+		statuses[id] = parseSyncStatus(v)
+	}
+	return resourceStates(p.enabled(), user, cidr, r.getGroups(user), since, statuses), nil
+}
+
+// resourceStates works out the state of a whitelisting of cidr, made at
+// since, on each resource open to groups.
+func resourceStates(resources []Resource, user string, cidr string, groups []string, since time.Time, statuses map[string]SyncStatus) []ResourceAccess {
+	states := []ResourceAccess{}
+	for _, res := range resources {
+		id := res.id()
+		if !hasGroup(res.Config.Group, groups) || !hasResource(id, groups) {
+			continue
+		}
+		state := statePending
+		st := statuses[id]
+		switch {
+		case !covers(res, user, cidr, groups):
+			// dropped from the resource's entries: IPv6 it can't take, or
+			// already allowed by its static whitelist
+			if isValidIpOrNetV4(cidr) {
+				state = stateApplied
+			} else {
+				state = stateSkipped
+			}
+		case !st.Applied.IsZero() && !st.Applied.Before(since):
+			state = stateApplied
+		case st.Failed:
+			state = stateFailed
+		}
+		states = append(states, ResourceAccess{Id: id, State: state})
+	}
+	return states
+}
+
+// recordSyncStatus keeps the outcome of a sync of the whitelist read at read,
+// for the "My access" page.
+func recordSyncStatus(report SyncReport, read time.Time) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	saved, err := r.getSyncStatuses(ctx)
+	if err != nil {
+		log.Print("status.recordSyncStatus(): ", err)
+		return
+	}
+	for _, res := range report.Results {
+		st := parseSyncStatus(saved[res.Resource])
+		st.Failed = res.Err != nil
+		st.Synced = time.Now().UTC()
+		if !st.Failed {
+			st.Applied = read.UTC()
+		}
+		v, _ := json.Marshal(st)
+		if err := r.setSyncStatus(ctx, res.Resource, v); err != nil {
+			log.Print("status.recordSyncStatus(): ", err)
+		}
+	}
+}
+
+// parseSyncStatus reads a stored SyncStatus, the zero one when it's missing or
+// unreadable.
+func parseSyncStatus(v string) SyncStatus {
+	var st SyncStatus
+	json.Unmarshal([]byte(v), &st)
+	return st
+}
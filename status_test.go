@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResourceStates(t *testing.T) {
+	c.Debug = false
+	since := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	static := []string{"198.51.100.1/32"}
+	resources := []Resource{
+		{Provider: &fakeProvider{name: "applied", static: static}},
+		{Provider: &fakeProvider{name: "pending", static: static}},
+		{Provider: &fakeProvider{name: "failed", static: static}},
+		{Provider: &fakeProvider{name: "never-synced", static: static}},
+		{Provider: &fakeProvider{name: "ops", group: []string{"ops"}, static: static}, Config: ResourceConfiguration{Group: []string{"ops"}}},
+		{Provider: &fakeProvider{name: "ipv6", ipv6: true, static: static}},
+	}
+	statuses := map[string]SyncStatus{
+		"fake/applied": {Applied: since.Add(time.Second)},
+		"fake/pending": {Applied: since.Add(-time.Minute)},
+		"fake/failed":  {Applied: since.Add(-time.Minute), Failed: true},
+		"fake/ipv6":    {Applied: since.Add(-time.Minute)},
+	}
+
+	tests := []struct {
+		cidr string
+		want []ResourceAccess
+	}{
+		{"203.0.113.9/32", []ResourceAccess{
+			{"fake/applied", stateApplied},
+			{"fake/pending", statePending},
+			{"fake/failed", stateFailed},
+			{"fake/never-synced", statePending},
+			{"fake/ipv6", statePending},
+		}},
+		// only the resource that takes IPv6 gets it
+		{"2001:db8::1/128", []ResourceAccess{
+			{"fake/applied", stateSkipped},
+			{"fake/pending", stateSkipped},
+			{"fake/failed", stateSkipped},
+			{"fake/never-synced", stateSkipped},
+			{"fake/ipv6", statePending},
+		}},
+		// allowed by the resources' static whitelist already
+		{"198.51.100.1/32", []ResourceAccess{
+			{"fake/applied", stateApplied},
+			{"fake/pending", stateApplied},
+			{"fake/failed", stateApplied},
+			{"fake/never-synced", stateApplied},
+			{"fake/ipv6", stateApplied},
+		}},
+	}
+
+	for _, f := range tests {
+		got := resourceStates(resources, "testuser", f.cidr, []string{"devs"}, since, statuses)
+		if !reflect.DeepEqual(got, f.want) {
+			t.Errorf("resourceStates(%s) = %v, want %v", f.cidr, got, f.want)
+		}
+	}
+}
+
+func TestDurationChoices(t *testing.T) {
+	tests := []struct {
+		max  int
+		want []int
+	}{
+		{24, []int{1, 2, 4, 8, 12, 24}},
+		{10, []int{1, 2, 4, 8, 10}},
+		{1, []int{1}},
+	}
+
+	for _, f := range tests {
+		if got := durationChoices(f.max); !reflect.DeepEqual(got, f.want) {
+			t.Errorf("durationChoices(%d) = %v, want %v", f.max, got, f.want)
+		}
+	}
+}
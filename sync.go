@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// SyncResult is the outcome of reconciling a single resource.
+type SyncResult struct {
+	Resource string
+	Err      error
+	Duration time.Duration
+}
+
+// SyncReport is the combined outcome of reconciling a set of resources, in the
+// order the resources were given.
+type SyncReport struct {
+	Results []SyncResult
+}
+
+// Failed returns the results of the resources that could not be updated.
+func (sr SyncReport) Failed() []SyncResult {
+	var failed []SyncResult
+	for _, res := range sr.Results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// Err combines every resource failure into one error, or nil when all
+// resources were updated.
+func (sr SyncReport) Err() error {
+	var errs []error
+	for _, res := range sr.Failed() {
+		errs = append(errs, errors.New(res.Resource+": "+res.Err.Error()))
+	}
+	return errors.Join(errs...)
+}
+
+// failedReport reports every resource as failed with err.
+func failedReport(resources []Resource, err error) SyncReport {
+	report := SyncReport{Results: make([]SyncResult, len(resources))}
+	for i, res := range resources {
+		report.Results[i] = SyncResult{Resource: res.id(), Err: err}
+	}
+	return report
+}
+
+// syncTimeout is how long a single resource update may take.
+func syncTimeout() time.Duration {
+	return time.Duration(applySyncDefaults(c.Sync).Timeout) * time.Second
+}
+
+// forEachResource calls fn for every resource, running at most concurrency
+// calls at once and giving each its own timeout.
+func forEachResource(ctx context.Context, resources []Resource, concurrency int, timeout time.Duration, fn func(ctx context.Context, i int, res Resource)) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, res := range resources {
+		wg.Add(1)
+		go func(i int, res Resource) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			rctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			fn(rctx, i, res)
+		}(i, res)
+	}
+	wg.Wait()
+}
+
+// reconcile updates resources against list, running at most concurrency
+// updates at once and giving each its own timeout. Every resource receives the
+// same list, so one sync works from a single consistent snapshot.
+func reconcile(ctx context.Context, resources []Resource, list map[string]string, concurrency int, timeout time.Duration) SyncReport {
+	report := SyncReport{Results: make([]SyncResult, len(resources))}
+	forEachResource(ctx, resources, concurrency, timeout, func(ctx context.Context, i int, res Resource) {
+		start := time.Now()
+		err := res.update(ctx, list)
+		report.Results[i] = SyncResult{Resource: res.id(), Err: err, Duration: time.Since(start)}
+	})
+
+	for _, res := range report.Failed() {
+		log.Print("sync.reconcile(): failed to update '"+res.Resource+"': ", res.Err)
+	}
+	if c.Debug {
+		for _, res := range report.Results {
+			log.Print("sync.reconcile(): '"+res.Resource+"' took ", res.Duration)
+		}
+	}
+	return report
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconcileConcurrency(t *testing.T) {
+	tracker := &updateTracker{}
+	var resources []Resource
+	var fakes []*fakeProvider
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		f := &fakeProvider{name: name, delay: 20 * time.Millisecond, tracker: tracker}
+		fakes = append(fakes, f)
+		resources = append(resources, Resource{Provider: f})
+	}
+	list := map[string]string{"alice": "1.1.1.1/32"}
+
+	report := reconcile(context.Background(), resources, list, 2, time.Second)
+
+	if tracker.peak != 2 {
+		t.Errorf("peak concurrent updates = %d, want 2", tracker.peak)
+	}
+	if len(report.Results) != len(resources) {
+		t.Fatalf("got %d results, want %d", len(report.Results), len(resources))
+	}
+	for i, res := range report.Results {
+		if res.Resource != resources[i].id() {
+			t.Errorf("result %d is for %q, want %q (results keep resource order)", i, res.Resource, resources[i].id())
+		}
+		if res.Err != nil {
+			t.Errorf("result %d unexpected error: %v", i, res.Err)
+		}
+	}
+	for _, f := range fakes {
+		if f.seen["alice"] != "1.1.1.1/32" {
+			t.Errorf("%s did not receive the sync's whitelist snapshot, got %v", f.id(), f.seen)
+		}
+	}
+	if report.Err() != nil {
+		t.Errorf("report.Err() = %v, want nil", report.Err())
+	}
+}
+
+func TestReconcileTimeoutAndFailures(t *testing.T) {
+	resources := []Resource{
+		{Provider: &fakeProvider{name: "ok"}},
+		{Provider: &fakeProvider{name: "slow", delay: time.Minute}},
+		{Provider: &fakeProvider{name: "broken", fail: errors.New("boom")}},
+	}
+
+	start := time.Now()
+	report := reconcile(context.Background(), resources, nil, 3, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("reconcile took %v, the per-resource timeout was not applied", elapsed)
+	}
+
+	failed := report.Failed()
+	if len(failed) != 2 {
+		t.Fatalf("failed = %+v, want slow and broken", failed)
+	}
+	if failed[0].Resource != "fake/slow" || !errors.Is(failed[0].Err, context.DeadlineExceeded) {
+		t.Errorf("slow resource result = %+v, want a deadline exceeded error", failed[0])
+	}
+	if failed[1].Resource != "fake/broken" || failed[1].Err.Error() != "boom" {
+		t.Errorf("broken resource result = %+v, want boom", failed[1])
+	}
+	if err := report.Err(); err == nil || err.Error() != "fake/slow: context deadline exceeded\nfake/broken: boom" {
+		t.Errorf("report.Err() = %q", err)
+	}
+}
+
+func TestApplySyncDefaults(t *testing.T) {
+	got := applySyncDefaults(SyncConfiguration{})
+	if got.Concurrency != 4 || got.Timeout != 300 {
+		t.Errorf("applySyncDefaults() = %+v, want concurrency 4 and timeout 300", got)
+	}
+	got = applySyncDefaults(SyncConfiguration{Concurrency: 10, Timeout: 30})
+	if got.Concurrency != 10 || got.Timeout != 30 {
+		t.Errorf("applySyncDefaults() overrode explicit values: %+v", got)
+	}
+}
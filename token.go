@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ApiToken lets a machine or CLI client whitelist its IP without signing in.
+// Tokens are issued by an admin; only their sha256 is kept, as the token's id.
+type ApiToken struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`                // shown as the whitelisting's name
+	Groups    []string  `json:"groups,omitempty"`    // matched against resource groups
+	Resources []string  `json:"resources,omitempty"` // resource ids it may be whitelisted on, all when empty
+	MaxTTL    int       `json:"max_ttl,omitempty"`   // hours a whitelisting may last, ttl when 0
+	Expires   time.Time `json:"expires"`
+}
+
+// TokenRequest is what an admin posts to /admin/tokens to issue a token.
+type TokenRequest struct {
+	Name      string   `json:"name"`
+	Groups    []string `json:"groups"`
+	Resources []string `json:"resources"`
+	MaxTTL    int      `json:"max_ttl"`
+	ExpiresIn int      `json:"expires_in"` // hours until the token expires, default 2160 (90 days)
+}
+
+// tokenPrefix marks api tokens, so they're recognisable in logs and secret
+// scanners.
+const tokenPrefix = "ipw_"
+
+var defaultTokenExpiry = 90 * 24 * time.Hour
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newApiToken checks a token request against the configured resources and
+// returns the token it describes, with its secret.
+func newApiToken(tr TokenRequest, resourceIds []string) (string, ApiToken, error) {
+	if tr.Name == "" {
+		return "", ApiToken{}, errors.New("a token needs a name")
+	}
+	if tr.MaxTTL < 0 || tr.ExpiresIn < 0 {
+		return "", ApiToken{}, errors.New("max_ttl and expires_in can't be negative")
+	}
+	if tr.MaxTTL > maxTTL() {
+		return "", ApiToken{}, errors.New("max_ttl can't be longer than the " + strconv.Itoa(maxTTL()) + " hour max_ttl")
+	}
+	known := make(map[string]bool)
+	for _, id := range resourceIds {
+		known[id] = true
+	}
+	for _, id := range tr.Resources {
+		if !known[id] {
+			return "", ApiToken{}, errors.New("unknown resource '" + id + "'")
+		}
+	}
+
+	expiresIn := defaultTokenExpiry
+	if tr.ExpiresIn > 0 {
+		expiresIn = time.Duration(tr.ExpiresIn) * time.Hour
+	}
+	secret := tokenPrefix + randomString(32)
+	return secret, ApiToken{
+		Id:        hashToken(secret),
+		Name:      tr.Name,
+		Groups:    tr.Groups,
+		Resources: tr.Resources,
+		MaxTTL:    tr.MaxTTL,
+		Expires:   time.Now().Add(expiresIn).UTC().Truncate(time.Second),
+	}, nil
+}
+
+// scopes are the groups the token's whitelisting is stored with: its own
+// groups plus the resources it's restricted to.
+func (t ApiToken) scopes() []string {
+	scopes := append([]string{}, t.Groups...)
+	for _, id := range t.Resources {
+		scopes = append(scopes, resourceScope+id)
+	}
+	return scopes
+}
+
+// ttl is how long a whitelisting lasts when requested for hours, 0 meaning as
+// long as the token allows.
+func (t ApiToken) ttl(hours int) (time.Duration, error) {
+	max := t.MaxTTL
+	if max == 0 {
+		max = c.TTL
+	}
+	if hours < 0 || hours > max {
+		return 0, errors.New("ttl must be between 1 and " + strconv.Itoa(max) + " hours")
+	}
+	if hours == 0 {
+		hours = max
+	}
+	return time.Duration(hours) * time.Hour, nil
+}
+
+// lookupToken returns the token for a secret, or nil when it's unknown or has
+// expired.
+func lookupToken(ctx context.Context, secret string) (*ApiToken, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	b, err := r.getToken(ctx, hashToken(secret))
+	if err != nil || b == nil {
+		return nil, err
+	}
+	var t ApiToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// tokensHandler lists the api tokens with GET, issues one with POST and
+// revokes one with DELETE ?id=<id>. The secret is only shown when issued.
+func tokensHandler(w http.ResponseWriter, req *http.Request) error {
+	switch req.Method {
+	case http.MethodGet:
+		values, err := r.values(req.Context(), keyToken)
+		if err != nil {
+			return Error{Code: http.StatusServiceUnavailable, Message: "could not read the tokens"}
+		}
+		tokens := []ApiToken{}
+		for _, id := range sortedKeys(values) {
+			var t ApiToken
+			if err := json.Unmarshal([]byte(values[id]), &t); err != nil {
+				log.Print("token.tokensHandler(): ", err)
+				continue
+			}
+			tokens = append(tokens, t)
+		}
+		sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(tokens)
+
+	case http.MethodPost:
+		var tr TokenRequest
+		if err := json.NewDecoder(req.Body).Decode(&tr); err != nil {
+			return Error{Code: http.StatusBadRequest, Message: "invalid token request: " + err.Error()}
+		}
+		var ids []string
+		for _, res := range p.all() {
+			ids = append(ids, res.id())
+		}
+		secret, t, err := newApiToken(tr, ids)
+		if err != nil {
+			return Error{Code: http.StatusBadRequest, Message: err.Error()}
+		}
+		b, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		if err := r.setToken(req.Context(), t.Id, b, time.Until(t.Expires)); err != nil {
+			log.Print("token.tokensHandler(): ", err)
+			return Error{Code: http.StatusServiceUnavailable, Message: "could not store the token"}
+		}
+		log.Println("token.tokensHandler(): api token '" + t.Name + "' issued, expires " + t.Expires.Format(time.RFC3339))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		return json.NewEncoder(w).Encode(struct {
+			Token string `json:"token"`
+			ApiToken
+		}{secret, t})
+
+	case http.MethodDelete:
+		id := req.FormValue("id")
+		if id == "" {
+			return Error{Code: http.StatusBadRequest, Message: "the id of the token to revoke is missing"}
+		}
+		found, err := r.deleteToken(req.Context(), id)
+		if err != nil {
+			return Error{Code: http.StatusServiceUnavailable, Message: "could not revoke the token"}
+		}
+		if !found {
+			return Error{Code: http.StatusNotFound, Message: "no such token"}
+		}
+		log.Println("token.tokensHandler(): api token '" + id + "' revoked")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	default:
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+}
+
+// whitelistTokenHandler whitelists the caller's IP for the api token sent as
+// "Authorization: Bearer <token>", for the optional ttl form value in hours.
+func whitelistTokenHandler(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return Error{Code: http.StatusMethodNotAllowed}
+	}
+	u, t, err := tokenUser(req)
+	if err, ok := err.(Error); ok && err.Code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	if err != nil {
+		return err
+	}
+	if err := chooseTTL(req, u, t); err != nil {
+		return err
+	}
+	if !u.whitelist() {
+		return Error{Code: http.StatusServiceUnavailable, Message: "could not whitelist " + u.ip}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(Whitelisting{
+		Name:    u.name,
+		IP:      u.ip,
+		Expires: time.Now().Add(u.ttl).UTC().Truncate(time.Second),
+	})
+}
+
+// tokenUser builds the user for the api token a request carries as
+// "Authorization: Bearer <token>".
+func tokenUser(req *http.Request) (*User, *ApiToken, error) {
+	t, err := lookupToken(req.Context(), bearerToken(req))
+	if err != nil {
+		log.Print("token.tokenUser(): ", err)
+		return nil, nil, Error{Code: http.StatusServiceUnavailable, Message: "could not check the token"}
+	}
+	if t == nil {
+		return nil, nil, Error{Code: http.StatusUnauthorized}
+	}
+	if err := checkClientIP(req); err != nil {
+		return nil, nil, err
+	}
+
+	// keyed on the id, names are only for display and needn't be unique
+	u := User{name: t.Name, groups: t.scopes()}
+	if err := u.finishUser("token "+t.Id, req); err != nil {
+		log.Print("token.tokenUser(): ", err)
+		return nil, nil, Error{Code: http.StatusForbidden, Message: "Your IP address can't be whitelisted"}
+	}
+	return &u, t, nil
+}
+
+// hoursParam reads a form value in hours: 0 when it isn't set, and -1 when it
+// isn't a positive number.
+func hoursParam(req *http.Request, name string) int {
+	v := req.FormValue(name)
+	if v == "" {
+		return 0
+	}
+	hours, err := strconv.Atoi(v)
+	if err != nil || hours <= 0 {
+		return -1
+	}
+	return hours
+}
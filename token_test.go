@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewApiToken(t *testing.T) {
+	c.TTL, c.MaxTTL = 24, 0
+	resources := []string{"azure/keyvault/rg/kv", "unifi/networklist/default/ci"}
+
+	tests := []struct {
+		name    string
+		tr      TokenRequest
+		wantErr bool
+	}{
+		{"minimal", TokenRequest{Name: "ci"}, false},
+		{"scoped", TokenRequest{Name: "ci", Groups: []string{"devs"}, Resources: []string{"unifi/networklist/default/ci"}, MaxTTL: 2, ExpiresIn: 24}, false},
+		{"no name", TokenRequest{}, true},
+		{"unknown resource", TokenRequest{Name: "ci", Resources: []string{"azure/keyvault/rg/other"}}, true},
+		{"max_ttl over ttl", TokenRequest{Name: "ci", MaxTTL: 48}, true},
+		{"negative expiry", TokenRequest{Name: "ci", ExpiresIn: -1}, true},
+	}
+
+	for _, f := range tests {
+		t.Run(f.name, func(t *testing.T) {
+			secret, token, err := newApiToken(f.tr, resources)
+			if f.wantErr {
+				if err == nil {
+					t.Fatalf("newApiToken() = %+v, want an error", token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newApiToken() returned error: %v", err)
+			}
+			if !strings.HasPrefix(secret, tokenPrefix) {
+				t.Errorf("secret %q doesn't start with %q", secret, tokenPrefix)
+			}
+			if token.Id != hashToken(secret) || strings.Contains(token.Id, secret) {
+				t.Errorf("id %q isn't the secret's hash", token.Id)
+			}
+			wantExpiry := defaultTokenExpiry
+			if f.tr.ExpiresIn > 0 {
+				wantExpiry = time.Duration(f.tr.ExpiresIn) * time.Hour
+			}
+			if d := time.Until(token.Expires) - wantExpiry; d > time.Second || d < -2*time.Second {
+				t.Errorf("expires %v, want in %v", token.Expires, wantExpiry)
+			}
+		})
+	}
+}
+
+func TestApiTokenTTL(t *testing.T) {
+	c.TTL = 24
+
+	tests := []struct {
+		maxTTL  int
+		hours   int
+		want    time.Duration
+		wantErr bool
+	}{
+		{0, 0, 24 * time.Hour, false},
+		{0, 8, 8 * time.Hour, false},
+		{0, 25, 0, true},
+		{2, 0, 2 * time.Hour, false},
+		{2, 1, time.Hour, false},
+		{2, 3, 0, true},
+		{2, -1, 0, true},
+	}
+
+	for _, f := range tests {
+		got, err := ApiToken{MaxTTL: f.maxTTL}.ttl(f.hours)
+		if (err != nil) != f.wantErr || got != f.want {
+			t.Errorf("ttl(%d) with max_ttl %d = %v, %v, want %v (error %v)", f.hours, f.maxTTL, got, err, f.want, f.wantErr)
+		}
+	}
+}
+
+func TestApiTokenScopes(t *testing.T) {
+	token := ApiToken{Groups: []string{"devs"}, Resources: []string{"unifi/networklist/default/ci"}}
+	got := token.scopes()
+	want := []string{"devs", "resource:unifi/networklist/default/ci"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("scopes() = %v, want %v", got, want)
+	}
+	if !hasGroup([]string{"devs"}, got) || !hasResource("unifi/networklist/default/ci", got) || hasResource("azure/keyvault/rg/kv", got) {
+		t.Errorf("scopes() %v don't grant the token's groups and resources only", got)
+	}
+}
+
+func TestTokenHandlers(t *testing.T) {
+	testRedisInstance := CreateTestRedis(t)
+	var rc RedisConfiguration
+	rc.Host = testRedisInstance.Host
+	rc.Port = testRedisInstance.Port
+	rc.Token = testRedisInstance.Token
+	if !r.connect(rc) {
+		t.Fatal("could not connect to test redis")
+	}
+	defer DeleteTestRedis(t, testRedisInstance)
+	c.TTL = 24
+
+	// issue
+	req := httptest.NewRequest(http.MethodPost, "/admin/tokens", strings.NewReader(`{"name":"ci runner","groups":["devs"],"max_ttl":2}`))
+	rec := httptest.NewRecorder()
+	if err := tokensHandler(rec, req); err != nil {
+		t.Fatalf("tokensHandler() POST returned error: %v", err)
+	}
+	var issued struct {
+		Token string `json:"token"`
+		ApiToken
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&issued); err != nil || rec.Code != http.StatusCreated || issued.Token == "" {
+		t.Fatalf("tokensHandler() POST = %d %+v (%v), want 201 and a token", rec.Code, issued, err)
+	}
+
+	// list, without the secret
+	rec = httptest.NewRecorder()
+	if err := tokensHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/tokens", nil)); err != nil {
+		t.Fatalf("tokensHandler() GET returned error: %v", err)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, issued.Id) || strings.Contains(body, issued.Token) {
+		t.Errorf("tokensHandler() GET = %s, want the token's id and not its secret", body)
+	}
+
+	// whitelist with it
+	whitelist := func(token string, ttl string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPost, "/api/whitelist?ttl="+ttl, nil)
+		req.RemoteAddr = "203.0.113.9:5555"
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		return rec, whitelistTokenHandler(rec, req)
+	}
+	if _, err := whitelist("ipw_wrong", ""); !isStatus(err, http.StatusUnauthorized) {
+		t.Errorf("unknown token: got %v, want 401", err)
+	}
+	if _, err := whitelist(issued.Token, "3"); !isStatus(err, http.StatusBadRequest) {
+		t.Errorf("ttl over max_ttl: got %v, want 400", err)
+	}
+	rec, err := whitelist(issued.Token, "1")
+	if err != nil {
+		t.Fatalf("whitelistTokenHandler() returned error: %v", err)
+	}
+	if !strings.Contains(rec.Body.String(), "203.0.113.9") {
+		t.Errorf("whitelistTokenHandler() = %s, want the whitelisted ip", rec.Body.String())
+	}
+	ctx := context.Background()
+	key := "token" + issued.Id
+	if list, _ := r.getWhitelist(ctx); list[key] != "203.0.113.9/32" {
+		t.Errorf("whitelist entry = %q, want 203.0.113.9/32", list[key])
+	}
+	if groups, _ := r.getUserGroups(ctx, key); strings.Join(groups, ",") != "devs" {
+		t.Errorf("whitelisted groups = %v, want [devs]", groups)
+	}
+
+	// another token with the same name has its own entry
+	secret, other, err := newApiToken(TokenRequest{Name: "ci runner", Groups: []string{"ops"}}, nil)
+	if err != nil {
+		t.Fatalf("newApiToken() returned error: %v", err)
+	}
+	b, _ := json.Marshal(other)
+	if err := r.setToken(ctx, other.Id, b, time.Until(other.Expires)); err != nil {
+		t.Fatalf("could not store token: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/api/whitelist", nil)
+	req.RemoteAddr = "198.51.100.7:5555"
+	req.Header.Set("Authorization", "Bearer "+secret)
+	if err := whitelistTokenHandler(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("whitelistTokenHandler() returned error: %v", err)
+	}
+	if list, _ := r.getWhitelist(ctx); list[key] != "203.0.113.9/32" || list["token"+other.Id] != "198.51.100.7/32" {
+		t.Errorf("whitelist = %v, want an entry per token", list)
+	}
+	if groups, _ := r.getUserGroups(ctx, key); strings.Join(groups, ",") != "devs" {
+		t.Errorf("whitelisted groups = %v after the other token, want [devs]", groups)
+	}
+
+	// revoke
+	rec = httptest.NewRecorder()
+	if err := tokensHandler(rec, httptest.NewRequest(http.MethodDelete, "/admin/tokens?id="+issued.Id, nil)); err != nil || rec.Code != http.StatusNoContent {
+		t.Fatalf("tokensHandler() DELETE = %d, %v, want 204", rec.Code, err)
+	}
+	if _, err := whitelist(issued.Token, ""); !isStatus(err, http.StatusUnauthorized) {
+		t.Errorf("revoked token: got %v, want 401", err)
+	}
+}
+
+func isStatus(err error, code int) bool {
+	e, ok := err.(Error)
+	return ok && e.Code == code
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -13,11 +14,6 @@ import (
 	"time"
 )
 
-// Unifi is the aggregate of all configured UniFi provider resources.
-type Unifi struct {
-	NetworkList []UnifiNetworkList
-}
-
 // UnifiNetworkList maps to one UniFi Network List (firewall address-group) that
 // the app keeps in sync with the current whitelist.
 type UnifiNetworkList struct {
@@ -37,8 +33,8 @@ type unifiFirewallGroup struct {
 
 // unifiClient is the transport seam so update() is testable without a live gateway.
 type unifiClient interface {
-	getFirewallGroup(name string) (unifiFirewallGroup, error)
-	updateFirewallGroup(g unifiFirewallGroup) error
+	getFirewallGroup(ctx context.Context, name string) (unifiFirewallGroup, error)
+	updateFirewallGroup(ctx context.Context, g unifiFirewallGroup) error
 }
 
 // unifiApplicationClient is the MVP unifiClient implementation, talking to the
@@ -79,9 +75,9 @@ func (uc *unifiApplicationClient) base() string {
 
 // login authenticates against the gateway and caches the session's CSRF token.
 // The session cookie is stored in the client's cookiejar. Callers must hold uc.mu.
-func (uc *unifiApplicationClient) login() error {
+func (uc *unifiApplicationClient) login(ctx context.Context) error {
 	body, _ := json.Marshal(map[string]string{"username": uc.cfg.Username, "password": uc.cfg.Password})
-	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(uc.cfg.Host, "/")+"/api/auth/login", bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(uc.cfg.Host, "/")+"/api/auth/login", bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -92,7 +88,7 @@ func (uc *unifiApplicationClient) login() error {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unifi login failed: status %d", resp.StatusCode)
+		return newStatusError("unifi login failed", resp)
 	}
 	uc.csrf = resp.Header.Get("X-CSRF-Token")
 	return nil
@@ -104,18 +100,18 @@ func (uc *unifiApplicationClient) login() error {
 // CSRF token from each response, and re-authenticates once if the session has
 // expired (401) or the token is stale (403). uc.mu serialises requests so a
 // concurrent update() can't rotate the token out from under an in-flight call.
-func (uc *unifiApplicationClient) authedDo(method, url string, body []byte) (*http.Response, error) {
+func (uc *unifiApplicationClient) authedDo(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
 	uc.mu.Lock()
 	defer uc.mu.Unlock()
 
 	var lastErr error
 	for attempt := 0; attempt < 2; attempt++ {
 		if uc.csrf == "" {
-			if err := uc.login(); err != nil {
+			if err := uc.login(ctx); err != nil {
 				return nil, err
 			}
 		}
-		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 		if err != nil {
 			return nil, err
 		}
@@ -134,7 +130,7 @@ func (uc *unifiApplicationClient) authedDo(method, url string, body []byte) (*ht
 		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
 			resp.Body.Close()
 			uc.csrf = ""
-			lastErr = fmt.Errorf("unifi %s: status %d", method, resp.StatusCode)
+			lastErr = newStatusError("unifi "+method, resp)
 			continue
 		}
 		return resp, nil
@@ -142,14 +138,14 @@ func (uc *unifiApplicationClient) authedDo(method, url string, body []byte) (*ht
 	return nil, lastErr
 }
 
-func (uc *unifiApplicationClient) getFirewallGroup(name string) (unifiFirewallGroup, error) {
-	resp, err := uc.authedDo(http.MethodGet, uc.base(), nil)
+func (uc *unifiApplicationClient) getFirewallGroup(ctx context.Context, name string) (unifiFirewallGroup, error) {
+	resp, err := uc.authedDo(ctx, http.MethodGet, uc.base(), nil)
 	if err != nil {
 		return unifiFirewallGroup{}, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return unifiFirewallGroup{}, fmt.Errorf("unifi getFirewallGroup failed: status %d", resp.StatusCode)
+		return unifiFirewallGroup{}, newStatusError("unifi getFirewallGroup failed", resp)
 	}
 	var out struct {
 		Data []unifiFirewallGroup `json:"data"`
@@ -165,15 +161,15 @@ func (uc *unifiApplicationClient) getFirewallGroup(name string) (unifiFirewallGr
 	return unifiFirewallGroup{}, fmt.Errorf("unifi network list '%s' not found", name)
 }
 
-func (uc *unifiApplicationClient) updateFirewallGroup(g unifiFirewallGroup) error {
+func (uc *unifiApplicationClient) updateFirewallGroup(ctx context.Context, g unifiFirewallGroup) error {
 	body, _ := json.Marshal(g)
-	resp, err := uc.authedDo(http.MethodPut, uc.base()+"/"+g.ID, body)
+	resp, err := uc.authedDo(ctx, http.MethodPut, uc.base()+"/"+g.ID, body)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unifi updateFirewallGroup failed: status %d", resp.StatusCode)
+		return newStatusError("unifi updateFirewallGroup failed", resp)
 	}
 	return nil
 }
@@ -218,17 +214,12 @@ func (nl *UnifiNetworkList) buildMembers(list map[string]string, getGroups func(
 		members = append(members, ip)
 	}
 	// dynamic whitelist
-	for key, ip := range list {
-		if !w.inRange(ip, nl.IPWhiteList) && isValidIpOrNetV4(ip) {
-			if hasGroup(nl.Group, getGroups(key)) {
-				add(ip)
-			} else if c.Debug {
-				log.Print("unifi.UnifiNetworkList.buildMembers(): user '"+key+"' is not part of any of the groups ", nl.Group, " required for network list '"+nl.Name+"'")
-			}
-		}
+	allowed := whitelistedIps(nl.id(), list, nl.IPWhiteList, nl.Group, getGroups, true)
+	for _, key := range sortedKeys(allowed) {
+		add(allowed[key])
 	}
 	// static whitelist (global + per-list)
-	for _, ip := range append(c.IPWhiteList, nl.IPWhiteList...) {
+	for _, ip := range staticWhitelist(nl.IPWhiteList) {
 		if isValidIpOrNetV4(ip) {
 			add(ip)
 		}
@@ -245,37 +236,65 @@ func unifiMember(ip string) string {
 	return strings.TrimSuffix(ip, "/32")
 }
 
-func (*UnifiNetworkList) new(nl UnifiNetworkList) {
-	u.NetworkList = append(u.NetworkList, nl)
-	log.Println("unifi.UnifiNetworkList.new(): network list added '" + nl.Name + "'")
+func init() {
+	registerProvider("unifi", "networklist", newUnifiNetworkList)
+}
+
+func newUnifiNetworkList(rc ResourceConfiguration) (Provider, error) {
+	nl := &UnifiNetworkList{
+		Name:        rc.Name,
+		Group:       rc.Group,
+		IPWhiteList: rc.IPWhiteList,
+		client:      newUnifiClient(c.Unifi),
+	}
+	log.Println("unifi.newUnifiNetworkList(): network list added '" + nl.Name + "'")
+	return nl, nil
+}
+
+func (nl *UnifiNetworkList) id() string {
+	return "unifi/networklist/" + nl.Name
+}
+
+func (*UnifiNetworkList) enabled() bool {
+	return unifiEnabled(c.Unifi)
+}
+
+func (nl *UnifiNetworkList) desired(list map[string]string, getGroups func(string) []string) []string {
+	return nl.buildMembers(list, getGroups)
+}
+
+func (nl *UnifiNetworkList) current(ctx context.Context) ([]string, error) {
+	g, err := nl.client.getFirewallGroup(ctx, nl.Name)
+	if err != nil {
+		return nil, err
+	}
+	return g.Members, nil
 }
 
-func (nl *UnifiNetworkList) update() int {
+func (nl *UnifiNetworkList) update(ctx context.Context, list map[string]string) error {
 	log.Print("unifi.UnifiNetworkList.update(): updating '" + nl.Name + "'")
 
-	members := nl.buildMembers(w.List, r.getGroups)
+	members := nl.buildMembers(list, r.getGroups)
 
-	g, err := nl.client.getFirewallGroup(nl.Name)
+	g, err := nl.client.getFirewallGroup(ctx, nl.Name)
 	if err != nil {
-		log.Print("unifi.UnifiNetworkList.update():", err)
-		return 1
+		return err
 	}
 
 	if sameMembers(g.Members, members) {
 		if c.Debug {
 			log.Print("unifi.UnifiNetworkList.update(): no changes required for '" + nl.Name + "'")
 		}
-		return 0
+		return nil
 	}
 
 	g.Members = members
-	if err := nl.client.updateFirewallGroup(g); err != nil {
-		log.Print("unifi.UnifiNetworkList.update():", err)
-		return 1
+	if err := nl.client.updateFirewallGroup(ctx, g); err != nil {
+		return err
 	}
 
 	log.Print("unifi.UnifiNetworkList.update(): updated '" + nl.Name + "'")
-	return 0
+	return nil
 }
 
 // unifiEnabled reports whether UniFi syncing should run. It is disabled when no
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -15,11 +16,9 @@ var errFakeUnifi = errors.New("fake unifi error")
 
 // fakeRedisConn is a minimal no-op redigo redis.Conn. buildMembers() calls
 // r.getGroups() incidentally (its result is only consulted when nl.Group is
-// non-nil), and RedisConfiguration.exec() panics on the zero-value r.Connection
-// (nil slice / nil interface) rather than erroring gracefully. These unit tests
-// don't want a real Redis (that's covered by the docker-backed suite), so we
-// stub just enough of r's Redis connection for exec() to fail cleanly instead
-// of panicking.
+// non-nil). These unit tests don't want a real Redis (that's covered by the
+// docker-backed suite), so we stub just enough of r's connection pool for
+// exec() to fail cleanly without dialing anything.
 type fakeRedisConn struct{}
 
 func (fakeRedisConn) Close() error { return nil }
@@ -31,14 +30,10 @@ func (fakeRedisConn) Send(commandName string, args ...interface{}) error { retur
 func (fakeRedisConn) Flush() error                                       { return nil }
 func (fakeRedisConn) Receive() (reply interface{}, err error)            { return nil, nil }
 
-// stubRedis wires r up with fakeRedisConn so update() -> buildMembers() ->
-// r.getGroups() doesn't panic when no real Redis is connected.
+// stubRedis wires r up with a pool handing out fakeRedisConn so update() ->
+// buildMembers() -> r.getGroups() fails fast when no real Redis is connected.
 func stubRedis() {
-	r.Running = make([]bool, redisDBCount)
-	r.Connection = make([]redis.Conn, redisDBCount)
-	for i := range r.Connection {
-		r.Connection[i] = fakeRedisConn{}
-	}
+	r.Pool = &redis.Pool{Dial: func() (redis.Conn, error) { return fakeRedisConn{}, nil }}
 }
 
 func TestSameMembers(t *testing.T) {
@@ -173,11 +168,11 @@ type fakeUnifiClient struct {
 	updateCalls int
 }
 
-func (f *fakeUnifiClient) getFirewallGroup(name string) (unifiFirewallGroup, error) {
+func (f *fakeUnifiClient) getFirewallGroup(ctx context.Context, name string) (unifiFirewallGroup, error) {
 	return f.group, f.getErr
 }
 
-func (f *fakeUnifiClient) updateFirewallGroup(g unifiFirewallGroup) error {
+func (f *fakeUnifiClient) updateFirewallGroup(ctx context.Context, g unifiFirewallGroup) error {
 	f.updateCalls++
 	f.updated = &g
 	return f.putErr
@@ -187,15 +182,15 @@ func TestUpdateNoChange(t *testing.T) {
 	stubRedis()
 	c.Debug = false
 	c.IPWhiteList = nil
-	w.List = map[string]string{"alice": "1.1.1.1/32"}
+	list := map[string]string{"alice": "1.1.1.1/32"}
 	// UniFi stores single hosts bare, so the existing group has no /32 — the built
 	// member (also bare) must match it, producing no change.
 	fake := &fakeUnifiClient{group: unifiFirewallGroup{ID: "abc", Name: "l", GroupType: "address-group", Members: []string{"1.1.1.1"}}}
 	nl := UnifiNetworkList{Name: "l", client: fake}
 	// getGroups via Redis is bypassed: buildMembers uses r.getGroups in update(),
 	// so stub the whitelist to a single entry whose group check passes (nil Group).
-	if ret := nl.update(); ret != 0 {
-		t.Fatalf("update() = %d, want 0", ret)
+	if err := nl.update(context.Background(), list); err != nil {
+		t.Fatalf("update() = %v, want nil", err)
 	}
 	if fake.updateCalls != 0 {
 		t.Errorf("updateFirewallGroup called %d times, want 0 (no change)", fake.updateCalls)
@@ -206,11 +201,11 @@ func TestUpdateChange(t *testing.T) {
 	stubRedis()
 	c.Debug = false
 	c.IPWhiteList = nil
-	w.List = map[string]string{"alice": "2.2.2.2/32"}
+	list := map[string]string{"alice": "2.2.2.2/32"}
 	fake := &fakeUnifiClient{group: unifiFirewallGroup{ID: "abc", Name: "l", GroupType: "address-group", Members: []string{"1.1.1.1"}}}
 	nl := UnifiNetworkList{Name: "l", client: fake}
-	if ret := nl.update(); ret != 0 {
-		t.Fatalf("update() = %d, want 0", ret)
+	if err := nl.update(context.Background(), list); err != nil {
+		t.Fatalf("update() = %v, want nil", err)
 	}
 	if fake.updateCalls != 1 {
 		t.Fatalf("updateFirewallGroup called %d times, want 1", fake.updateCalls)
@@ -221,25 +216,25 @@ func TestUpdateChange(t *testing.T) {
 }
 
 func TestUpdateGetError(t *testing.T) {
-	w.List = map[string]string{}
+	list := map[string]string{}
 	fake := &fakeUnifiClient{getErr: errFakeUnifi}
 	nl := UnifiNetworkList{Name: "l", client: fake}
-	if ret := nl.update(); ret != 1 {
-		t.Errorf("update() = %d, want 1 on get error", ret)
+	if err := nl.update(context.Background(), list); err == nil {
+		t.Error("update() = nil, want an error on get error")
 	}
 }
 
 func TestUpdatePutError(t *testing.T) {
 	stubRedis()
 	c.IPWhiteList = nil
-	w.List = map[string]string{"alice": "2.2.2.2/32"}
+	list := map[string]string{"alice": "2.2.2.2/32"}
 	fake := &fakeUnifiClient{
 		group:  unifiFirewallGroup{ID: "abc", Members: []string{"1.1.1.1/32"}},
 		putErr: errFakeUnifi,
 	}
 	nl := UnifiNetworkList{Name: "l", client: fake}
-	if ret := nl.update(); ret != 1 {
-		t.Errorf("update() = %d, want 1 on put error", ret)
+	if err := nl.update(context.Background(), list); err == nil {
+		t.Error("update() = nil, want an error on put error")
 	}
 }
 
@@ -283,7 +278,7 @@ func TestUnifiApplicationClientReusesSession(t *testing.T) {
 
 	// Two independent update cycles, as separate whitelist events would trigger.
 	for i := 0; i < 2; i++ {
-		g, err := client.getFirewallGroup("ip-whitelister")
+		g, err := client.getFirewallGroup(context.Background(), "ip-whitelister")
 		if err != nil {
 			t.Fatalf("cycle %d getFirewallGroup error: %v", i, err)
 		}
@@ -291,7 +286,7 @@ func TestUnifiApplicationClientReusesSession(t *testing.T) {
 			t.Fatalf("cycle %d getFirewallGroup = %+v, want id=abc members=[1.1.1.1]", i, g)
 		}
 		g.Members = []string{"2.2.2.2"}
-		if err := client.updateFirewallGroup(g); err != nil {
+		if err := client.updateFirewallGroup(context.Background(), g); err != nil {
 			t.Fatalf("cycle %d updateFirewallGroup error: %v", i, err)
 		}
 	}
@@ -336,7 +331,7 @@ func TestUnifiApplicationClientReloginsOnSessionExpiry(t *testing.T) {
 	defer srv.Close()
 
 	client := newUnifiClient(UnifiConfiguration{Host: srv.URL, Site: "default"})
-	if _, err := client.getFirewallGroup("l"); err != nil {
+	if _, err := client.getFirewallGroup(context.Background(), "l"); err != nil {
 		t.Fatalf("getFirewallGroup error: %v", err)
 	}
 	if loginHits != 2 {
@@ -357,7 +352,7 @@ func TestUnifiApplicationClientGroupNotFound(t *testing.T) {
 	}))
 	defer srv.Close()
 	client := newUnifiClient(UnifiConfiguration{Host: srv.URL, Site: "default"})
-	if _, err := client.getFirewallGroup("missing"); err == nil {
+	if _, err := client.getFirewallGroup(context.Background(), "missing"); err == nil {
 		t.Error("expected error for missing network list, got nil")
 	}
 }
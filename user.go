@@ -1,10 +1,11 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"regexp"
 	"strings"
@@ -16,35 +17,47 @@ type User struct {
 	name       string
 	employeeId string
 	ip         string
-	cidr       string   // microsoft saying without /<netmask> can cause issues... dont believe them but w/e ticket id - 2106010050001687
-	groups     []string // list of object ids
+	cidr       string        // microsoft saying without /<netmask> can cause issues... dont believe them but w/e ticket id - 2106010050001687
+	groups     []string      // list of object ids
+	ttl        time.Duration // how long to whitelist for, c.TTL hours when 0
 }
 
-type AzGetGroup struct {
-	Value []AzGroup `json:"value"`
-}
+// graphURL is the Microsoft Graph API the signed-in user is looked up with.
+var graphURL = "https://graph.microsoft.com/v1.0"
 
-type AzGroup struct {
-	ObjectId string `json:"objectId"`
+// GraphGroups is a page of the groups a user is a member of.
+type GraphGroups struct {
+	Value    []GraphGroup `json:"value"`
+	NextLink string       `json:"@odata.nextLink"`
 }
 
-func (u *User) new(client *http.Client, req *http.Request) *User {
-	// get display name + employee id
-	resp, err := client.Get("https://graph.windows.net/me?api-version=1.6")
-	if err != nil {
-		log.Printf("user.new(): error creating token  %v", err)
-		return nil
-	}
-	defer resp.Body.Close()
+type GraphGroup struct {
+	Id string `json:"id"`
+}
 
-	if resp.StatusCode >= 400 {
-		log.Printf("user.new(): token response was %s", resp.Status)
-		return nil
-	}
+// IdTokenClaims are the ID token claims used to check a sign-in and find a
+// user's groups, and the access token claims the command-line client's token
+// is checked with.
+type IdTokenClaims struct {
+	Aud    string   `json:"aud"`
+	Nonce  string   `json:"nonce"`
+	Groups []string `json:"groups"`
+	// set instead of groups when the user has too many groups for the token
+	ClaimNames map[string]string `json:"_claim_names"`
+	HasGroups  bool              `json:"hasgroups"`
+	// the app an access token was issued to, in v1 and v2 tokens
+	AppId string `json:"appid"`
+	Azp   string `json:"azp"`
+	// the tenant that issued the token
+	Tid string `json:"tid"`
+	Iss string `json:"iss"`
+}
 
+func (u *User) new(client *http.Client, idToken string, req *http.Request) *User {
+	// get display name + employee id
 	var ud map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&ud); err != nil {
-		log.Printf("user.new(): error decoding JSON response: %v", err)
+	if err := graphGet(client, graphURL+"/me?$select=displayName,employeeId", &ud); err != nil {
+		log.Print("user.new(): ", err)
 		return nil
 	}
 
@@ -55,72 +68,116 @@ func (u *User) new(client *http.Client, req *http.Request) *User {
 	u.employeeId = fmt.Sprintf("%v", ud["employeeId"])
 	u.name = fmt.Sprintf("%v", ud["displayName"])
 
-	// get users groups
-	resp, err = client.Get("https://graph.windows.net/me/memberOf?api-version=1.6")
-	if err != nil {
-		log.Printf("user.new(): error creating token  %v", err)
-		return nil
+	// get users groups, from the id token when it lists them all
+	if groups, ok := idTokenGroups(idToken, c.Auth.ClientId); ok {
+		u.groups = groups
+	} else {
+		groups, err := graphGroups(client)
+		if err != nil {
+			log.Print("user.new(): ", err)
+			return nil
+		}
+		u.groups = groups
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		log.Printf("user.new(): token response was %s", resp.Status)
-		return nil
+	if c.Debug {
+		log.Printf("user.new(): %v groups: %v", u.name, u.groups)
 	}
 
-	var ug AzGetGroup
-	if err := json.NewDecoder(resp.Body).Decode(&ug); err != nil {
-		log.Printf("user.new(): error decoding JSON response: %v", err)
+	// derive key, client IP, and cidr (shared with the no-auth path)
+	if err := u.finishUser(u.name+u.employeeId, req); err != nil {
+		log.Print("user.new(): ", err)
 		return nil
 	}
 
-	if c.Debug {
-		log.Printf("user.new(): %v", ug)
-	}
+	log.Println("user.new(): authentication successful - " + u.name + " (" + u.employeeId + ") - " + u.ip)
 
-	for _, g := range ug.Value {
-		u.groups = append(u.groups, g.ObjectId)
-	}
+	return u
+}
 
-	if c.Debug {
-		log.Printf("user.new(): %v groups: %v", u.name, u.groups)
+// graphGet decodes the JSON response of a Microsoft Graph request into v.
+func graphGet(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	// derive key, client IP, and cidr (shared with the no-auth path)
-	if err := u.finishUser(u.name+u.employeeId, req); err != nil {
-		log.Fatal("user.new(): ", err)
+	if resp.StatusCode >= 400 {
+		return newStatusError("graph", resp)
 	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
 
-	log.Println("user.new(): authentication successful - " + u.name + " (" + u.employeeId + ") - " + u.ip)
+// graphGroups returns the object ids of every group the signed-in user is a
+// member of, directly or through nested groups, following each page.
+func graphGroups(client *http.Client) ([]string, error) {
+	var groups []string
+	next := graphURL + "/me/transitiveMemberOf/microsoft.graph.group?$select=id&$top=999"
+	for next != "" {
+		var page GraphGroups
+		if err := graphGet(client, next, &page); err != nil {
+			return nil, err
+		}
+		for _, g := range page.Value {
+			groups = append(groups, g.Id)
+		}
+		next = page.NextLink
+	}
+	return groups, nil
+}
 
-	return u
+// parseIdToken reads an ID token's claims. The token comes straight from the
+// token endpoint over TLS, so its signature isn't checked.
+func parseIdToken(idToken string) (IdTokenClaims, error) {
+	var claims IdTokenClaims
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed id token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, err
+	}
+	err = json.Unmarshal(payload, &claims)
+	return claims, err
 }
 
-// finishUser fills in the request-derived fields shared by both the OAuth and
-// no-auth constructors: the client IP (with a loopback override for local
-// testing), its cidr, and the whitelist key derived from identity. When
-// identity is empty the key falls back to the client IP.
-func (u *User) finishUser(identity string, req *http.Request) error {
-	// get ip from the configured trusted header. Azure Front Door sets
-	// X-Azure-Clientip (the default when ip_header is unset); no-auth mode uses
-	// ip_header (e.g. Cf-Connecting-Ip). Fall back to RemoteAddr when absent.
-	ipHeader := c.Auth.IPHeader
-	if ipHeader == "" {
-		ipHeader = "X-Azure-Clientip"
-	}
-	u.ip = req.Header.Get(ipHeader)
-	if u.ip == "" {
-		var err error
-		u.ip, _, err = net.SplitHostPort(req.RemoteAddr)
-		if err != nil {
-			log.Printf("user.finishUser(): %q is not IP:port\n", req.RemoteAddr)
+// idTokenGroups returns the groups claim of an ID token issued to clientId,
+// and whether it can be relied on. It can't when the claim is missing, i.e.
+// the app registration doesn't emit it, or when the user has more groups than
+// fit in a token (group overage), in which case they're looked up in Graph.
+func idTokenGroups(idToken string, clientId string) ([]string, bool) {
+	claims, err := parseIdToken(idToken)
+	if err != nil {
+		if idToken != "" {
+			log.Print("user.idTokenGroups(): ", err)
+		}
+		return nil, false
+	}
+	if claims.Aud != clientId {
+		log.Print("user.idTokenGroups(): id token was issued to '" + claims.Aud + "', ignoring it")
+		return nil, false
+	}
+	if _, overage := claims.ClaimNames["groups"]; overage || claims.HasGroups {
+		if c.Debug {
+			log.Print("user.idTokenGroups(): group overage, looking groups up in graph")
 		}
+		return nil, false
 	}
+	return claims.Groups, claims.Groups != nil
+}
 
-	// annoying when testing locally, make up an ip :)
-	if u.ip == "::1" {
-		u.ip = "80.18.81.18"
+// finishUser fills in the request-derived fields shared by both the OAuth and
+// no-auth constructors: the client IP (see clientIP), its cidr, and the
+// whitelist key derived from identity. When identity is empty the key falls
+// back to the client IP.
+func (u *User) finishUser(identity string, req *http.Request) error {
+	ip, err := clientIP(req)
+	if err != nil {
+		return err
 	}
+	u.ip = ip
 
 	cidr, err := addNetmask(u.ip)
 	if err != nil {
@@ -165,17 +222,70 @@ func (u *User) newFromRequest(req *http.Request) *User {
 	return u
 }
 
-func (u *User) whitelist() {
-	s := w.add(u)
-	if s {
-		log.Println("user.whitelist(): Whitelisting for '" + u.ip + "' (" + u.name + ") will expire on " + time.Now().Add(time.Duration(c.TTL)*time.Hour).Format("02-01-2006 at 15:04"))
+// lifetime is how long the user's whitelisting lasts.
+func (u *User) lifetime() time.Duration {
+	if u.ttl > 0 {
+		return u.ttl
+	}
+	return time.Duration(c.TTL) * time.Hour
+}
+
+// maxTTL is the longest whitelisting in hours anyone may choose: max_ttl, and
+// at least ttl.
+func maxTTL() int {
+	if c.MaxTTL < c.TTL {
+		return c.TTL
+	}
+	return c.MaxTTL
+}
+
+// maxLifetime is the longest the user may be whitelisted for: the lowest
+// max_ttl of the resources their whitelisting lands on.
+func (u *User) maxLifetime() time.Duration {
+	max := maxTTL()
+	for _, res := range p.enabled() {
+		if res.Config.MaxTTL > 0 && res.Config.MaxTTL < max && covers(res, u.key, u.cidr, u.groups) {
+			max = res.Config.MaxTTL
+		}
 	}
+	return time.Duration(max) * time.Hour
 }
 
-// TODO: currently unused
-// func (u *User) unwhitelist() {
-// 	s := w.delete(u)
-// 	if s {
-// 		log.Println("user.unwhitelist(): Whitelisting for '" + u.ip + "' (" + u.name + ") has been removed")
-// 	}
-// }
+// chooseLifetime has the user whitelisted for the hours they picked, up to
+// maxLifetime.
+func (u *User) chooseLifetime(hours int) error {
+	max := u.maxLifetime()
+	if hours <= 0 || time.Duration(hours)*time.Hour > max {
+		return fmt.Errorf("ttl must be between 1 and %d hours", int(max.Hours()))
+	}
+	u.ttl = time.Duration(hours) * time.Hour
+	return nil
+}
+
+// whitelist adds the user's ip, and reports whether it's whitelisted: by
+// their own entry, or by the static ip_whitelist. Whitelistings that would
+// outlast maxLifetime are cut short to it.
+func (u *User) whitelist() bool {
+	if max := u.maxLifetime(); u.lifetime() > max {
+		u.ttl = max
+	}
+	if !w.add(u) {
+		return w.inRange(u.ip, c.IPWhiteList)
+	}
+	log.Println("user.whitelist(): Whitelisting for '" + u.ip + "' (" + u.name + ") will expire on " + time.Now().Add(u.lifetime()).Format("02-01-2006 at 15:04"))
+	return true
+}
+
+// unwhitelist removes the user's whitelisting, returning whether it was
+// removed and the sync of the resources it was on.
+func (u *User) unwhitelist() (SyncReport, bool) {
+	report, ok := w.delete(u)
+	if !ok {
+		return report, false
+	}
+	log.Println("user.unwhitelist(): Whitelisting for '" + u.ip + "' (" + u.name + ") has been removed")
+	for _, res := range report.Failed() {
+		log.Printf("user.unwhitelist(): '%v' is still on %v, it will be retried: %v", u.key, res.Resource, res.Err)
+	}
+	return report, true
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
-// fakeTransport routes graph.windows.net requests to canned responses keyed by
-// URL path, so User.new() can be exercised without any live Azure call.
+// fakeTransport routes Microsoft Graph requests to canned responses keyed by
+// URL path, or path and query for paged requests, so User.new() can be
+// exercised without any live Azure call.
 type fakeTransport struct {
 	responses map[string]fakeResponse
 }
@@ -21,7 +26,10 @@ type fakeResponse struct {
 }
 
 func (f fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	resp, ok := f.responses[req.URL.Path]
+	resp, ok := f.responses[req.URL.Path+"?"+req.URL.RawQuery]
+	if !ok {
+		resp, ok = f.responses[req.URL.Path]
+	}
 	if !ok {
 		resp = fakeResponse{status: 404, body: "{}"}
 	}
@@ -34,26 +42,38 @@ func (f fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	}, nil
 }
 
-func fakeGraphClient(me, memberOf fakeResponse) *http.Client {
-	return &http.Client{
-		Transport: fakeTransport{
-			responses: map[string]fakeResponse{
-				"/me":          me,
-				"/me/memberOf": memberOf,
-			},
-		},
+func fakeGraphClient(me, memberOf fakeResponse, pages ...fakeResponse) *http.Client {
+	responses := map[string]fakeResponse{
+		"/v1.0/me": me,
+		"/v1.0/me/transitiveMemberOf/microsoft.graph.group": memberOf,
+	}
+	for i, page := range pages {
+		responses["/v1.0/me/transitiveMemberOf/microsoft.graph.group?$skiptoken="+strconv.Itoa(i+2)] = page
 	}
+	return &http.Client{Transport: fakeTransport{responses: responses}}
+}
+
+// fakeIdToken returns an unsigned ID token carrying claims.
+func fakeIdToken(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(claims)) + ".sig"
 }
 
 func TestUserNew(t *testing.T) {
 	c.Debug = false
 	c.Auth.IPHeader = "" // azure path reads X-Azure-Clientip
 	defer func() { c.Auth.IPHeader = "" }()
+	c.Auth.ClientId = "client-id"
+	defer func() { c.Auth.ClientId = "" }()
+	c.Dev.LoopbackIP = "80.18.81.18"
+	defer func() { c.Dev.LoopbackIP = "" }()
 
 	tests := []struct {
 		name         string
 		me           fakeResponse
 		memberOf     fakeResponse
+		pages        []fakeResponse // further pages of groups
+		idToken      string
 		clientIP     string // X-Azure-Clientip header
 		remoteAddr   string
 		wantName     string
@@ -66,7 +86,7 @@ func TestUserNew(t *testing.T) {
 		{
 			name:         "ipv4 from X-Azure-Clientip header",
 			me:           fakeResponse{200, `{"displayName":"Test User","employeeId":"12345"}`},
-			memberOf:     fakeResponse{200, `{"value":[{"objectId":"group-a"},{"objectId":"group-b"}]}`},
+			memberOf:     fakeResponse{200, `{"value":[{"id":"group-a"},{"id":"group-b"}]}`},
 			clientIP:     "1.2.3.4",
 			remoteAddr:   "10.0.0.1:5555",
 			wantName:     "Test User",
@@ -102,18 +122,74 @@ func TestUserNew(t *testing.T) {
 			wantCidr:     "80.18.81.18/32",
 			wantGroups:   nil,
 		},
+		{
+			name: "groups are read from every page",
+			me:   fakeResponse{200, `{"displayName":"Test User","employeeId":"12345"}`},
+			memberOf: fakeResponse{200, `{"value":[{"id":"group-a"}],
+				"@odata.nextLink":"https://graph.microsoft.com/v1.0/me/transitiveMemberOf/microsoft.graph.group?$skiptoken=2"}`},
+			pages:        []fakeResponse{{200, `{"value":[{"id":"group-b"},{"id":"group-c"}]}`}},
+			clientIP:     "1.2.3.4",
+			wantName:     "Test User",
+			wantEmployee: "12345",
+			wantKey:      "testuser12345",
+			wantIP:       "1.2.3.4",
+			wantCidr:     "1.2.3.4/32",
+			wantGroups:   []string{"group-a", "group-b", "group-c"},
+		},
+		{
+			name:         "groups claim in the id token",
+			me:           fakeResponse{200, `{"displayName":"Test User","employeeId":"12345"}`},
+			memberOf:     fakeResponse{500, `{}`},
+			idToken:      fakeIdToken(`{"aud":"client-id","groups":["group-a","group-b"]}`),
+			clientIP:     "1.2.3.4",
+			wantName:     "Test User",
+			wantEmployee: "12345",
+			wantKey:      "testuser12345",
+			wantIP:       "1.2.3.4",
+			wantCidr:     "1.2.3.4/32",
+			wantGroups:   []string{"group-a", "group-b"},
+		},
+		{
+			name:         "group overage falls back to graph",
+			me:           fakeResponse{200, `{"displayName":"Test User","employeeId":"12345"}`},
+			memberOf:     fakeResponse{200, `{"value":[{"id":"group-c"}]}`},
+			idToken:      fakeIdToken(`{"aud":"client-id","_claim_names":{"groups":"src1"},"_claim_sources":{"src1":{"endpoint":"https://graph.windows.net/"}}}`),
+			clientIP:     "1.2.3.4",
+			wantName:     "Test User",
+			wantEmployee: "12345",
+			wantKey:      "testuser12345",
+			wantIP:       "1.2.3.4",
+			wantCidr:     "1.2.3.4/32",
+			wantGroups:   []string{"group-c"},
+		},
+		{
+			name:         "id token for another app is ignored",
+			me:           fakeResponse{200, `{"displayName":"Test User","employeeId":"12345"}`},
+			memberOf:     fakeResponse{200, `{"value":[{"id":"group-c"}]}`},
+			idToken:      fakeIdToken(`{"aud":"other-app","groups":["group-a"]}`),
+			clientIP:     "1.2.3.4",
+			wantName:     "Test User",
+			wantEmployee: "12345",
+			wantKey:      "testuser12345",
+			wantIP:       "1.2.3.4",
+			wantCidr:     "1.2.3.4/32",
+			wantGroups:   []string{"group-c"},
+		},
 	}
 
 	for _, f := range tests {
 		t.Run(f.name, func(t *testing.T) {
 			req := httptest.NewRequest("GET", "/callback", nil)
-			req.RemoteAddr = f.remoteAddr
+			req.RemoteAddr = "10.0.0.1:5555" // behind a trusted proxy
+			if f.remoteAddr != "" {
+				req.RemoteAddr = f.remoteAddr
+			}
 			if f.clientIP != "" {
 				req.Header.Set("X-Azure-Clientip", f.clientIP)
 			}
 
 			var u User
-			got := u.new(fakeGraphClient(f.me, f.memberOf), req)
+			got := u.new(fakeGraphClient(f.me, f.memberOf, f.pages...), f.idToken, req)
 			if got == nil {
 				t.Fatalf("user.new() returned nil, want a populated user")
 			}
@@ -166,7 +242,8 @@ func TestUserWhitelist(t *testing.T) {
 	// whitelist should be stored and retrievable from redis.
 	u.whitelist()
 
-	if got := r.getWhitelist()[u.key]; got != u.cidr {
+	if list, _ := r.getWhitelist(context.Background()); list[u.key] != u.cidr {
+		got := list[u.key]
 		t.Errorf("user.whitelist(): redis entry for %q = %q, want %q", u.key, got, u.cidr)
 	}
 }
@@ -177,6 +254,8 @@ func TestUserNewFromRequest(t *testing.T) {
 	defer func() { c.Auth.Header = "" }()
 	c.Auth.IPHeader = "Cf-Connecting-Ip"
 	defer func() { c.Auth.IPHeader = "" }()
+	c.Dev.LoopbackIP = "80.18.81.18"
+	defer func() { c.Dev.LoopbackIP = "" }()
 
 	tests := []struct {
 		name       string
@@ -273,9 +352,54 @@ func TestUserNewErrorStatus(t *testing.T) {
 			req.Header.Set("X-Azure-Clientip", "1.2.3.4")
 
 			var u User
-			if got := u.new(fakeGraphClient(f.me, f.memberOf), req); got != nil {
+			if got := u.new(fakeGraphClient(f.me, f.memberOf), "", req); got != nil {
 				t.Errorf("user.new() = %v, want nil on error", got)
 			}
 		})
 	}
 }
+
+func TestChooseLifetime(t *testing.T) {
+	defer func(ttl, max int) { c.TTL, c.MaxTTL = ttl, max }(c.TTL, c.MaxTTL)
+	defer p.set(nil)
+	c.TTL, c.MaxTTL = 24, 168
+	p.set([]Resource{
+		{Provider: &fakeProvider{name: "open"}},
+		{Provider: &fakeProvider{name: "ops", group: []string{"ops"}}, Config: ResourceConfiguration{MaxTTL: 8}},
+	})
+
+	tests := []struct {
+		name    string
+		groups  []string
+		hours   int
+		wantMax int
+		wantErr bool
+	}{
+		{"under the global max_ttl", []string{"devs"}, 48, 168, false},
+		{"over the global max_ttl", []string{"devs"}, 169, 168, true},
+		{"capped by a resource", []string{"ops"}, 8, 8, false},
+		{"over a resource's max_ttl", []string{"ops"}, 12, 8, true},
+		{"zero", []string{"devs"}, 0, 168, true},
+	}
+
+	for _, f := range tests {
+		u := &User{key: "testuser", cidr: "203.0.113.9/32", groups: f.groups}
+		if got := u.maxLifetime(); got != time.Duration(f.wantMax)*time.Hour {
+			t.Errorf("%s: maxLifetime() = %v, want %dh", f.name, got, f.wantMax)
+		}
+		err := u.chooseLifetime(f.hours)
+		if (err != nil) != f.wantErr {
+			t.Errorf("%s: chooseLifetime(%d) returned %v, want error %v", f.name, f.hours, err, f.wantErr)
+		}
+		if err == nil && u.lifetime() != time.Duration(f.hours)*time.Hour {
+			t.Errorf("%s: lifetime() = %v, want %dh", f.name, u.lifetime(), f.hours)
+		}
+	}
+
+	// max_ttl below ttl doesn't shorten the default
+	c.MaxTTL = 0
+	u := &User{key: "testuser", cidr: "203.0.113.9/32", groups: []string{"devs"}}
+	if got := u.maxLifetime(); got != 24*time.Hour {
+		t.Errorf("maxLifetime() without max_ttl = %v, want ttl", got)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// VerifyConfiguration has auth.type: none check a signed identity header set
+// by the SSO proxy in front of the app, rather than trusting a plain one.
+type VerifyConfiguration struct {
+	Type       string `yaml:"type"`        // a registered verifier, e.g. 'cloudflare' or 'jwt'
+	TeamDomain string `yaml:"team_domain"` // cloudflare: <team>.cloudflareaccess.com
+	Header     string `yaml:"header"`      // header carrying the token
+	Issuer     string `yaml:"issuer"`      // expected 'iss'
+	JwksURL    string `yaml:"jwks_url"`    // where the proxy publishes its signing keys
+	Audience   string `yaml:"audience"`    // expected 'aud', e.g. the Cloudflare Access application's AUD tag
+	UserClaim  string `yaml:"user_claim"`  // default 'email'
+	NameClaim  string `yaml:"name_claim"`  // default 'name'
+	// GroupsClaim is matched against resource groups, default 'groups'
+	GroupsClaim string `yaml:"groups_claim"`
+}
+
+// HeaderVerifier checks the identity an SSO proxy signed into a request.
+type HeaderVerifier interface {
+	// verify returns the claims of the request's verified identity.
+	verify(req *http.Request) (map[string]interface{}, error)
+}
+
+// HeaderVerifierFactory builds a HeaderVerifier from its configuration.
+type HeaderVerifierFactory func(vc VerifyConfiguration) (HeaderVerifier, error)
+
+// headerVerifiers is the registry of known verifiers, keyed by type.
+var headerVerifiers = make(map[string]HeaderVerifierFactory)
+
+// headerVerifier checks requests in auth.type: none, when configured.
+var headerVerifier HeaderVerifier
+
+var errNoIdentity = errors.New("no signed identity in the request")
+
+// registerHeaderVerifier makes a verifier available to config files as
+// `verify: {type: <typ>}`. Verifiers call it from an init() in their own file.
+func registerHeaderVerifier(typ string, f HeaderVerifierFactory) {
+	typ = strings.ToLower(typ)
+	if _, ok := headerVerifiers[typ]; ok {
+		log.Fatalln("verify.registerHeaderVerifier(): verifier '" + typ + "' is already registered")
+	}
+	headerVerifiers[typ] = f
+}
+
+// newHeaderVerifier builds the verifier registered for vc's type.
+func newHeaderVerifier(vc VerifyConfiguration) (HeaderVerifier, error) {
+	f, ok := headerVerifiers[strings.ToLower(vc.Type)]
+	if !ok {
+		return nil, errors.New("unsupported verify type '" + vc.Type + "'")
+	}
+	return f(vc)
+}
+
+// applyVerifyDefaults fills in the claims most proxies use.
+func applyVerifyDefaults(vc VerifyConfiguration) VerifyConfiguration {
+	if vc.UserClaim == "" {
+		vc.UserClaim = "email"
+	}
+	if vc.NameClaim == "" {
+		vc.NameClaim = "name"
+	}
+	if vc.GroupsClaim == "" {
+		vc.GroupsClaim = "groups"
+	}
+	return vc
+}
+
+func init() {
+	registerHeaderVerifier("jwt", newJWTVerifier)
+}
+
+// jwtVerifier verifies a JWT in a request header against the signing keys the
+// proxy publishes, e.g. oauth2-proxy's Authorization header or Pomerium's
+// X-Pomerium-Jwt-Assertion. Keys are cached, and fetched again when a token
+// is signed with one that isn't known yet.
+type jwtVerifier struct {
+	header   string
+	verifier *oidc.IDTokenVerifier
+}
+
+func newJWTVerifier(vc VerifyConfiguration) (HeaderVerifier, error) {
+	if vc.Header == "" || vc.Issuer == "" || vc.JwksURL == "" || vc.Audience == "" {
+		return nil, errors.New("verify type '" + vc.Type + "' needs a header, issuer, jwks_url and audience")
+	}
+	keySet := oidc.NewRemoteKeySet(context.Background(), vc.JwksURL)
+	return &jwtVerifier{
+		header:   vc.Header,
+		verifier: oidc.NewVerifier(vc.Issuer, keySet, &oidc.Config{ClientID: vc.Audience}),
+	}, nil
+}
+
+func (v *jwtVerifier) verify(req *http.Request) (map[string]interface{}, error) {
+	token := req.Header.Get(v.header)
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	if token == "" {
+		return nil, errNoIdentity
+	}
+
+	idToken, err := v.verifier.Verify(req.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHeaderVerifier(t *testing.T) {
+	tests := []struct {
+		name       string
+		vc         VerifyConfiguration
+		wantErr    bool
+		wantHeader string
+	}{
+		{"cloudflare", VerifyConfiguration{Type: "cloudflare", TeamDomain: "myteam.cloudflareaccess.com", Audience: "aud-tag"}, false, "Cf-Access-Jwt-Assertion"},
+		{"cloudflare without team domain", VerifyConfiguration{Type: "cloudflare", Audience: "aud-tag"}, true, ""},
+		{"cloudflare without audience", VerifyConfiguration{Type: "cloudflare", TeamDomain: "myteam.cloudflareaccess.com"}, true, ""},
+		{"jwt", VerifyConfiguration{Type: "JWT", Header: "X-Pomerium-Jwt-Assertion", Issuer: "https://authenticate.example.com", JwksURL: "https://authenticate.example.com/.well-known/pomerium/jwks.json", Audience: "whitelist.example.com"}, false, "X-Pomerium-Jwt-Assertion"},
+		{"jwt without jwks url", VerifyConfiguration{Type: "jwt", Header: "Authorization", Issuer: "https://idp.example.com", Audience: "app"}, true, ""},
+		{"unknown type", VerifyConfiguration{Type: "magic"}, true, ""},
+	}
+
+	for _, f := range tests {
+		v, err := newHeaderVerifier(f.vc)
+		if (err != nil) != f.wantErr {
+			t.Errorf("%s: newHeaderVerifier() error = %v, wantErr %v", f.name, err, f.wantErr)
+			continue
+		}
+		if err == nil && v.(*jwtVerifier).header != f.wantHeader {
+			t.Errorf("%s: newHeaderVerifier() header = %q, want %q", f.name, v.(*jwtVerifier).header, f.wantHeader)
+		}
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	v, err := newHeaderVerifier(VerifyConfiguration{Type: "jwt", Header: "Authorization", Issuer: ti.URL, JwksURL: ti.URL + "/keys", Audience: "aud-tag"})
+	if err != nil {
+		t.Fatalf("newHeaderVerifier(): %v", err)
+	}
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   ti.URL,
+			"aud":   []string{"aud-tag"},
+			"email": "alice@example.com",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+		}
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		cl := valid()
+		cl[name] = value
+		return cl
+	}
+
+	tests := []struct {
+		name    string
+		claims  map[string]interface{}
+		key     *rsa.PrivateKey
+		prefix  string
+		wantErr bool
+	}{
+		{"valid", valid(), nil, "", false},
+		{"bearer token", valid(), nil, "Bearer ", false},
+		{"wrong audience", with("aud", []string{"another-app"}), nil, "", true},
+		{"wrong issuer", with("iss", "https://evil.example.com"), nil, "", true},
+		{"expired", with("exp", time.Now().Add(-time.Hour).Unix()), nil, "", true},
+		{"signed by another key", valid(), other, "", true},
+		{"no token", nil, nil, "", true},
+	}
+
+	for _, f := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if f.claims != nil {
+			ti.signWith = f.key
+			req.Header.Set("Authorization", f.prefix+ti.sign(t, f.claims))
+		}
+		claims, err := v.verify(req)
+		if (err != nil) != f.wantErr {
+			t.Errorf("%s: verify() error = %v, wantErr %v", f.name, err, f.wantErr)
+			continue
+		}
+		if err == nil && claims["email"] != "alice@example.com" {
+			t.Errorf("%s: verify() claims = %v, want the token's", f.name, claims)
+		}
+	}
+	ti.signWith = nil
+}
+
+func TestNoAuthIndexHandlerVerified(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+
+	c.Auth.IPHeader = "Cf-Connecting-Ip"
+	// cloudflare, with the issuer and keys pointed at the stand-in issuer
+	c.Auth.Verify = applyVerifyDefaults(VerifyConfiguration{Type: "cloudflare", TeamDomain: "example.cloudflareaccess.com", Issuer: ti.URL, JwksURL: ti.URL + "/keys", Audience: "aud-tag"})
+	v, err := newHeaderVerifier(c.Auth.Verify)
+	if err != nil {
+		t.Fatalf("newHeaderVerifier(): %v", err)
+	}
+	headerVerifier = v
+	defer func() { headerVerifier, c.Auth.Verify, c.Auth.IPHeader = nil, VerifyConfiguration{}, "" }()
+
+	// no redis here, the static whitelist has the ip whitelisted
+	c.IPWhiteList = []string{"203.0.113.0/24"}
+	defer func() { c.IPWhiteList = nil }()
+
+	token := ti.sign(t, map[string]interface{}{
+		"iss":    ti.URL,
+		"aud":    []string{"aud-tag"},
+		"email":  "alice@example.com",
+		"groups": []string{"ops"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	})
+
+	tests := []struct {
+		name     string
+		header   string // Cf-Access-Authenticated-User-Email, ignored once verifying
+		token    string
+		wantCode int
+	}{
+		{"signed identity", "", token, http.StatusOK},
+		{"plain header only", "mallory@example.com", "", http.StatusUnauthorized},
+		{"forged token", "", token[:len(token)-4] + "AAAA", http.StatusUnauthorized},
+	}
+
+	for _, f := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Cf-Connecting-Ip", "203.0.113.7")
+		req.RemoteAddr = "10.0.0.1:5555"
+		if f.header != "" {
+			req.Header.Set("Cf-Access-Authenticated-User-Email", f.header)
+		}
+		if f.token != "" {
+			req.Header.Set("Cf-Access-Jwt-Assertion", f.token)
+		}
+		rr := httptest.NewRecorder()
+		handle(noAuthIndexHandler).ServeHTTP(rr, req)
+		if rr.Code != f.wantCode {
+			t.Errorf("%s: noAuthIndexHandler() code = %d, want %d", f.name, rr.Code, f.wantCode)
+		}
+		if f.wantCode == http.StatusOK && !strings.Contains(rr.Body.String(), "alice@example.com") {
+			t.Errorf("%s: noAuthIndexHandler() body missing the verified identity:\n%s", f.name, rr.Body.String())
+		}
+	}
+
+	// groups from the token make group-scoped resources available
+	var u User
+	claims := map[string]interface{}{"email": "alice@example.com", "groups": []interface{}{"ops"}}
+	vc := c.Auth.Verify
+	if u.newFromClaims(claims, vc.UserClaim, vc.NameClaim, vc.GroupsClaim, httptest.NewRequest("GET", "/", nil)); !reflect.DeepEqual(u.groups, []string{"ops"}) {
+		t.Errorf("user.newFromClaims(): groups = %v, want [ops]", u.groups)
+	}
+}
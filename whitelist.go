@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
-type Whitelist struct {
-	List map[string]string // key = alecpinson123456, value = 123.123.123.123/32
-}
+type Whitelist struct{}
+
+// syncMu stops resources being synced and checked for drift at the same time.
+var syncMu sync.Mutex
 
 func (*Whitelist) init() {
 	// load config
@@ -20,104 +23,229 @@ func (*Whitelist) init() {
 	if !r.connect(c.Redis) {
 		os.Exit(1)
 	}
+	go r.healthCheck()
+
+	// elect the replica that syncs resources, the others forward their syncs
+	// to it
+	l.campaign()
 
-	// enable ttl check on whitelisted ips
+	// remove whitelisted ips as they expire, with a periodic sweep as backup
+	go r.watchExpiry(w.expired)
 	go w.ttl()
 
+	// retry failed resource updates, pending ones are restored by the leader
+	go q.retry()
+
+	// check resources for drift, if enabled
+	go w.drift()
+
 	// initialize authentication
 	go h.init(c.Auth)
 
-	// update resources on startup
-	w.updateResources()
+	// update resources on startup. The leader does it before serving; on
+	// other replicas it's forwarded to the leader, which can take as long as
+	// the leader's own syncs, so they serve straight away
+	if t := s.trigger(); l.leading() {
+		t.wait()
+	}
 
 	// initialize http
 	h.start()
 }
 
 func (w *Whitelist) add(u *User) bool {
-	w.List = r.getWhitelist()
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	list, err := r.getWhitelist(ctx) // key = alecpinson123456, value = 123.123.123.123/32
+	if err != nil {
+		log.Print("whitelist.add(): ", err)
+		return false
+	}
 
 	if w.inRange(u.ip, c.IPWhiteList) {
 		return false
 	}
 
-	ret := r.addGroups(u.key, u.groups)
-	if !ret {
-		return ret
+	if err := r.addGroups(ctx, u.key, u.groups, u.lifetime()); err != nil {
+		log.Print("whitelist.add(): ", err)
+		return false
 	}
 
-	if w.List[u.key] != u.cidr {
+	if list[u.key] != u.cidr {
 		// need to update list
-		if w.List[u.key] == "" {
+		if list[u.key] == "" {
 			log.Println("whitelist.add(): no current whitelist for '" + u.key + "' was found, adding ip " + u.ip)
 		} else {
-			log.Println("whitelist.add(): updating whitelist for '" + u.key + "' from " + w.List[u.key] + " to " + u.ip)
+			log.Println("whitelist.add(): updating whitelist for '" + u.key + "' from " + list[u.key] + " to " + u.ip)
+		}
+		if err := r.addIp(ctx, u.key, u.cidr, u.lifetime()); err != nil {
+			log.Print("whitelist.add(): ", err)
+			return false
 		}
-		ret = r.addIp(u.key, u.cidr)
-		if !ret {
-			return ret
+		if err := r.apiCalled(ctx, u.key); err != nil {
+			log.Print("whitelist.add(): ", err)
 		}
-		r.apiCalled(u.key)
-		go w.updateResources()
+		s.trigger()
 		return true
 	} else {
 		// ip already whitelisted ... renew redis expiry time though
 		log.Println("whitelist.add(): no changes required for '" + u.key + "', ip already set to " + u.ip)
-		if r.canCallApi(u.key) {
-			r.apiCalled(u.key)
-			go w.updateResources()
+		canCall, err := r.canCallApi(ctx, u.key)
+		if err != nil {
+			log.Print("whitelist.add(): ", err)
 		}
-		return r.setIpExpiry(u.key)
+		if canCall {
+			if err := r.apiCalled(ctx, u.key); err != nil {
+				log.Print("whitelist.add(): ", err)
+			}
+			s.trigger()
+		}
+		if err := r.setIpExpiry(ctx, u.key, u.lifetime()); err != nil {
+			log.Print("whitelist.add(): ", err)
+			return false
+		}
+		return true
 	}
 }
 
-func (w *Whitelist) delete(u *User) bool {
-	ret := r.deleteIp(u.key)
-	if !ret {
-		return ret
+// delete removes a user's whitelisting and cached groups, then syncs the
+// resources it was applied to and returns their results. It returns false when
+// the whitelisting could not be removed.
+func (w *Whitelist) delete(u *User) (SyncReport, bool) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	cidr, _, err := r.getIp(ctx, u.key)
+	if err != nil {
+		log.Print("whitelist.delete(): ", err)
+		return SyncReport{}, false
+	}
+	stored := User{key: u.key, cidr: cidr, groups: r.getGroups(u.key)}
+	var ids []string
+	if cidr != "" {
+		ids = coveredResources(&stored)
 	}
-	w.updateResources()
-	log.Println("whitelist.delete(): whitelisting for '" + u.key + "' removed.")
-	return true
-}
 
-// trigger removal of ips due to ttl
-func (*Whitelist) ttl() {
-	// run every hour, might need increasing in future
-	for range time.Tick(time.Hour * 1) {
-		w.updateResources()
+	if err := r.deleteIp(ctx, u.key); err != nil {
+		log.Print("whitelist.delete(): ", err)
+		return SyncReport{}, false
 	}
+	if err := r.deleteGroups(ctx, u.key); err != nil {
+		log.Print("whitelist.delete(): ", err)
+	}
+	log.Println("whitelist.delete(): whitelisting for '" + u.key + "' removed.")
+	if len(ids) == 0 {
+		return SyncReport{}, true
+	}
+	return s.trigger(ids...).wait(), true
 }
 
-func (*Whitelist) updateResources() bool {
-	if c.Auth.TenantId == "notreal-not-real-not-notreal" {
-		return false
+// extend adds by to the time a user's whitelisting has left, and returns the
+// new time left, which is at most the maxLifetime of the resources the
+// whitelisting lands on. It returns false when there's no whitelisting to
+// extend.
+func (w *Whitelist) extend(user string, by time.Duration) (time.Duration, bool) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	cidr, ttl, err := r.getIp(ctx, user)
+	if err != nil {
+		log.Print("whitelist.extend(): ", err)
+		return 0, false
 	}
-	w.List = r.getWhitelist()
-	for _, fd := range a.FrontDoor {
-		fd.update()
+	if cidr == "" {
+		return 0, false
 	}
-	for _, st := range a.StorageAccount {
-		st.update()
+	groups, err := r.getUserGroups(ctx, user)
+	if err != nil {
+		log.Print("whitelist.extend(): ", err)
 	}
-	for _, kv := range a.KeyVault {
-		kv.update()
+	// no further than the user could have chosen themselves
+	u := &User{key: user, cidr: cidr, groups: groups}
+	if ttl += by; ttl > u.maxLifetime() {
+		ttl = u.maxLifetime()
 	}
-	for _, pg := range a.PostgresServer {
-		pg.update()
+	if err := r.setIpExpiry(ctx, user, ttl); err != nil {
+		log.Print("whitelist.extend(): ", err)
+		return 0, false
 	}
-	for _, rc := range a.RedisCache {
-		rc.update()
+	if err := r.setGroupExpiry(ctx, user, ttl); err != nil {
+		log.Print("whitelist.extend(): ", err)
+	}
+	log.Println("whitelist.extend(): whitelisting for '" + user + "' extended by " + by.String())
+	return ttl, true
+}
+
+// trigger removal of ips due to ttl, in case an expiry event was missed
+func (*Whitelist) ttl() {
+	interval := time.Duration(applySyncDefaults(c.Sync).Sweep) * time.Second
+	for range time.Tick(interval) {
+		if l.leading() {
+			s.trigger()
+		}
+	}
+}
+
+// expired syncs the resources a user's expired whitelisting was applied to.
+func (*Whitelist) expired(user string) {
+	// every replica sees the expiry, only the leader acts on it
+	if !l.leading() {
+		return
 	}
-	for _, cd := range a.CosmosDb {
-		cd.update()
+	log.Println("whitelist.expired(): whitelisting for '" + user + "' expired")
+	ids := expiryResources(p.enabled(), r.getGroups(user))
+	if len(ids) != 0 {
+		s.trigger(ids...)
 	}
-	if unifiEnabled(c.Unifi) {
-		for _, nl := range u.NetworkList {
-			nl.update()
+}
+
+// expiryResources returns the ids of the resources a user with groups may have
+// been whitelisted on. Without groups, e.g. when they've already expired from
+// the cache, every resource is included.
+func expiryResources(resources []Resource, groups []string) []string {
+	var ids []string
+	for _, res := range resources {
+		if len(groups) == 0 || hasGroup(res.Config.Group, groups) {
+			ids = append(ids, res.id())
 		}
 	}
-	return true
+	return ids
+}
+
+// updateResources reconciles the enabled resources with the given ids, or all
+// of them when none are given, against a fresh snapshot of the whitelist,
+// c.Sync.Concurrency at a time, and returns the combined result. Syncs should
+// be requested through s.trigger() rather than by calling this directly.
+func (*Whitelist) updateResources(ids ...string) SyncReport {
+	resources := p.enabled()
+	if len(ids) != 0 {
+		resources = filterResources(resources, ids)
+	}
+	if len(resources) == 0 {
+		return SyncReport{}
+	}
+
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	ctx, cancel := redisContext()
+	read := time.Now()
+	list, err := r.getWhitelist(ctx)
+	cancel()
+	if err != nil {
+		// syncing against a partial or empty list would wipe the rules, so
+		// leave every resource as it is and report it as failed
+		log.Print("whitelist.updateResources(): could not read the whitelist: ", err)
+		return failedReport(resources, err)
+	}
+
+	sc := applySyncDefaults(c.Sync)
+	report := reconcile(context.Background(), resources, list, sc.Concurrency, syncTimeout())
+	q.record(report)
+	recordSyncStatus(report, read)
+	log.Printf("whitelist.updateResources(): %d resources synced, %d failed", len(report.Results), len(report.Failed()))
+	return report
 }
 
 func (*Whitelist) inRange(ip string, whitelist []string) bool {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -82,7 +83,7 @@ func TestDelete(t *testing.T) {
 
 			ret = w.add(&testUser)
 			if ret == true {
-				ret = w.delete(&testUser)
+				_, ret = w.delete(&testUser)
 				if ret != f.success {
 					t.Errorf("user_test.TestAddFail(): Add IP that already exists in `ip_whitelist` range '%v', got '%v', want '%v'", f, ret, f.success)
 				}
@@ -101,17 +102,17 @@ func TestInRange(t *testing.T) {
 		success   bool
 	}{
 		// not in the (empty) static whitelist
-		{Whitelist{map[string]string{"alecpinson123456": "123.123.123.123/32"}}, "12.12.12.12/32", []string{}, false},
+		{Whitelist{}, "12.12.12.12/32", []string{}, false},
 		// covered by a static CIDR range
-		{Whitelist{map[string]string{"alecpinson123456": "123.123.123.123/32"}}, "1.2.3.4/32", []string{"1.2.3.0/24"}, true},
+		{Whitelist{}, "1.2.3.4/32", []string{"1.2.3.0/24"}, true},
 		// ipv6 is not matched against an ipv4 range
-		{Whitelist{map[string]string{"alecpinson123456": "123.123.123.123/32"}}, "2a00:11c7:1234:b801:a16e:12af:5e42:1100/32", []string{"1.2.3.0/24"}, false},
+		{Whitelist{}, "2a00:11c7:1234:b801:a16e:12af:5e42:1100/32", []string{"1.2.3.0/24"}, false},
 		// ipv6 with an empty static whitelist
-		{Whitelist{map[string]string{"alecpinson123456": "123.123.123.123/32"}}, "2a00:11c7:1234:b801:a16e:12af:5e42:1111/32", []string{}, false},
+		{Whitelist{}, "2a00:11c7:1234:b801:a16e:12af:5e42:1111/32", []string{}, false},
 		// a bare (non-CIDR) static whitelist entry that exactly matches
-		{Whitelist{map[string]string{"alecpinson123456": "123.123.123.123/32"}}, "203.0.113.5", []string{"203.0.113.5"}, true},
+		{Whitelist{}, "203.0.113.5", []string{"203.0.113.5"}, true},
 		// a bare static whitelist entry that does not match
-		{Whitelist{map[string]string{"alecpinson123456": "123.123.123.123/32"}}, "203.0.113.6", []string{"203.0.113.5"}, false},
+		{Whitelist{}, "203.0.113.6", []string{"203.0.113.5"}, false},
 	}
 
 	for _, f := range tests {
@@ -121,3 +122,26 @@ func TestInRange(t *testing.T) {
 		}
 	}
 }
+
+func TestExpiryResources(t *testing.T) {
+	resources := []Resource{
+		{Provider: &fakeProvider{name: "everyone"}},
+		{Provider: &fakeProvider{name: "group-a"}, Config: ResourceConfiguration{Group: []string{"group-a"}}},
+		{Provider: &fakeProvider{name: "group-b"}, Config: ResourceConfiguration{Group: []string{"group-b"}}},
+	}
+
+	tests := []struct {
+		groups []string
+		want   []string
+	}{
+		{[]string{"group-a"}, []string{"fake/everyone", "fake/group-a"}},
+		{[]string{"group-c"}, []string{"fake/everyone"}},
+		{nil, []string{"fake/everyone", "fake/group-a", "fake/group-b"}}, // groups already expired
+	}
+
+	for _, f := range tests {
+		if got := expiryResources(resources, f.groups); !reflect.DeepEqual(got, f.want) {
+			t.Errorf("expiryResources(%v) = %v, want %v", f.groups, got, f.want)
+		}
+	}
+}